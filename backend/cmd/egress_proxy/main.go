@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// An HTTP proxy only letting requests to allowlisted hosts through. It runs next to the
+// containers of rooms with the allowlist egress policy, which have no other way out.
+//
+//	EGRESS_ALLOWLIST=registry.npmjs.org,.pythonhosted.org   hosts, a leading dot allows subdomains
+//	EGRESS_PROXY_ADDR=:3128                                 address to listen on
+func main() {
+	allowlist := strings.Split(os.Getenv("EGRESS_ALLOWLIST"), ",")
+	addr := os.Getenv("EGRESS_PROXY_ADDR")
+	if addr == "" {
+		addr = ":3128"
+	}
+
+	proxy := &egressProxy{
+		allowlist: allowlist,
+		transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+
+	log.Printf("Egress proxy listening on %s, allowing %s", addr, strings.Join(allowlist, ", "))
+	if err := http.ListenAndServe(addr, proxy); err != nil {
+		log.Fatalf("Failed to start egress proxy: %v", err)
+	}
+}
+
+type egressProxy struct {
+	allowlist []string
+	transport *http.Transport
+}
+
+// allowed reports whether host, without port, is on the allowlist
+func (p *egressProxy) allowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range p.allowlist {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.HasPrefix(entry, "."):
+			if host == entry[1:] || strings.HasSuffix(host, entry) {
+				return true
+			}
+		case host == entry:
+			return true
+		}
+	}
+	return false
+}
+
+func (p *egressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Hostname()
+	if r.Method == http.MethodConnect {
+		host, _, _ = net.SplitHostPort(r.Host)
+	}
+	if !p.allowed(host) {
+		log.Printf("Blocked %s %s", r.Method, r.Host)
+		http.Error(w, "egress to "+host+" is not allowed in this room", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	p.forward(w, r)
+}
+
+// tunnel relays an HTTPS connection opened with CONNECT
+func (p *egressProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection for %s: %v", r.Host, err)
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The client may have sent the start of the TLS handshake along with CONNECT
+		io.Copy(upstream, buffered)
+		upstream.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+	<-done
+}
+
+// forward proxies a plain HTTP request
+func (p *egressProxy) forward(w http.ResponseWriter, r *http.Request) {
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Connection")
+	r.Header.Del("Proxy-Authorization")
+
+	resp, err := p.transport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"sync"
 	"time"
 
 	"github.com/ICBasecamp/K0/backend/pkg/docker"
@@ -37,7 +36,7 @@ func main() {
 
 	// Create the Docker client
 	log.Println("Creating Docker client...")
-	dockerClient, err := docker.CreateDockerClient()
+	dockerClient, err := docker.CreateRuntime()
 	if err != nil {
 		log.Fatalf("Failed to create Docker client: %v", err)
 	}
@@ -45,12 +44,17 @@ func main() {
 
 	// Create a container from the GitHub repository directly using Docker client
 	log.Printf("Creating container from GitHub repository: %s", githubURL)
-	var containerStreams sync.Map
-	response, err := dockerClient.BuildAndStartContainerFromGitHubWS(imageName, githubURL, &containerStreams)
+	// The image name doubles as the room, which pooled hosts place containers by
+	result, err := dockerClient.BuildImageFromGitHub(githubURL, docker.BuildOptions{RoomID: imageName})
+	if err != nil {
+		log.Fatalf("Failed to build image: %v", err)
+	}
+	response, err := dockerClient.StartContainer(result.Image, docker.StartOptions{RoomID: imageName})
 	if err != nil {
 		log.Fatalf("Failed to create container: %v", err)
 	}
 	log.Printf("Container created successfully with ID: %s", response.ID)
+	defer response.Result.Close()
 
 	// Give the container some time to run
 	log.Println("Waiting for container to run...")
@@ -69,5 +73,10 @@ func main() {
 	}
 	log.Println("Container removed successfully")
 
+	// Hands the host back to the pool
+	if err := dockerClient.RemoveRoomNetwork(imageName); err != nil {
+		log.Fatalf("Failed to remove room network: %v", err)
+	}
+
 	log.Println("Test completed successfully!")
 }
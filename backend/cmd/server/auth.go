@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// accessTokenParam carries the Supabase access token where browsers cannot set headers:
+// websockets and the first request of a preview
+const accessTokenParam = "access_token"
+
+// previewTokenCookie keeps a preview authenticated for the requests the app's page makes itself
+const previewTokenCookie = "k0_preview_token"
+
+// userIDKey is the Locals key holding the ID of the authenticated user
+const userIDKey = "user_id"
+
+// supabaseClaims are the claims of a Supabase access token K0 relies on
+type supabaseClaims struct {
+	Sub  string `json:"sub"`
+	Role string `json:"role"`
+	Exp  int64  `json:"exp"`
+}
+
+// verifyAccessToken checks the signature and expiry of a Supabase access token, signed with
+// the project's SUPABASE_JWT_SECRET, and returns the ID of the user it was issued to
+func verifyAccessToken(token string, now time.Time) (string, error) {
+	secret := os.Getenv("SUPABASE_JWT_SECRET")
+	if secret == "" {
+		return "", errors.New("SUPABASE_JWT_SECRET is not set")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed access token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	// The algorithm is fixed, trusting the header would allow "none"
+	if header.Alg != "HS256" {
+		return "", fmt.Errorf("unsupported access token algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed access token signature")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errors.New("invalid access token signature")
+	}
+
+	var claims supabaseClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if claims.Exp == 0 || now.Unix() >= claims.Exp {
+		return "", errors.New("access token expired")
+	}
+	// The anon and service role keys are signed with the same secret but belong to no user
+	if claims.Role != "authenticated" || claims.Sub == "" {
+		return "", errors.New("access token does not belong to a signed in user")
+	}
+	return claims.Sub, nil
+}
+
+func decodeTokenPart(part string, into any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed access token")
+	}
+	if err := json.Unmarshal(data, into); err != nil {
+		return errors.New("malformed access token")
+	}
+	return nil
+}
+
+// accessToken returns the token a request was made with: the Authorization bearer token,
+// the access_token query parameter, or the preview cookie
+func accessToken(c *fiber.Ctx) string {
+	if token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+		return token
+	}
+	if token := c.Query(accessTokenParam); token != "" {
+		return token
+	}
+	return c.Cookies(previewTokenCookie)
+}
+
+// isParticipant reports whether a user is listed in room_participants for a room
+func isParticipant(roomID, userID string) (bool, error) {
+	var participants []struct {
+		RoomID string `json:"room_id"`
+	}
+	_, err := supabaseClient.From("room_participants").
+		Select("room_id", "", false).
+		Eq("room_id", roomID).
+		Eq("user_id", userID).
+		Limit(1, "").
+		ExecuteTo(&participants)
+	if err != nil {
+		return false, err
+	}
+	return len(participants) > 0, nil
+}
+
+// requireUser only lets signed in users through, for routes that do not belong to a room
+func requireUser(c *fiber.Ctx) error {
+	userID, err := verifyAccessToken(accessToken(c), time.Now())
+	if err != nil {
+		return signInRequired(c, err)
+	}
+	c.Locals(userIDKey, userID)
+	return c.Next()
+}
+
+func signInRequired(c *fiber.Ctx, err error) error {
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"error": fmt.Sprintf("Sign in required: %v", err),
+	})
+}
+
+// requireParticipant only lets signed in users listed in room_participants for the room
+// roomOf finds through, and records activity for the room. The user is taken from the verified
+// access token, never from the client.
+func requireParticipant(roomOf func(c *fiber.Ctx) (string, bool)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, err := verifyAccessToken(accessToken(c), time.Now())
+		if err != nil {
+			return signInRequired(c, err)
+		}
+
+		roomID, ok := roomOf(c)
+		if !ok {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Not found",
+			})
+		}
+
+		participant, err := isParticipant(roomID, userID)
+		if err != nil {
+			log.Printf("Error checking participants of room %s: %v", roomID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check room participants",
+			})
+		}
+		if !participant {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Only participants of this room have access to it",
+			})
+		}
+
+		// Any request of a participant keeps the room's container alive, nobody else's does
+		activity.Touch(roomID)
+		c.Locals(userIDKey, userID)
+		return c.Next()
+	}
+}
+
+// roomParam finds the room in a route parameter
+func roomParam(param string) func(c *fiber.Ctx) (string, bool) {
+	return func(c *fiber.Ctx) (string, bool) {
+		roomID := c.Params(param)
+		return roomID, roomID != ""
+	}
+}
+
+// jobRoom finds the room of the job in the :id route parameter
+func jobRoom(c *fiber.Ctx) (string, bool) {
+	job, ok := jobs.Get(c.Params("id"))
+	if !ok {
+		return "", false
+	}
+	return job.RoomID, true
+}
+
+// connectionRoom finds the room of the websocket connection name in the :id route parameter,
+// which may be followed by "___" and a room ID that is not trusted
+func connectionRoom(c *fiber.Ctx) (string, bool) {
+	name := strings.Split(c.Params("id"), "___")[0]
+	if session, ok := sessions.ByName(name); ok {
+		return session.RoomID, true
+	}
+	if job, ok := jobs.ByName(name); ok {
+		return job.RoomID, true
+	}
+	return "", false
+}
+
+// bodyRoom finds the room in the body, parsed like the handler behind it does so both agree
+// on the room for JSON, form and XML bodies alike
+func bodyRoom(c *fiber.Ctx) (string, bool) {
+	var body struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return "", false
+	}
+	return body.RoomID, body.RoomID != ""
+}
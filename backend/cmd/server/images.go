@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/pkg/docker"
+	"github.com/gofiber/fiber/v2"
+)
+
+// imageUsage remembers when each cached image was last started or stopped, so the janitor
+// only evicts images nobody has used for a while
+type imageUsage struct {
+	mu       sync.Mutex
+	lastUsed map[string]time.Time
+}
+
+func newImageUsage() *imageUsage {
+	return &imageUsage{lastUsed: make(map[string]time.Time)}
+}
+
+// Touch records that images were used just now
+func (u *imageUsage) Touch(images ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	for _, image := range images {
+		u.lastUsed[image] = now
+	}
+}
+
+// LastUsed returns when an image was last used, created if it has not been since the server started
+func (u *imageUsage) LastUsed(image string, created time.Time) time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if t, ok := u.lastUsed[image]; ok && t.After(created) {
+		return t
+	}
+	return created
+}
+
+// Forget drops what is known about an evicted image
+func (u *imageUsage) Forget(image string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.lastUsed, image)
+}
+
+// imagesInUse returns the images run by a session or about to be by a running job
+func imagesInUse() map[string]bool {
+	inUse := make(map[string]bool)
+	for _, session := range sessions.All() {
+		for _, image := range session.images() {
+			inUse[image] = true
+		}
+	}
+	for _, job := range jobs.All() {
+		snapshot := job.Snapshot()
+		if snapshot.Phase == phaseReady || snapshot.Phase == phaseFailed {
+			continue
+		}
+		inUse[snapshot.Image] = true
+		for _, service := range snapshot.Services {
+			inUse[service.Image] = true
+		}
+	}
+	return inUse
+}
+
+// requireAdmin only lets requests with the ADMIN_TOKEN bearer token through. Admin routes
+// are disabled when no token is configured.
+func requireAdmin(c *fiber.Ctx) error {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Admin API is disabled",
+		})
+	}
+
+	given, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid admin token",
+		})
+	}
+	return c.Next()
+}
+
+// cachedImage is a cached image as reported by the admin API
+type cachedImage struct {
+	docker.CachedImage
+	LastUsed time.Time `json:"last_used"`
+	InUse    bool      `json:"in_use"`
+}
+
+// handleListImages lists the build cache with what each image was built from
+func handleListImages(c *fiber.Ctx) error {
+	images, err := dockerClient.ListCachedImages()
+	if err != nil {
+		log.Printf("Error listing cached images: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list cached images",
+		})
+	}
+
+	inUse := imagesInUse()
+	listed := make([]cachedImage, len(images))
+	for i, image := range images {
+		listed[i] = cachedImage{
+			CachedImage: image,
+			LastUsed:    imageUses.LastUsed(image.Reference, image.Created),
+			InUse:       inUse[image.Reference],
+		}
+	}
+	return c.JSON(listed)
+}
+
+// handleEvictImage removes a cached image by key, unless a room is running it
+func handleEvictImage(c *fiber.Ctx) error {
+	reference := docker.ImageCacheRepository + ":" + c.Params("key")
+	if imagesInUse()[reference] {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": fmt.Sprintf("%s is in use by a room", reference),
+		})
+	}
+
+	if err := dockerClient.RemoveCachedImage(reference); err != nil {
+		status := fiber.StatusInternalServerError
+		if docker.IsNotFound(err) {
+			status = fiber.StatusNotFound
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to evict %s: %v", reference, err),
+		})
+	}
+	imageUses.Forget(reference)
+	log.Printf("Evicted cached image %s", reference)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/pkg/docker"
+	"github.com/docker/go-units"
+)
+
+const (
+	defaultIdleTTL         = 30 * time.Minute
+	defaultMaxSessionTime  = 2 * time.Hour
+	defaultJanitorInterval = time.Minute
+	defaultImageTTL        = 24 * time.Hour
+)
+
+// activityTracker remembers when each room was last used. A room with an open websocket
+// counts as active for as long as the connection lasts.
+type activityTracker struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	conns    map[string]int
+}
+
+func newActivityTracker() *activityTracker {
+	return &activityTracker{
+		lastSeen: make(map[string]time.Time),
+		conns:    make(map[string]int),
+	}
+}
+
+// Touch records activity in a room
+func (a *activityTracker) Touch(roomID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastSeen[roomID] = time.Now()
+}
+
+// Connect records an open connection to a room until the returned function is called
+func (a *activityTracker) Connect(roomID string) (release func()) {
+	a.mu.Lock()
+	a.conns[roomID]++
+	a.lastSeen[roomID] = time.Now()
+	a.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.conns[roomID]--
+			if a.conns[roomID] <= 0 {
+				delete(a.conns, roomID)
+			}
+			a.lastSeen[roomID] = time.Now()
+		})
+	}
+}
+
+// IdleSince returns how long a room has had no activity, zero while it has open connections
+func (a *activityTracker) IdleSince(roomID string, now time.Time) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.conns[roomID] > 0 {
+		return 0
+	}
+	lastSeen, ok := a.lastSeen[roomID]
+	if !ok {
+		return 0
+	}
+	return now.Sub(lastSeen)
+}
+
+// Forget drops what is known about a room once it has been cleaned up
+func (a *activityTracker) Forget(roomID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conns[roomID] == 0 {
+		delete(a.lastSeen, roomID)
+	}
+}
+
+// janitor removes containers, images, streams and jobs nobody uses anymore
+type janitor struct {
+	IdleTTL        time.Duration // Rooms without activity for this long are cleaned up
+	MaxSessionTime time.Duration // Containers are removed after this long no matter what
+	Interval       time.Duration
+	ImageTTL       time.Duration // Cached images no room used for this long are evicted
+	BuildCacheSize int64         // The BuildKit cache is pruned down to this many bytes, never if zero
+}
+
+// newJanitorFromEnv reads SESSION_IDLE_TTL, SESSION_MAX_LIFETIME, JANITOR_INTERVAL and
+// IMAGE_CACHE_TTL, e.g. "45m", and BUILD_CACHE_MAX_SIZE, e.g. "20GB"
+func newJanitorFromEnv() *janitor {
+	j := &janitor{
+		IdleTTL:        durationFromEnv("SESSION_IDLE_TTL", defaultIdleTTL),
+		MaxSessionTime: durationFromEnv("SESSION_MAX_LIFETIME", defaultMaxSessionTime),
+		Interval:       durationFromEnv("JANITOR_INTERVAL", defaultJanitorInterval),
+		ImageTTL:       durationFromEnv("IMAGE_CACHE_TTL", defaultImageTTL),
+	}
+	if size := os.Getenv("BUILD_CACHE_MAX_SIZE"); size != "" {
+		bytes, err := units.RAMInBytes(size)
+		if err != nil {
+			log.Printf("Ignoring invalid BUILD_CACHE_MAX_SIZE %q: %v", size, err)
+		} else {
+			j.BuildCacheSize = bytes
+		}
+	}
+	return j
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// Run sweeps every Interval until the process exits
+func (j *janitor) Run() {
+	log.Printf("Janitor running every %s (idle TTL %s, max session %s)", j.Interval, j.IdleTTL, j.MaxSessionTime)
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		j.sweep(time.Now())
+	}
+}
+
+func (j *janitor) sweep(now time.Time) {
+	for _, session := range sessions.All() {
+		reason := ""
+		switch {
+		case now.Sub(session.StartedAt) > j.MaxSessionTime:
+			reason = "max session length reached"
+		case activity.IdleSince(session.RoomID, now) > j.IdleTTL:
+			reason = "idle"
+		default:
+			continue
+		}
+
+		log.Printf("Reaping container %s of room %s: %s", session.ContainerID, session.RoomID, reason)
+		if err := removeSession(session); err != nil {
+			log.Printf("Error reaping container %s: %v", session.ContainerID, err)
+			continue
+		}
+		markRoomExpired(session.RoomID, reason)
+		activity.Forget(session.RoomID)
+	}
+
+	// Finished jobs only matter while someone may still look at their progress
+	for _, job := range jobs.All() {
+		snapshot := job.Snapshot()
+		if snapshot.Phase != phaseReady && snapshot.Phase != phaseFailed {
+			continue
+		}
+		if now.Sub(snapshot.UpdatedAt) > j.IdleTTL {
+			outputHub.Remove(jobTopicID(job.ID))
+			jobs.Delete(job)
+		}
+	}
+
+	j.removeOrphans(now)
+}
+
+// removeOrphans cleans up containers, networks and images of ours that no session or running job
+// knows about, e.g. from failed builds or from before the server restarted
+func (j *janitor) removeOrphans(now time.Time) {
+	inUse := make(map[string]bool)
+	for _, session := range sessions.All() {
+		inUse[session.Name] = true
+		inUse[session.ContainerID] = true
+		inUse[session.RoomID] = true
+	}
+	for _, job := range jobs.All() {
+		if phase := job.Snapshot().Phase; phase != phaseReady && phase != phaseFailed {
+			inUse[job.Name] = true
+			inUse[job.RoomID] = true
+		}
+	}
+
+	containers, err := dockerClient.ListContainers(imagePrefix, docker.ImageCacheRepository+":")
+	if err != nil {
+		log.Printf("Janitor failed to list containers: %v", err)
+		return
+	}
+	for _, c := range containers {
+		if inUse[c.ID] || inUse[imageRepository(c.Image)] || inUse[c.Stack] || now.Sub(c.Created) < j.IdleTTL {
+			// Its room's network can't go away yet either
+			inUse[c.RoomID] = true
+			continue
+		}
+		log.Printf("Removing orphaned container %s (%s)", c.ID, c.Image)
+		if err := dockerClient.RemoveContainer(c.ID); err != nil {
+			log.Printf("Error removing orphaned container %s: %v", c.ID, err)
+		}
+	}
+
+	volumes, err := dockerClient.StackVolumes()
+	if err != nil {
+		log.Printf("Janitor failed to list stack volumes: %v", err)
+		return
+	}
+	for name, stack := range volumes {
+		if inUse[stack] {
+			continue
+		}
+		// Fails while a container still uses the volume, the next sweep tries again
+		log.Printf("Removing orphaned volume %s", name)
+		if err := dockerClient.RemoveStackVolume(name); err != nil {
+			log.Printf("Error removing orphaned volume %s: %v", name, err)
+		}
+	}
+
+	rooms, err := dockerClient.RoomNetworks()
+	if err != nil {
+		log.Printf("Janitor failed to list room networks: %v", err)
+		return
+	}
+	for _, roomID := range rooms {
+		if inUse[roomID] {
+			continue
+		}
+		log.Printf("Removing network of room %s", roomID)
+		if err := dockerClient.RemoveRoomNetwork(roomID); err != nil {
+			log.Printf("Error removing network of room %s: %v", roomID, err)
+		}
+	}
+
+	images, err := dockerClient.ListImages(imagePrefix + "*")
+	if err != nil {
+		log.Printf("Janitor failed to list images: %v", err)
+		return
+	}
+	for _, img := range images {
+		if now.Sub(img.Created) < j.IdleTTL {
+			continue
+		}
+		for _, tag := range img.Tags {
+			if inUse[imageRepository(tag)] {
+				continue
+			}
+			log.Printf("Removing orphaned image %s", tag)
+			if err := dockerClient.RemoveImage(tag); err != nil {
+				log.Printf("Error removing orphaned image %s: %v", tag, err)
+			}
+		}
+	}
+
+	j.evictImages(now)
+}
+
+// evictImages removes cached images no room has used for ImageTTL, and trims the BuildKit
+// cache. Layers and cache entries keep later builds of changed commits quick.
+func (j *janitor) evictImages(now time.Time) {
+	images, err := dockerClient.ListCachedImages()
+	if err != nil {
+		log.Printf("Janitor failed to list cached images: %v", err)
+		return
+	}
+	inUse := imagesInUse()
+	for _, image := range images {
+		if inUse[image.Reference] || now.Sub(imageUses.LastUsed(image.Reference, image.Created)) < j.ImageTTL {
+			continue
+		}
+		log.Printf("Evicting cached image %s built from %s at %s", image.Reference, image.Remote, image.Commit)
+		if err := dockerClient.RemoveCachedImage(image.Reference); err != nil && !docker.IsNotFound(err) {
+			// Containers of a room may still be using it
+			log.Printf("Error evicting cached image %s: %v", image.Reference, err)
+			continue
+		}
+		imageUses.Forget(image.Reference)
+	}
+
+	if j.BuildCacheSize > 0 {
+		reclaimed, err := dockerClient.PruneBuildCache(j.BuildCacheSize)
+		if err != nil {
+			log.Printf("Janitor failed to prune build cache: %v", err)
+		} else if reclaimed > 0 {
+			log.Printf("Pruned %s of build cache", units.HumanSize(float64(reclaimed)))
+		}
+	}
+}
+
+// imageRepository strips the tag off an image name, compose services are tagged with their name
+func imageRepository(image string) string {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
+
+// markRoomExpired records on the room that its container was cleaned up
+func markRoomExpired(roomID, reason string) {
+	_, _, err := supabaseClient.From("running_rooms").Update(
+		map[string]any{
+			"status":         "expired",
+			"expired_at":     time.Now().UTC().Format(time.RFC3339),
+			"expired_reason": reason,
+		},
+		"",
+		"",
+	).Eq("id", roomID).Execute()
+	if err != nil {
+		log.Printf("Error marking room %s as expired: %v", roomID, err)
+	}
+}
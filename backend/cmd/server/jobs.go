@@ -0,0 +1,541 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/internal/git"
+	"github.com/ICBasecamp/K0/backend/pkg/containerize"
+	"github.com/ICBasecamp/K0/backend/pkg/docker"
+	"github.com/ICBasecamp/K0/backend/pkg/transcript"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// jobPhase is where a build job currently is
+type jobPhase string
+
+const (
+	phaseQueued   jobPhase = "queued"
+	phaseCloning  jobPhase = jobPhase(docker.PhaseCloning)
+	phaseBuilding jobPhase = jobPhase(docker.PhaseBuilding)
+	phaseStarting jobPhase = "starting"
+	phaseReady    jobPhase = "ready"
+	phaseFailed   jobPhase = "failed"
+)
+
+// buildJob clones, builds and starts a repository for a room in the background
+type buildJob struct {
+	ID         string
+	RoomID     string
+	GitHubLink string
+	Ref        string // What was asked for, the default branch if empty
+	Name       string // Websocket connection name of the container output, also names a compose stack
+	Build      buildSpec
+	Resources  docker.ResourceProfile
+	Egress     docker.EgressPolicy
+	CreatedAt  time.Time
+
+	mu          sync.Mutex
+	phase       jobPhase
+	err         string
+	commit      string                // Resolved from Ref once cloned
+	image       string                // Built or reused image, see docker.ImageCacheRepository
+	cached      bool                  // The image was reused from an identical earlier build
+	context     *git.ContextStats     // Size of the build context once sent
+	generated   *containerize.Project // What a generated Dockerfile was made for
+	credential  *git.Credential       // Dropped as soon as the clone is done
+	containerID string
+	services    []docker.StackService // Containers of a compose stack, in start order
+	status      *docker.ReadyStatus
+	updatedAt   time.Time
+	events      io.WriteCloser // Feeds the job's event topic, see jobTopicID
+
+	settled chan struct{} // Closed once the container output topic exists or the job failed
+}
+
+// jobEvent is one message on a job's event stream, sent as a JSON text frame
+type jobEvent struct {
+	Type   string                   `json:"type"` // "phase" or "build"
+	Phase  jobPhase                 `json:"phase,omitempty"`
+	Error  string                   `json:"error,omitempty"`
+	Status *docker.ReadyStatus      `json:"status,omitempty"`
+	Build  *jsonmessage.JSONMessage `json:"build,omitempty"`
+}
+
+// jobSnapshot is the JSON representation of a job returned by the API
+type jobSnapshot struct {
+	ID               string                `json:"id"`
+	RoomID           string                `json:"room_id"`
+	GitHubLink       string                `json:"github_link"`
+	Ref              string                `json:"ref,omitempty"`
+	CommitSHA        string                `json:"commit_sha,omitempty"`
+	Image            string                `json:"image,omitempty"`
+	Cached           bool                  `json:"cached"` // Reused the image of an identical earlier build
+	Dockerfile       string                `json:"dockerfile,omitempty"`
+	ContextDir       string                `json:"context_dir,omitempty"`
+	Target           string                `json:"target,omitempty"`
+	BuildContext     *git.ContextStats     `json:"build_context,omitempty"`
+	Generated        *containerize.Project `json:"generated,omitempty"` // Set if the Dockerfile was generated
+	ComposeFile      string                `json:"compose_file,omitempty"`
+	WSConnectionName string                `json:"ws_connection_name"`
+	ResourceProfile  string                `json:"resource_profile"`
+	Egress           docker.EgressPolicy   `json:"egress"`
+	Phase            jobPhase              `json:"phase"`
+	Error            string                `json:"error,omitempty"`
+	ContainerID      string                `json:"container_id,omitempty"`
+	Services         []docker.StackService `json:"services,omitempty"` // Set for compose stacks, ContainerID is the primary service
+	Status           *docker.ReadyStatus   `json:"status,omitempty"`
+	CreatedAt        time.Time             `json:"created_at"`
+	UpdatedAt        time.Time             `json:"updated_at"`
+}
+
+// buildSpec is how a repository's image is built. Empty fields are worked out from the repository.
+type buildSpec struct {
+	Dockerfile   string            `json:"dockerfile"`    // Relative to the repository root
+	ContextDir   string            `json:"context_dir"`   // Relative to the repository root
+	Target       string            `json:"target"`        // Stage of a multi-stage Dockerfile
+	BuildArgs    map[string]string `json:"build_args"`    // Values for ARG instructions
+	Generate     bool              `json:"generate"`      // Generate a Dockerfile even if the repository has one
+	StartCommand string            `json:"start_command"` // Replaces the start command of a generated Dockerfile
+	ComposeFile  string            `json:"compose_file"`  // Relative to the repository root, run as a stack
+}
+
+// validate cleans the paths of the spec and checks the rest
+func (b *buildSpec) validate() error {
+	var err error
+	if b.Dockerfile != "" {
+		if b.Dockerfile, err = git.CleanRepoPath(b.Dockerfile); err != nil {
+			return fmt.Errorf("invalid dockerfile: %w", err)
+		}
+		if b.Dockerfile == "." {
+			return fmt.Errorf("invalid dockerfile: %q is not a file", b.Dockerfile)
+		}
+	}
+	if b.ContextDir != "" {
+		if b.ContextDir, err = git.CleanRepoPath(b.ContextDir); err != nil {
+			return fmt.Errorf("invalid context_dir: %w", err)
+		}
+	}
+	if b.ComposeFile != "" {
+		if b.ComposeFile, err = git.CleanRepoPath(b.ComposeFile); err != nil {
+			return fmt.Errorf("invalid compose_file: %w", err)
+		}
+		if b.Dockerfile != "" || b.Generate {
+			return fmt.Errorf("compose_file can't be combined with dockerfile or generate")
+		}
+	}
+	if b.Target != "" && !stageName.MatchString(b.Target) {
+		return fmt.Errorf("invalid target %q", b.Target)
+	}
+	for key := range b.BuildArgs {
+		if !buildArgName.MatchString(key) {
+			return fmt.Errorf("invalid build arg name %q", key)
+		}
+	}
+	return nil
+}
+
+var (
+	stageName    = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]*$`)
+	buildArgName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// imagePrefix starts the name of every image and container built for a room
+const imagePrefix = "github-container-"
+
+// jobTopicID is the output hub topic carrying a job's events
+func jobTopicID(jobID string) string {
+	return "job-" + jobID
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Snapshot returns the current state of the job
+func (j *buildJob) Snapshot() jobSnapshot {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return jobSnapshot{
+		ID:               j.ID,
+		RoomID:           j.RoomID,
+		GitHubLink:       j.GitHubLink,
+		Ref:              j.Ref,
+		CommitSHA:        j.commit,
+		Image:            j.image,
+		Cached:           j.cached,
+		Dockerfile:       j.Build.Dockerfile,
+		ContextDir:       j.Build.ContextDir,
+		Target:           j.Build.Target,
+		BuildContext:     j.context,
+		Generated:        j.generated,
+		ComposeFile:      j.Build.ComposeFile,
+		WSConnectionName: j.Name,
+		ResourceProfile:  j.Resources.Name,
+		Egress:           j.Egress,
+		Phase:            j.phase,
+		Error:            j.err,
+		ContainerID:      j.containerID,
+		Services:         j.services,
+		Status:           j.status,
+		CreatedAt:        j.CreatedAt,
+		UpdatedAt:        j.updatedAt,
+	}
+}
+
+// Settled is closed once viewers can attach to the container output or the job failed
+func (j *buildJob) Settled() <-chan struct{} {
+	return j.settled
+}
+
+// emit publishes an event to everyone following the job
+func (j *buildJob) emit(event jobEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event of job %s: %v", j.ID, err)
+		return
+	}
+	j.events.Write(data)
+}
+
+// setPhase moves the job to a new phase and announces it
+func (j *buildJob) setPhase(phase jobPhase) {
+	j.mu.Lock()
+	j.phase = phase
+	j.updatedAt = time.Now()
+	j.mu.Unlock()
+
+	log.Printf("Job %s for room %s is %s", j.ID, j.RoomID, phase)
+	j.emit(jobEvent{Type: "phase", Phase: phase})
+}
+
+// fail marks the job as failed and ends its event stream
+func (j *buildJob) fail(err error, status *docker.ReadyStatus) {
+	j.mu.Lock()
+	j.phase = phaseFailed
+	j.err = err.Error()
+	j.status = status
+	j.updatedAt = time.Now()
+	j.mu.Unlock()
+
+	log.Printf("Job %s for room %s failed: %v", j.ID, j.RoomID, err)
+	j.emit(jobEvent{Type: "phase", Phase: phaseFailed, Error: err.Error(), Status: status})
+}
+
+// jobRegistry keeps every job by id and the latest job of each room
+type jobRegistry struct {
+	mu     sync.RWMutex
+	byID   map[string]*buildJob
+	byName map[string]*buildJob
+	byRoom map[string]*buildJob
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{
+		byID:   make(map[string]*buildJob),
+		byName: make(map[string]*buildJob),
+		byRoom: make(map[string]*buildJob),
+	}
+}
+
+// Add registers a job as the latest one of its room
+func (r *jobRegistry) Add(j *buildJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.byID[j.ID] = j
+	r.byName[j.Name] = j
+	r.byRoom[j.RoomID] = j
+}
+
+// Get returns the job with the given id
+func (r *jobRegistry) Get(id string) (*buildJob, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	j, ok := r.byID[id]
+	return j, ok
+}
+
+// ByName returns the job producing the container with the given websocket connection name
+func (r *jobRegistry) ByName(name string) (*buildJob, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	j, ok := r.byName[name]
+	return j, ok
+}
+
+// ByRoom returns the latest job of a room
+func (r *jobRegistry) ByRoom(roomID string) (*buildJob, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	j, ok := r.byRoom[roomID]
+	return j, ok
+}
+
+// All returns every registered job
+func (r *jobRegistry) All() []*buildJob {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make([]*buildJob, 0, len(r.byID))
+	for _, j := range r.byID {
+		all = append(all, j)
+	}
+	return all
+}
+
+// Delete forgets a job
+func (r *jobRegistry) Delete(j *buildJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.byID, j.ID)
+	if r.byName[j.Name] == j {
+		delete(r.byName, j.Name)
+	}
+	if r.byRoom[j.RoomID] == j {
+		delete(r.byRoom, j.RoomID)
+	}
+}
+
+// startBuildJob registers a job for importing githubLink into a room and runs it in the background
+func startBuildJob(roomID, githubLink, ref string, credential *git.Credential, build buildSpec, resources docker.ResourceProfile, egress docker.EgressPolicy) (*buildJob, error) {
+	now := time.Now()
+	job := &buildJob{
+		ID:         newJobID(),
+		RoomID:     roomID,
+		GitHubLink: githubLink,
+		Ref:        ref,
+		// create unique image name based on room id and timestamp
+		// we use imagename as ws connection name, but container id is still required for stopping and removing the container
+		Name:       fmt.Sprintf("%s%s-%d", imagePrefix, roomID, now.UnixNano()),
+		Build:      build,
+		Resources:  resources,
+		Egress:     egress,
+		credential: credential,
+		CreatedAt:  now,
+		phase:      phaseQueued,
+		updatedAt:  now,
+		settled:    make(chan struct{}),
+	}
+
+	_, events, err := outputHub.OpenWriter(jobTopicID(job.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job event stream: %w", err)
+	}
+	job.events = events
+
+	jobs.Add(job)
+	go runBuildJob(job)
+
+	return job, nil
+}
+
+// runBuildJob takes a job through cloning, building, starting and readiness
+func runBuildJob(job *buildJob) {
+	defer job.events.Close()
+
+	settle := sync.OnceFunc(func() { close(job.settled) })
+	defer settle()
+
+	result, err := dockerClient.BuildImageFromGitHub(job.GitHubLink, docker.BuildOptions{
+		Resources:    job.Resources,
+		Ref:          job.Ref,
+		Credential:   job.credential,
+		Dockerfile:   job.Build.Dockerfile,
+		ContextDir:   job.Build.ContextDir,
+		Target:       job.Build.Target,
+		BuildArgs:    job.Build.BuildArgs,
+		Generate:     job.Build.Generate,
+		StartCommand: job.Build.StartCommand,
+		ComposeFile:  job.Build.ComposeFile,
+		RoomID:       job.RoomID,
+		OnPhase: func(phase docker.BuildPhase) {
+			job.setPhase(jobPhase(phase))
+		},
+		OnMessage: func(message jsonmessage.JSONMessage) {
+			job.emit(jobEvent{Type: "build", Build: &message})
+		},
+	})
+	job.mu.Lock()
+	job.credential = nil
+	job.mu.Unlock()
+	if err != nil {
+		job.fail(err, nil)
+		return
+	}
+
+	job.mu.Lock()
+	job.commit = result.Commit
+	job.image = result.Image
+	job.cached = result.Cached
+	job.Build.Dockerfile = result.Dockerfile
+	job.Build.ContextDir = result.ContextDir
+	if !result.Cached {
+		job.context = &result.Context
+	}
+	job.generated = result.Generated
+	if result.Compose != nil {
+		job.Build.ComposeFile = result.Compose.File
+	}
+	job.mu.Unlock()
+	recordRoomCommit(job.RoomID, job.Ref, result.Commit)
+
+	job.setPhase(phaseStarting)
+	options := docker.StartOptions{
+		Resources: job.Resources,
+		RoomID:    job.RoomID,
+		Egress:    job.Egress,
+	}
+	var response docker.StackResponse
+	if result.Compose != nil {
+		response, err = dockerClient.StartStack(job.Name, result.Compose, options)
+	} else {
+		response.TerminalResponse, err = dockerClient.StartContainer(result.Image, options)
+	}
+	if err != nil {
+		job.fail(fmt.Errorf("failed to start container %s: %w", job.Name, err), nil)
+		return
+	}
+	log.Printf("Container created successfully with ID: %s", response.ID)
+
+	job.mu.Lock()
+	job.containerID = response.ID
+	job.services = response.Services
+	job.mu.Unlock()
+
+	if err := attachContainer(job.RoomID, job.Name, result.Image, response); err != nil {
+		job.fail(err, nil)
+		return
+	}
+	settle()
+
+	// Wait for the app to come up, or to crash, before telling the room about it.
+	// Output stays available on the websocket when the container crashed, so viewers can see why.
+	status, err := dockerClient.WaitReady(response.ID, response.Ports, docker.ReadyTimeout())
+	if err != nil {
+		job.fail(fmt.Errorf("failed to check container status: %w", err), nil)
+		return
+	}
+	if status.State != docker.ReadyStateReady {
+		job.fail(fmt.Errorf("container is %s", status.State), &status)
+		return
+	}
+
+	job.mu.Lock()
+	job.status = &status
+	job.mu.Unlock()
+	job.setPhase(phaseReady)
+}
+
+// recordRoomCommit stores on the room which commit its container was built from
+func recordRoomCommit(roomID, ref, commit string) {
+	_, _, err := supabaseClient.From("running_rooms").Update(
+		map[string]any{
+			"ref":        ref,
+			"commit_sha": commit,
+		},
+		"",
+		"",
+	).Eq("id", roomID).Execute()
+	if err != nil {
+		log.Printf("Error recording commit of room %s: %v", roomID, err)
+	}
+}
+
+// attachContainer hands a started container's output to the hub, starts persisting it
+// and makes the container, or compose stack, the room's current session in place of the
+// previous one
+func attachContainer(roomID, name, image string, response docker.StackResponse) error {
+	// The hub owns the log stream from here on and fans it out to every viewer
+	topic, err := outputHub.Open(name, response.Result, docker.CopyLogs)
+	if err != nil {
+		response.Result.Close()
+		return fmt.Errorf("failed to open output stream: %w", err)
+	}
+
+	// Persist the output once per container, whether or not anyone is watching
+	go transcript.NewWriter(transcriptStore, roomID).Run(topic)
+
+	session := &roomSession{
+		RoomID:      roomID,
+		Name:        name,
+		Image:       image,
+		ContainerID: response.ID,
+		Ports:       response.Ports,
+		Services:    response.Services,
+		StartedAt:   time.Now(),
+	}
+	imageUses.Touch(session.images()...)
+
+	// Importing again replaces the room's container, the previous one goes with its output stream
+	if prev := sessions.Put(session); prev != nil {
+		if err := removeSession(prev); err != nil {
+			log.Printf("Error removing previous container %s of room %s: %v", prev.ContainerID, roomID, err)
+		}
+	}
+	return nil
+}
+
+// handleJobStatus reports the phase of a build job
+func handleJobStatus(c *fiber.Ctx) error {
+	job, ok := jobs.Get(c.Params("id"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Job not found",
+		})
+	}
+	return c.JSON(job.Snapshot())
+}
+
+// handleRoomJob reports the latest build job of a room, so everyone in it can follow along
+func handleRoomJob(c *fiber.Ctx) error {
+	job, ok := jobs.ByRoom(c.Params("id"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No job for this room",
+		})
+	}
+	return c.JSON(job.Snapshot())
+}
+
+// handleJobEvents streams a job's phase changes and decoded build output, replaying
+// everything that happened before the client connected
+func handleJobEvents(c *websocket.Conn) {
+	job, ok := jobs.Get(c.Params("id"))
+	if !ok {
+		c.WriteMessage(websocket.TextMessage, []byte("Invalid job ID"))
+		return
+	}
+	topic, ok := outputHub.Get(jobTopicID(job.ID))
+	if !ok {
+		c.WriteMessage(websocket.TextMessage, []byte("Invalid job ID"))
+		return
+	}
+	defer activity.Connect(job.RoomID)()
+
+	sub := topic.Subscribe(0)
+	defer sub.Close()
+
+	for chunk := range sub.Chunks() {
+		if err := c.WriteMessage(websocket.TextMessage, chunk.Data); err != nil {
+			return
+		}
+	}
+	c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "job finished"))
+}
@@ -1,17 +1,18 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
-	"unicode"
 
+	"github.com/ICBasecamp/K0/backend/internal/git"
 	"github.com/ICBasecamp/K0/backend/pkg/docker"
+	"github.com/ICBasecamp/K0/backend/pkg/docker/dockertest"
+	"github.com/ICBasecamp/K0/backend/pkg/stream"
+	"github.com/ICBasecamp/K0/backend/pkg/transcript"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/websocket/v2"
@@ -21,9 +22,14 @@ import (
 )
 
 var (
-	ContainerStreams = sync.Map{}
-	supabaseClient   *supabase.Client
-	dockerClient     *docker.DockerClient
+	outputHub       *stream.Hub
+	supabaseClient  *supabase.Client
+	transcriptStore transcript.Store
+	dockerClient    docker.Runtime
+	sessions        = newSessionRegistry()
+	jobs            = newJobRegistry()
+	activity        = newActivityTracker()
+	imageUses       = newImageUsage()
 )
 
 func main() {
@@ -34,15 +40,34 @@ func main() {
 	}
 	log.Println("Environment file loaded successfully")
 
+	// Output hub keeps recent container output around so late joiners can replay it
+	replayBytes, _ := strconv.Atoi(os.Getenv("OUTPUT_REPLAY_BYTES"))
+	outputHub = stream.NewHub(stream.Config{
+		ReplayBytes: replayBytes,
+		SpillDir:    os.Getenv("OUTPUT_SPILL_DIR"),
+	})
+
+	// Operators can tune the resource profiles rooms choose from
+	if path := os.Getenv("RESOURCE_PROFILES_FILE"); path != "" {
+		if err := docker.LoadResourceProfiles(path); err != nil {
+			log.Fatalf("Failed to load resource profiles: %v", err)
+		}
+	}
+
 	// S3 client removed - no longer needed for simplified Docker service
 
-	// Create Docker client
-	log.Println("Creating Docker client...")
-	dockerClient, err = docker.CreateDockerClient()
-	if err != nil {
-		log.Fatalf("Failed to create Docker client: %v", err)
+	// Create Docker client, or the in-memory fake to run the server without Docker
+	if os.Getenv("CONTAINER_RUNTIME") == "fake" {
+		log.Println("Using the fake container runtime")
+		dockerClient = dockertest.New()
+	} else {
+		log.Println("Creating Docker client...")
+		dockerClient, err = docker.CreateRuntime()
+		if err != nil {
+			log.Fatalf("Failed to create Docker client: %v", err)
+		}
+		log.Println("Docker client created successfully")
 	}
-	log.Println("Docker client created successfully")
 
 	// Create supabase client
 	log.Println("Initializing Supabase client...")
@@ -52,7 +77,21 @@ func main() {
 		log.Fatalf("Failed to initialize Supabase client: %v", supabaseErr)
 	}
 	log.Println("Supabase client initialized successfully")
+	transcriptStore = transcript.NewSupabaseStore(supabaseClient)
+
+	app := newApp()
 
+	// stop and remove containers nobody uses anymore
+	go newJanitorFromEnv().Run()
+
+	log.Println("Starting server on port 3009...")
+	if err := app.Listen(":3009"); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+// newApp registers every route of the API on a new app, using the clients set up by main
+func newApp() *fiber.App {
 	app := fiber.New(fiber.Config{
 		ReadBufferSize:  1024 * 1024,
 		WriteBufferSize: 1024 * 1024,
@@ -61,8 +100,8 @@ func main() {
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "http://localhost:3000",
-		AllowHeaders: "Origin, Content-Type, Accept, Connection, Upgrade",
-		AllowMethods: "GET, POST, OPTIONS",
+		AllowHeaders: "Origin, Content-Type, Accept, Connection, Upgrade, Authorization",
+		AllowMethods: "GET, POST, PUT, PATCH, DELETE, OPTIONS",
 	}))
 
 	app.Use("/ws/*", func(c *fiber.Ctx) error {
@@ -92,10 +131,16 @@ func main() {
 		return c.SendString("testing")
 	})
 
-	app.Post("/start-github-container", func(c *fiber.Ctx) error {
+	// only participants of the room may import into it
+	app.Post("/start-github-container", requireParticipant(bodyRoom), func(c *fiber.Ctx) error {
 		type RequestBody struct {
-			RoomID     string `json:"room_id"`
-			GitHubLink string `json:"github_link"`
+			RoomID          string          `json:"room_id"`
+			GitHubLink      string          `json:"github_link"`
+			Ref             string          `json:"ref"`              // Branch, tag, commit SHA or pull/N, the default branch if empty
+			Credential      *git.Credential `json:"credential"`       // Short-lived token or deploy key for private repositories
+			ResourceProfile string          `json:"resource_profile"` // small, medium or large, medium if empty
+			Egress          string          `json:"egress"`           // none, allowlist or full, see docker.ParseEgressPolicy
+			buildSpec                       // dockerfile, context_dir, target, build_args, generate and start_command, see buildSpec
 		}
 
 		var requestBody RequestBody
@@ -111,32 +156,104 @@ func main() {
 			})
 		}
 
-		// create unique image name based on room id and timestamp
-		// we use imagename as ws connection name, but container id is still required for stopping and removing the container
-		imageName := fmt.Sprintf("github-container-%s-%d", requestBody.RoomID, time.Now().Unix())
+		// Any allowed git host works, the field name predates support for more than GitHub
+		if _, err := git.ParseRepository(requestBody.GitHubLink); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if err := git.ValidateRef(requestBody.Ref); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if err := requestBody.buildSpec.validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 
-		// Create container directly using Docker client - simplified for microservice architecture
-		response, err := dockerClient.BuildAndStartContainerFromGitHubWS(imageName, requestBody.GitHubLink, &ContainerStreams)
+		resources, err := docker.LookupResourceProfile(requestBody.ResourceProfile)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to create container: %v", err),
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
 			})
 		}
 
-		log.SetFlags(log.LstdFlags | log.Lshortfile)
-		log.Println("Starting GitHub container...")
-		log.Printf("Container created successfully with ID: %s", response.ID)
+		egress, err := docker.ParseEgressPolicy(requestBody.Egress)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 
-		// Sleep for 5 seconds to allow container to start up
-		time.Sleep(5 * time.Second)
+		activity.Touch(requestBody.RoomID)
 
-		// Return the WebSocket connection name immediately
-		return c.JSON(fiber.Map{
-			"ws_connection_name": imageName,
-			"container_id":       response.ID,
+		// Clone, build and start in the background, progress is available through the job
+		job, err := startBuildJob(requestBody.RoomID, requestBody.GitHubLink, requestBody.Ref, requestBody.Credential, requestBody.buildSpec, resources, egress)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to start job: %v", err),
+			})
+		}
+
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"job_id":             job.ID,
+			"ws_connection_name": job.Name,
+			"preview_path":       "/preview/" + requestBody.RoomID + "/",
 		})
 	})
 
+	// validate a repository URL and look up its default branch and visibility before importing it
+	app.Post("/repositories/lookup", requireUser, handleRepositoryLookup)
+
+	// candidate Dockerfiles of a repository at a ref, with their stages and exposed ports
+	app.Post("/repositories/dockerfiles", requireUser, handleListDockerfiles)
+
+	// resource profiles a room can be started with
+	app.Get("/resource-profiles", func(c *fiber.Ctx) error {
+		return c.JSON(docker.ResourceProfiles())
+	})
+
+	// lifecycle of a room's container, restricted to the room's participants
+	container := app.Group("/rooms/:id/container", requireParticipant(roomParam("id")))
+	container.Get("/", handleInspectContainer)
+	container.Post("/stop", handleStopContainer)
+	container.Post("/restart", handleRestartContainer)
+	container.Delete("/", handleRemoveContainer)
+
+	// build cache, restricted to operators holding ADMIN_TOKEN
+	admin := app.Group("/admin", requireAdmin)
+	admin.Get("/images", handleListImages)
+	admin.Delete("/images/:key", handleEvictImage)
+
+	app.Get("/jobs/:id", requireParticipant(jobRoom), handleJobStatus)
+	app.Get("/rooms/:id/job", requireParticipant(roomParam("id")), handleRoomJob)
+
+	// rebuild the full terminal output of a room from its persisted chunks
+	app.Get("/rooms/:id/transcript", requireParticipant(roomParam("id")), func(c *fiber.Ctx) error {
+		rows, err := transcriptStore.Rows(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to load transcript: %v", err),
+			})
+		}
+		return c.SendString(transcript.Rebuild(rows))
+	})
+
+	// browse the app running in a room's container, HTTP and websockets
+	// ?access_token= on the first request is kept in a cookie for the rest of the app's requests
+	app.All("/preview/:room", func(c *fiber.Ctx) error {
+		target := "/preview/" + c.Params("room") + "/"
+		if query := c.Request().URI().QueryString(); len(query) > 0 {
+			target += "?" + string(query)
+		}
+		return c.Redirect(target, fiber.StatusMovedPermanently)
+	})
+	app.All("/preview/:room/*", requireParticipant(roomParam("room")), handlePreview)
+
 	app.Use("/ws/container-output/:id", func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
 			c.Set("Access-Control-Allow-Origin", "*") // Allow frontend origin here
@@ -147,74 +264,117 @@ func main() {
 	})
 
 	// encode websocket connection id and room id by separating with "___"
-	app.Get("/ws/container-output/:id", websocket.New(func(c *websocket.Conn) {
-		params := c.Params("id")
-		parts := strings.Split(params, "___")
-		if len(parts) != 2 {
-			c.WriteMessage(websocket.TextMessage, []byte("Invalid parameters"))
-			return
-		}
-		id := parts[0]
-		roomId := parts[1]
+	// the room id is optional and only kept for compatibility with older clients
+	// ?since=<offset> resumes after the last received byte, ?tail=<n> replays only the last n bytes,
+	// and without either the whole retained output is replayed before live streaming starts
+	// browsers cannot set headers on websockets, so the access token may come as ?access_token=
+	app.Get("/ws/container-output/:id", requireParticipant(connectionRoom), websocket.New(func(c *websocket.Conn) {
+		id := strings.Split(c.Params("id"), "___")[0]
 		log.Println("Websocket connection established for ID:", id)
 
-		streamRaw, ok := ContainerStreams.Load(id)
+		// Viewers may connect as soon as the job is created, before the container exists
+		if job, ok := jobs.ByName(id); ok {
+			<-job.Settled()
+		}
+
+		topic, ok := outputHub.Get(id)
 		if !ok {
 			c.WriteMessage(websocket.TextMessage, []byte("Invalid container ID"))
 			return
 		}
+		if session, ok := sessions.ByName(id); ok {
+			defer activity.Connect(session.RoomID)()
+		}
 
-		stream := streamRaw.(io.ReadCloser)
-		defer stream.Close()
-
-		buf := make([]byte, 1024)
-		for {
-			n, err := stream.Read(buf)
-			if err != nil {
-				break
+		var sub *stream.Subscriber
+		if tail := c.Query("tail"); tail != "" {
+			n, err := strconv.ParseInt(tail, 10, 64)
+			if err != nil || n < 0 {
+				c.WriteMessage(websocket.TextMessage, []byte("Invalid tail parameter"))
+				return
 			}
-			if writeErr := c.WriteMessage(websocket.TextMessage, buf[:n]); writeErr != nil {
-				break
+			sub = topic.SubscribeTail(n)
+		} else {
+			since, err := strconv.ParseInt(c.Query("since", "0"), 10, 64)
+			if err != nil || since < 0 {
+				c.WriteMessage(websocket.TextMessage, []byte("Invalid since parameter"))
+				return
 			}
-
-			currentTerminalOutput, _, err := supabaseClient.From("running_rooms").Select("terminal_output", "", false).Eq("id", roomId).Single().Execute()
-			if err != nil {
-				log.Printf("Error getting terminal output: %v", err)
-			}
-			var result struct {
-				TerminalOutput string `json:"terminal_output"`
+			sub = topic.Subscribe(since)
+		}
+		defer sub.Close()
+
+		// Viewers only receive output; reading is just to notice when they go away
+		readDone := make(chan struct{})
+		go func() {
+			defer close(readDone)
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					sub.Close()
+					return
+				}
 			}
-			if err := json.Unmarshal(currentTerminalOutput, &result); err != nil {
-				log.Printf("Error parsing terminal output: %v", err)
-				continue
+		}()
+		defer func() {
+			// The connection is reused once the handler returns, so the reader must be finished first
+			c.Close()
+			<-readDone
+		}()
+
+		for chunk := range sub.Chunks() {
+			if err := c.WriteJSON(outputFrame{
+				Type:   "output",
+				Stream: chunk.Stream.String(),
+				Offset: chunk.Offset,
+				End:    chunk.End(),
+				Data:   chunk.Data,
+			}); err != nil {
+				return
 			}
-			newOutput := result.TerminalOutput + filterPrintable(buf[:n])
-
-			// update running_rooms table with terminal_output
-			_, _, err = supabaseClient.From("running_rooms").Update(
-				map[string]any{"terminal_output": newOutput},
-				"",
-				"",
-			).Eq("id", roomId).Execute() // Use the actual room ID from the connection
+		}
 
-			if err != nil {
-				log.Printf("Error updating terminal output: %v", err)
-			}
+		if sub.Lagged() {
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client too slow"))
+		} else {
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "stream ended"))
 		}
 	}))
 
-	log.Println("Starting server on port 3009...")
-	if err := app.Listen(":3009"); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
-}
+	app.Use("/ws/jobs/:id", func(c *fiber.Ctx) error {
+		if websocket.IsWebSocketUpgrade(c) {
+			c.Set("Access-Control-Allow-Origin", "*")
+			c.Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept")
+			return c.Next()
+		}
+		return fiber.ErrUpgradeRequired
+	})
 
-func filterPrintable(input []byte) string {
-	out := make([]rune, 0, len(input))
-	for _, r := range string(input) {
-		if unicode.IsPrint(r) || r == '\n' || r == '\r' || r == '\t' {
-			out = append(out, r)
+	// phase changes and docker build progress of a job
+	app.Get("/ws/jobs/:id", requireParticipant(jobRoom), websocket.New(handleJobEvents))
+
+	app.Use("/ws/container-exec/:id", func(c *fiber.Ctx) error {
+		if websocket.IsWebSocketUpgrade(c) {
+			c.Set("Access-Control-Allow-Origin", "*")
+			c.Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept")
+			return c.Next()
 		}
-	}
-	return string(out)
+		return fiber.ErrUpgradeRequired
+	})
+
+	// interactive shell in the container, same connection name as /ws/container-output
+	app.Get("/ws/container-exec/:id", requireParticipant(connectionRoom), websocket.New(handleTerminal))
+
+	return app
+}
+
+// outputFrame is the message sent to output viewers for every chunk. Data holds the raw
+// terminal bytes, base64 encoded so ANSI sequences and partial UTF-8 survive intact, and
+// Stream says whether they were written to stdout or stderr. A client that reconnects with
+// ?since=<end of the last frame> does not receive anything twice.
+type outputFrame struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream"`
+	Offset int64  `json:"offset"`
+	End    int64  `json:"end"`
+	Data   []byte `json:"data"`
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/ICBasecamp/K0/backend/pkg/docker"
+	fastws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/proxy"
+	"github.com/gofiber/websocket/v2"
+)
+
+// previewUpstreamKey is the Locals key carrying the upstream websocket URL into previewWebSocket
+const previewUpstreamKey = "preview_upstream"
+
+// previewPort picks the port the preview proxy forwards to, the lowest one the image exposes
+func previewPort(ports []docker.PortMapping) (docker.PortMapping, bool) {
+	for _, port := range ports {
+		if port.HostPort != "" {
+			return port, true
+		}
+	}
+	return docker.PortMapping{}, false
+}
+
+// handlePreview forwards /preview/:room/* to the app running in the room's container.
+// The prefix is stripped, so apps should use relative URLs or honor X-Forwarded-Prefix.
+// Only participants get here, see requireParticipant, and their access token is never
+// passed on to the app.
+func handlePreview(c *fiber.Ctx) error {
+	roomID := c.Params("room")
+	if token := c.Query(accessTokenParam); token != "" {
+		c.Cookie(&fiber.Cookie{
+			Name:     previewTokenCookie,
+			Value:    token,
+			Path:     "/preview/" + roomID + "/",
+			HTTPOnly: true,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+	}
+	if uri := c.Request().URI(); uri.QueryArgs().Has(accessTokenParam) {
+		uri.QueryArgs().Del(accessTokenParam)
+		uri.SetQueryStringBytes(uri.QueryArgs().QueryString())
+	}
+	c.Request().Header.Del(fiber.HeaderAuthorization)
+	c.Request().Header.DelCookie(previewTokenCookie)
+	session, ok := sessions.ByRoom(roomID)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No container running for this room",
+		})
+	}
+
+	port, ok := previewPort(session.Ports)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Container does not expose any ports",
+		})
+	}
+
+	upstreamHost := fmt.Sprintf("%s:%s", dockerClient.Host(session.ContainerID), port.HostPort)
+	path := "/" + c.Params("*")
+	if query := c.Request().URI().QueryString(); len(query) > 0 {
+		path += "?" + string(query)
+	}
+
+	if websocket.IsWebSocketUpgrade(c) {
+		c.Locals(previewUpstreamKey, "ws://"+upstreamHost+path)
+		return previewWebSocket(c)
+	}
+
+	c.Request().Header.Set("X-Forwarded-Host", c.Hostname())
+	c.Request().Header.Set("X-Forwarded-Proto", c.Protocol())
+	c.Request().Header.Set("X-Forwarded-Prefix", "/preview/"+roomID)
+	c.Request().Header.SetHost(upstreamHost)
+
+	if err := proxy.Do(c, "http://"+upstreamHost+path); err != nil {
+		log.Printf("Error proxying preview request for room %s: %v", roomID, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "The app in this room is not responding",
+		})
+	}
+	return nil
+}
+
+// previewWebSocket relays websocket traffic between the browser and the app in the container
+var previewWebSocket = websocket.New(func(c *websocket.Conn) {
+	upstreamURL, _ := c.Locals(previewUpstreamKey).(string)
+	defer activity.Connect(c.Params("room"))()
+
+	upstream, _, err := fastws.DefaultDialer.Dial(upstreamURL, http.Header{})
+	if err != nil {
+		log.Printf("Error dialing preview websocket %s: %v", upstreamURL, err)
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "app not reachable"))
+		return
+	}
+	defer upstream.Close()
+
+	// Each side is read by one goroutine and written by the other, closing both ends
+	// as soon as either direction fails unblocks the remaining one
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			upstream.Close()
+			c.Close()
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer closeBoth()
+		relayWebSocket(upstream, c.Conn)
+	}()
+
+	relayWebSocket(c.Conn, upstream)
+	closeBoth()
+	<-done
+})
+
+// relayWebSocket copies messages from src to dst until either side fails
+func relayWebSocket(src, dst *fastws.Conn) {
+	for {
+		messageType, msg, err := src.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := dst.WriteMessage(messageType, msg); err != nil {
+			return
+		}
+	}
+}
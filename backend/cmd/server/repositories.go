@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/internal/git"
+	"github.com/ICBasecamp/K0/backend/pkg/containerize"
+	"github.com/gofiber/fiber/v2"
+)
+
+// handleRepositoryLookup checks that a repository can be imported and returns what its
+// provider knows about it. The credential, if any, goes in the body to keep it out of URLs.
+func handleRepositoryLookup(c *fiber.Ctx) error {
+	var body struct {
+		URL        string          `json:"url"`
+		Credential *git.Credential `json:"credential"`
+	}
+	if err := c.BodyParser(&body); err != nil || body.URL == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Repository URL is required",
+		})
+	}
+
+	repo, err := git.ParseRepository(body.URL)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	metadata, err := git.LookupMetadata(repo, body.Credential)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error":      err.Error(),
+			"repository": repo,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"repository": repo,
+		"metadata":   metadata,
+	})
+}
+
+// Listing Dockerfiles clones the repository while the request waits. At most
+// maxConcurrentListings clones run at once, and requests wait up to listingQueueTimeout for
+// one of them to finish.
+const (
+	maxConcurrentListings = 4
+	listingQueueTimeout   = 30 * time.Second
+)
+
+var listingSlots = make(chan struct{}, maxConcurrentListings)
+
+// handleListDockerfiles clones a repository at a ref and lists the Dockerfiles in it, so the
+// interviewer can pick the one to build along with its context, target and build args. It
+// also shows the Dockerfile that would be generated for the context directory, which is what
+// gets built if the repository has no Dockerfile.
+func handleListDockerfiles(c *fiber.Ctx) error {
+	var body struct {
+		URL          string          `json:"url"`
+		Ref          string          `json:"ref"`
+		Credential   *git.Credential `json:"credential"`
+		ContextDir   string          `json:"context_dir"`   // Where to detect the project, the root if empty
+		StartCommand string          `json:"start_command"` // Replaces the detected start command
+	}
+	if err := c.BodyParser(&body); err != nil || body.URL == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Repository URL is required",
+		})
+	}
+
+	if _, err := git.ParseRepository(body.URL); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := git.ValidateRef(body.Ref); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	contextDir, err := git.CleanRepoPath(body.ContextDir)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	select {
+	case listingSlots <- struct{}{}:
+		defer func() { <-listingSlots }()
+	case <-time.After(listingQueueTimeout):
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Too many repositories are being listed, try again later",
+		})
+	}
+
+	gitClient, err := git.NewGitClient("")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	repoPath, err := gitClient.CloneRepository(body.URL, git.CloneOptions{Ref: body.Ref, Credential: body.Credential})
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to clone repository: %v", err),
+		})
+	}
+	defer gitClient.CleanupRepository(repoPath)
+
+	commit, err := gitClient.HeadCommit(repoPath)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	dockerfiles, err := gitClient.FindDockerfiles(repoPath)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	response := fiber.Map{
+		"commit_sha":  commit,
+		"dockerfiles": dockerfiles,
+	}
+	// The context directory may be a symlink, detection must not look outside the clone
+	contextPath, err := git.ResolveRepoPath(repoPath, contextDir)
+	if err != nil {
+		response["generate_error"] = fmt.Sprintf("context directory %s is not a directory in the repository: %v", contextDir, err)
+		return c.JSON(response)
+	}
+	generated, err := containerize.Generate(contextPath, body.StartCommand)
+	if err != nil {
+		response["generate_error"] = err.Error()
+	} else {
+		response["generated"] = generated
+	}
+	return c.JSON(response)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/pkg/docker"
+	"github.com/ICBasecamp/K0/backend/pkg/transcript"
+	"github.com/gofiber/fiber/v2"
+)
+
+// roomContainer looks up the room's current session or responds with 404
+func roomContainer(c *fiber.Ctx) (*roomSession, bool) {
+	session, ok := sessions.ByRoom(c.Params("id"))
+	if !ok {
+		c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No container for this room",
+		})
+	}
+	return session, ok
+}
+
+// containerError maps a docker error to a response
+func containerError(c *fiber.Ctx, action string, err error) error {
+	status := fiber.StatusInternalServerError
+	if docker.IsNotFound(err) {
+		status = fiber.StatusNotFound
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error": fmt.Sprintf("Failed to %s container: %v", action, err),
+	})
+}
+
+// handleInspectContainer reports the state, exit code, uptime and resource usage of the room's container
+func handleInspectContainer(c *fiber.Ctx) error {
+	session, ok := roomContainer(c)
+	if !ok {
+		return nil
+	}
+
+	info, err := dockerClient.InspectContainer(session.ContainerID)
+	if err != nil {
+		return containerError(c, "inspect", err)
+	}
+	response := fiber.Map{
+		"ws_connection_name": session.Name,
+		"container":          info,
+	}
+	if services, err := inspectServices(session); err != nil {
+		return containerError(c, "inspect", err)
+	} else if services != nil {
+		response["services"] = services
+	}
+	return c.JSON(response)
+}
+
+// inspectServices reports every service of a compose stack by name, nil for a single container
+func inspectServices(session *roomSession) (map[string]docker.ContainerInfo, error) {
+	if len(session.Services) == 0 {
+		return nil, nil
+	}
+	services := make(map[string]docker.ContainerInfo, len(session.Services))
+	for _, service := range session.Services {
+		info, err := dockerClient.InspectContainer(service.ContainerID)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service.Name, err)
+		}
+		services[service.Name] = info
+	}
+	return services, nil
+}
+
+// handleStopContainer stops the room's container, or every service of its stack. Its output stream ends, the session stays
+// so the container can be restarted.
+func handleStopContainer(c *fiber.Ctx) error {
+	session, ok := roomContainer(c)
+	if !ok {
+		return nil
+	}
+
+	// Last started first, so services stop before what they depend on
+	ids := session.containerIDs()
+	for i := len(ids) - 1; i >= 0; i-- {
+		if err := dockerClient.StopContainer(ids[i]); err != nil {
+			return containerError(c, "stop", err)
+		}
+	}
+	log.Printf("Stopped container %s of room %s", session.ContainerID, session.RoomID)
+	return handleInspectContainer(c)
+}
+
+// handleRestartContainer restarts the room's container and reattaches its output, so
+// viewers and the transcript carry on from where the previous run stopped
+func handleRestartContainer(c *fiber.Ctx) error {
+	session, ok := roomContainer(c)
+	if !ok {
+		return nil
+	}
+
+	restartedAt := time.Now()
+	for _, id := range session.containerIDs() {
+		if err := dockerClient.RestartContainer(id); err != nil {
+			return containerError(c, "restart", err)
+		}
+	}
+
+	// The previous log stream ends once the container stopped; replace it with one for the new run
+	if topic, ok := outputHub.Get(session.Name); ok {
+		topic.Close()
+	}
+	var logs io.ReadCloser
+	var err error
+	if len(session.Services) > 0 {
+		logs, err = dockerClient.FollowStackLogs(session.Services, restartedAt)
+	} else {
+		logs, err = dockerClient.FollowLogs(session.ContainerID, restartedAt)
+	}
+	if err != nil {
+		return containerError(c, "attach to", err)
+	}
+	topic, err := outputHub.Reopen(session.Name, logs, docker.CopyLogs)
+	if err != nil {
+		logs.Close()
+		return containerError(c, "attach to", err)
+	}
+	writer := transcript.NewWriter(transcriptStore, session.RoomID)
+	writer.From = topic.Offset()
+	go writer.Run(topic)
+
+	// Docker may publish the ports on different host ports after a restart
+	info, err := dockerClient.InspectContainer(session.ContainerID)
+	if err != nil {
+		return containerError(c, "inspect", err)
+	}
+	services, err := inspectServices(session)
+	if err != nil {
+		return containerError(c, "inspect", err)
+	}
+	updated := *session
+	updated.Ports = info.Ports
+	updated.RestartedAt = info.StartedAt
+	updated.Services = make([]docker.StackService, len(session.Services))
+	for i, service := range session.Services {
+		service.Ports = services[service.Name].Ports
+		updated.Services[i] = service
+	}
+	if len(updated.Services) == 0 {
+		updated.Services = nil
+	}
+	// An import that replaced the session while restarting removed the container, and with it
+	// the output stream reopened above
+	if !sessions.Replace(session, &updated) {
+		outputHub.Remove(session.Name)
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The room's container was replaced while restarting",
+		})
+	}
+
+	log.Printf("Restarted container %s of room %s", session.ContainerID, session.RoomID)
+	response := fiber.Map{
+		"ws_connection_name": session.Name,
+		"container":          info,
+	}
+	if services != nil {
+		response["services"] = services
+	}
+	return c.JSON(response)
+}
+
+// handleRemoveContainer removes the room's container and forgets its session. The persisted
+// transcript is kept, and so is the image for other rooms importing the same source.
+func handleRemoveContainer(c *fiber.Ctx) error {
+	session, ok := roomContainer(c)
+	if !ok {
+		return nil
+	}
+
+	if err := removeSession(session); err != nil {
+		return containerError(c, "remove", err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// removeSession force-removes a session's container or stack, its room's network and its
+// output stream. Images are shared between rooms and evicted by the janitor once unused.
+func removeSession(session *roomSession) error {
+	if len(session.Services) > 0 {
+		if err := dockerClient.RemoveStack(session.Name, session.Services); err != nil {
+			return err
+		}
+	} else if err := dockerClient.RemoveContainer(session.ContainerID); err != nil && !docker.IsNotFound(err) {
+		return err
+	}
+
+	outputHub.Remove(session.Name)
+	sessions.Delete(session)
+	imageUses.Touch(session.images()...)
+
+	// A newer container of the room may still be using the network
+	if _, ok := sessions.ByRoom(session.RoomID); !ok {
+		if err := dockerClient.RemoveRoomNetwork(session.RoomID); err != nil {
+			log.Printf("Error removing network of room %s: %v", session.RoomID, err)
+		}
+	}
+	log.Printf("Removed container %s of room %s", session.ContainerID, session.RoomID)
+	return nil
+}
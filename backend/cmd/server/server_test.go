@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/pkg/docker"
+	"github.com/ICBasecamp/K0/backend/pkg/docker/dockertest"
+	"github.com/ICBasecamp/K0/backend/pkg/stream"
+	"github.com/ICBasecamp/K0/backend/pkg/transcript"
+	fastws "github.com/fasthttp/websocket"
+	"github.com/supabase-community/supabase-go"
+)
+
+const (
+	testSecret = "test-jwt-secret"
+	testRoom   = "room-1"
+	testUser   = "user-1"
+	testRepo   = "https://github.com/example/app"
+)
+
+// memoryStore keeps transcript rows in memory
+type memoryStore struct {
+	mu   sync.Mutex
+	rows []transcript.Row
+}
+
+func (s *memoryStore) Append(rows []transcript.Row) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rows = append(s.rows, rows...)
+	return nil
+}
+
+func (s *memoryStore) Rows(roomID string) ([]transcript.Row, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rows []transcript.Row
+	for _, row := range s.rows {
+		if row.RoomID == roomID {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// fakePostgREST answers the Supabase queries of the server: testUser is the only
+// participant of testRoom, and updates of running_rooms succeed
+func fakePostgREST(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		query := r.URL.Query()
+		if r.URL.Path == "/rest/v1/room_participants" &&
+			query.Get("room_id") == "eq."+testRoom && query.Get("user_id") == "eq."+testUser {
+			io.WriteString(w, `[{"room_id":"`+testRoom+`"}]`)
+			return
+		}
+		io.WriteString(w, `[]`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// startTestServer runs the API against the fake runtime and returns its address
+func startTestServer(t *testing.T) (string, *dockertest.Runtime) {
+	t.Setenv("SUPABASE_JWT_SECRET", testSecret)
+
+	runtime := dockertest.New()
+	runtime.Repositories[testRepo] = dockertest.Repository{
+		Commit: "0123456789abcdef0123456789abcdef01234567",
+		Ports:  []string{"3000/tcp"},
+		Output: "hello from the app\n",
+	}
+	client, err := supabase.NewClient(fakePostgREST(t).URL, "anon-key", &supabase.ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dockerClient = runtime
+	supabaseClient = client
+	transcriptStore = &memoryStore{}
+	outputHub = stream.NewHub(stream.Config{})
+	sessions = newSessionRegistry()
+	jobs = newJobRegistry()
+	activity = newActivityTracker()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newApp()
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+	return ln.Addr().String(), runtime
+}
+
+// accessTokenFor signs a Supabase access token for a user
+func accessTokenFor(userID string) string {
+	encode := func(v any) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." +
+		encode(map[string]any{"sub": userID, "role": "authenticated", "exp": time.Now().Add(time.Hour).Unix()})
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func request(t *testing.T, method, url, token string, body any) (*http.Response, map[string]any) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var decoded map[string]any
+	json.NewDecoder(resp.Body).Decode(&decoded)
+	return resp, decoded
+}
+
+func dialWS(t *testing.T, addr, path, token string) *fastws.Conn {
+	t.Helper()
+	u := "ws://" + addr + path + "?" + url.Values{accessTokenParam: {token}}.Encode()
+	conn, resp, err := fastws.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("failed to connect to %s: %v (status %d)", path, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+func TestRoomLifecycle(t *testing.T) {
+	addr, runtime := startTestServer(t)
+	base := "http://" + addr
+	token := accessTokenFor(testUser)
+	start := map[string]any{"room_id": testRoom, "github_link": testRepo}
+
+	// Only signed in participants may import into the room
+	if resp, _ := request(t, http.MethodPost, base+"/start-github-container", "", start); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("start without a token: got %d, want 401", resp.StatusCode)
+	}
+	if resp, _ := request(t, http.MethodPost, base+"/start-github-container", accessTokenFor("user-2"), start); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("start by another user: got %d, want 403", resp.StatusCode)
+	}
+	resp, started := request(t, http.MethodPost, base+"/start-github-container", token, start)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("start: got %d %v, want 202", resp.StatusCode, started)
+	}
+	jobID, _ := started["job_id"].(string)
+	name, _ := started["ws_connection_name"].(string)
+
+	// The job's events end with the container being ready
+	events := dialWS(t, addr, "/ws/jobs/"+jobID, token)
+	var phases []string
+	for {
+		_, msg, err := events.ReadMessage()
+		if err != nil {
+			break
+		}
+		decoder := json.NewDecoder(bytes.NewReader(msg))
+		for {
+			var event jobEvent
+			if err := decoder.Decode(&event); err != nil {
+				break
+			}
+			if event.Type == "phase" {
+				phases = append(phases, string(event.Phase))
+			}
+		}
+	}
+	if len(phases) == 0 || phases[len(phases)-1] != string(phaseReady) {
+		t.Fatalf("job phases %v, want them to end with %s", phases, phaseReady)
+	}
+
+	// Viewers get the container's output
+	output := dialWS(t, addr, "/ws/container-output/"+name+"___"+testRoom, token)
+	var received strings.Builder
+	for !strings.Contains(received.String(), "hello from the app") {
+		_, msg, err := output.ReadMessage()
+		if err != nil {
+			t.Fatalf("output ended after %q: %v", received.String(), err)
+		}
+		var frame outputFrame
+		if err := json.Unmarshal(msg, &frame); err != nil {
+			t.Fatalf("invalid output frame %s: %v", msg, err)
+		}
+		received.Write(frame.Data)
+	}
+
+	// The terminal is a shell in the container, the fake's echoes its input
+	terminal := dialWS(t, addr, "/ws/container-exec/"+name, token)
+	if err := terminal.WriteMessage(fastws.BinaryMessage, []byte("ls\r")); err != nil {
+		t.Fatal(err)
+	}
+	var echoed []byte
+	for !bytes.Contains(echoed, []byte("ls\r")) {
+		_, msg, err := terminal.ReadMessage()
+		if err != nil {
+			t.Fatalf("terminal ended after %q: %v", echoed, err)
+		}
+		echoed = append(echoed, msg...)
+	}
+
+	// Stopping the container ends its output stream
+	if resp, _ := request(t, http.MethodPost, base+"/rooms/"+testRoom+"/container/stop", accessTokenFor("user-2"), nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("stop by another user: got %d, want 403", resp.StatusCode)
+	}
+	resp, stopped := request(t, http.MethodPost, base+"/rooms/"+testRoom+"/container/stop", token, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stop: got %d %v, want 200", resp.StatusCode, stopped)
+	}
+	session, ok := sessions.ByRoom(testRoom)
+	if !ok {
+		t.Fatal("room has no session after stop")
+	}
+	if info, err := runtime.InspectContainer(session.ContainerID); err != nil || info.Running {
+		t.Fatalf("container still running after stop: %+v, %v", info, err)
+	}
+	for {
+		if _, _, err := output.ReadMessage(); err != nil {
+			var closeErr *fastws.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != fastws.CloseNormalClosure {
+				t.Fatalf("output did not end normally: %v", err)
+			}
+			break
+		}
+	}
+
+	// Everything the container wrote is in the transcript once its stream ended
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req, _ := http.NewRequest(http.MethodGet, base+"/rooms/"+testRoom+"/transcript", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.Contains(string(body), "hello from the app") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transcript is %q", body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWebSocketsRequireParticipants(t *testing.T) {
+	addr, _ := startTestServer(t)
+	resp, started := request(t, http.MethodPost, "http://"+addr+"/start-github-container", accessTokenFor(testUser),
+		map[string]any{"room_id": testRoom, "github_link": testRepo})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("start: got %d %v, want 202", resp.StatusCode, started)
+	}
+	name, _ := started["ws_connection_name"].(string)
+	jobID, _ := started["job_id"].(string)
+
+	for _, path := range []string{"/ws/container-exec/" + name, "/ws/container-output/" + name, "/ws/jobs/" + jobID} {
+		for token, want := range map[string]int{"": http.StatusUnauthorized, accessTokenFor("user-2"): http.StatusForbidden} {
+			u := "ws://" + addr + path + "?" + url.Values{accessTokenParam: {token}}.Encode()
+			conn, resp, err := fastws.DefaultDialer.Dial(u, nil)
+			if err == nil {
+				conn.Close()
+				t.Fatalf("%s: connected without being a participant", path)
+			}
+			if resp == nil || resp.StatusCode != want {
+				t.Fatalf("%s: got %v, want %d", path, resp, want)
+			}
+		}
+	}
+}
+
+func TestVerifyAccessToken(t *testing.T) {
+	t.Setenv("SUPABASE_JWT_SECRET", testSecret)
+	now := time.Now()
+
+	if userID, err := verifyAccessToken(accessTokenFor(testUser), now); err != nil || userID != testUser {
+		t.Fatalf("valid token: got %q, %v", userID, err)
+	}
+	if _, err := verifyAccessToken(accessTokenFor(testUser), now.Add(2*time.Hour)); err == nil {
+		t.Fatal("expired token accepted")
+	}
+
+	parts := strings.Split(accessTokenFor(testUser), ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-2","role":"authenticated","exp":9999999999}`))
+	if _, err := verifyAccessToken(parts[0]+"."+forged+"."+parts[2], now); err == nil {
+		t.Fatal("token with changed claims accepted")
+	}
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	if _, err := verifyAccessToken(none+"."+parts[1]+".", now); err == nil {
+		t.Fatal("unsigned token accepted")
+	}
+}
+
+var _ docker.Runtime = (*dockertest.Runtime)(nil)
+
+func TestRepositoryRoutesRequireSignIn(t *testing.T) {
+	addr, _ := startTestServer(t)
+	for _, path := range []string{"/repositories/lookup", "/repositories/dockerfiles"} {
+		resp, _ := request(t, http.MethodPost, "http://"+addr+path, "", map[string]any{"url": testRepo})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s without a token: got %d, want 401", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestOnlyParticipantsKeepRoomsAlive(t *testing.T) {
+	addr, _ := startTestServer(t)
+	url := "http://" + addr + "/rooms/" + testRoom + "/container"
+
+	for _, token := range []string{"", accessTokenFor("user-2")} {
+		request(t, http.MethodGet, url, token, nil)
+		if _, seen := activity.lastSeen[testRoom]; seen {
+			t.Fatalf("request with token %q recorded activity", token)
+		}
+	}
+	request(t, http.MethodGet, url, accessTokenFor(testUser), nil)
+	if _, seen := activity.lastSeen[testRoom]; !seen {
+		t.Fatal("request of a participant recorded no activity")
+	}
+}
+
+func TestRestartKeepsSessionStart(t *testing.T) {
+	addr, _ := startTestServer(t)
+	base := "http://" + addr
+	token := accessTokenFor(testUser)
+	if resp, started := request(t, http.MethodPost, base+"/start-github-container", token,
+		map[string]any{"room_id": testRoom, "github_link": testRepo}); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("start: got %d %v, want 202", resp.StatusCode, started)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	session, ok := sessions.ByRoom(testRoom)
+	for ; !ok; session, ok = sessions.ByRoom(testRoom) {
+		if time.Now().After(deadline) {
+			t.Fatal("room has no session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if resp, restarted := request(t, http.MethodPost, base+"/rooms/"+testRoom+"/container/restart", token, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restart: got %d %v, want 200", resp.StatusCode, restarted)
+	}
+	restarted, _ := sessions.ByRoom(testRoom)
+	if restarted == session || !restarted.StartedAt.Equal(session.StartedAt) || restarted.RestartedAt.IsZero() {
+		t.Fatalf("session after restart started at %v, restarted at %v, want started at %v",
+			restarted.StartedAt, restarted.RestartedAt, session.StartedAt)
+	}
+}
+
+func TestSessionReplaceKeepsNewerSessions(t *testing.T) {
+	registry := newSessionRegistry()
+	first := &roomSession{RoomID: testRoom, Name: "first"}
+	imported := &roomSession{RoomID: testRoom, Name: "imported"}
+	registry.Put(first)
+	registry.Put(imported)
+
+	// A restart of the first session finishing after the import must not bring it back
+	if registry.Replace(first, &roomSession{RoomID: testRoom, Name: "first"}) {
+		t.Fatal("replaced a session that was no longer current")
+	}
+	if current, _ := registry.ByRoom(testRoom); current != imported {
+		t.Fatalf("room's session is %s, want imported", current.Name)
+	}
+
+	restarted := &roomSession{RoomID: testRoom, Name: "imported"}
+	if !registry.Replace(imported, restarted) {
+		t.Fatal("did not replace the current session")
+	}
+	if current, _ := registry.ByName("imported"); current != restarted {
+		t.Fatal("connection name does not lead to the replacing session")
+	}
+}
+
+func TestStartChecksTheRoomTheHandlerParses(t *testing.T) {
+	addr, _ := startTestServer(t)
+	form := url.Values{"RoomID": {testRoom}, "GitHubLink": {testRepo}}.Encode()
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/start-github-container", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+accessTokenFor("user-2"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("form body by another user: got %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/pkg/docker"
+)
+
+// roomSession is the container or compose stack currently running for a room
+type roomSession struct {
+	RoomID      string
+	Name        string // Output topic and websocket connection name, also names a compose stack
+	Image       string // Image of a single container, shared with other rooms built from the same source
+	ContainerID string // The primary service of a compose stack
+	Ports       []docker.PortMapping
+	Services    []docker.StackService // Every container of a compose stack, nil for a single container
+	StartedAt   time.Time             // When the room's container was first started, restarts keep it
+	RestartedAt time.Time             // When the container was last restarted, zero if never
+}
+
+// containerIDs returns the containers of the session
+func (s *roomSession) containerIDs() []string {
+	if len(s.Services) == 0 {
+		return []string{s.ContainerID}
+	}
+	ids := make([]string, len(s.Services))
+	for i, service := range s.Services {
+		ids[i] = service.ContainerID
+	}
+	return ids
+}
+
+// images returns the images the session's containers run
+func (s *roomSession) images() []string {
+	if len(s.Services) == 0 {
+		return []string{s.Image}
+	}
+	images := make([]string, len(s.Services))
+	for i, service := range s.Services {
+		images[i] = service.Image
+	}
+	return images
+}
+
+// service returns the container of a compose service, the primary one if name is empty
+func (s *roomSession) service(name string) (string, bool) {
+	if name == "" {
+		return s.ContainerID, true
+	}
+	for _, service := range s.Services {
+		if service.Name == name {
+			return service.ContainerID, true
+		}
+	}
+	return "", false
+}
+
+// sessionRegistry tracks the running container of every room
+type sessionRegistry struct {
+	mu     sync.RWMutex
+	byRoom map[string]*roomSession
+	byName map[string]*roomSession
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		byRoom: make(map[string]*roomSession),
+		byName: make(map[string]*roomSession),
+	}
+}
+
+// Put registers s as the room's current session and returns the session it replaced, if any
+func (r *sessionRegistry) Put(s *roomSession) *roomSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prev := r.byRoom[s.RoomID]
+	if prev != nil {
+		delete(r.byName, prev.Name)
+	}
+	r.byRoom[s.RoomID] = s
+	r.byName[s.Name] = s
+	return prev
+}
+
+// Replace swaps prev for s as the room's session, unless prev was replaced in the meantime
+func (r *sessionRegistry) Replace(prev, s *roomSession) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.byRoom[s.RoomID] != prev {
+		return false
+	}
+	delete(r.byName, prev.Name)
+	r.byRoom[s.RoomID] = s
+	r.byName[s.Name] = s
+	return true
+}
+
+// ByRoom returns the current session of a room
+func (r *sessionRegistry) ByRoom(roomID string) (*roomSession, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.byRoom[roomID]
+	return s, ok
+}
+
+// ByName returns the session with the given websocket connection name
+func (r *sessionRegistry) ByName(name string) (*roomSession, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.byName[name]
+	return s, ok
+}
+
+// All returns the current session of every room
+func (r *sessionRegistry) All() []*roomSession {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make([]*roomSession, 0, len(r.byRoom))
+	for _, s := range r.byRoom {
+		all = append(all, s)
+	}
+	return all
+}
+
+// Delete forgets s if it is still the room's current session
+func (r *sessionRegistry) Delete(s *roomSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.byRoom[s.RoomID] == s {
+		delete(r.byRoom, s.RoomID)
+	}
+	if r.byName[s.Name] == s {
+		delete(r.byName, s.Name)
+	}
+}
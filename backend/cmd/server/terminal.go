@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// terminalMessage is a control message sent by a terminal client as a text frame.
+// Binary frames are passed to the shell as raw input.
+//
+//	{"type": "input", "data": "ls -la\r"}
+//	{"type": "resize", "cols": 120, "rows": 40}
+type terminalMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols uint   `json:"cols,omitempty"`
+	Rows uint   `json:"rows,omitempty"`
+}
+
+// handleTerminal attaches a websocket to a new shell in the container behind the connection
+// name. The initial terminal size can be given with ?cols=&rows=, and the service of a compose
+// stack with ?service=. Shell output is sent back as binary frames containing raw TTY bytes.
+func handleTerminal(c *websocket.Conn) {
+	id := strings.Split(c.Params("id"), "___")[0]
+
+	session, ok := sessions.ByName(id)
+	if !ok {
+		c.WriteMessage(websocket.TextMessage, []byte("Invalid container ID"))
+		return
+	}
+	containerID, ok := session.service(c.Query("service"))
+	if !ok {
+		c.WriteMessage(websocket.TextMessage, []byte("Unknown service"))
+		return
+	}
+	defer activity.Connect(session.RoomID)()
+
+	cols, _ := strconv.ParseUint(c.Query("cols"), 10, 32)
+	rows, _ := strconv.ParseUint(c.Query("rows"), 10, 32)
+
+	shell, err := dockerClient.ExecShell(containerID, uint(cols), uint(rows))
+	if err != nil {
+		log.Printf("Error starting shell in container %s: %v", containerID, err)
+		c.WriteMessage(websocket.TextMessage, []byte("Failed to start shell"))
+		return
+	}
+	log.Printf("Terminal session %s started in container %s", shell.ID, containerID)
+
+	// Shell output is the only writer on the socket, so writes never race
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := shell.Read(buf)
+			if n > 0 {
+				if writeErr := c.WriteMessage(websocket.BinaryMessage, buf[:n]); writeErr != nil {
+					return
+				}
+			}
+			if err != nil {
+				// The shell exited, unblock the read loop below
+				c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shell exited"))
+				c.Close()
+				return
+			}
+		}
+	}()
+	defer func() {
+		shell.Close()
+		<-outputDone
+	}()
+
+	for {
+		messageType, msg, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if messageType == websocket.BinaryMessage {
+			if _, err := shell.Write(msg); err != nil {
+				return
+			}
+			continue
+		}
+
+		var m terminalMessage
+		if err := json.Unmarshal(msg, &m); err != nil {
+			log.Printf("Ignoring malformed terminal message: %v", err)
+			continue
+		}
+		switch m.Type {
+		case "input":
+			if _, err := shell.Write([]byte(m.Data)); err != nil {
+				return
+			}
+		case "resize":
+			if m.Cols == 0 || m.Rows == 0 {
+				continue
+			}
+			if err := dockerClient.ResizeExec(shell.ID, m.Cols, m.Rows); err != nil {
+				log.Printf("Error resizing terminal %s: %v", shell.ID, err)
+			}
+		default:
+			log.Printf("Ignoring unknown terminal message type %q", m.Type)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GitClient represents a client for interacting with Git repositories
+type GitClient struct {
+	TempDir string       // Directory to clone repositories into
+	Mirrors *MirrorCache // Imports go through it if set, see MirrorCache
+}
+
+// NewGitClient creates a new Git client using the process-wide DefaultMirrorCache
+func NewGitClient(tempDir string) (*GitClient, error) {
+	// Create temp directory if it doesn't exist
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	return &GitClient{
+		TempDir: tempDir,
+		Mirrors: DefaultMirrorCache(),
+	}, nil
+}
+
+// CloneOptions selects what to clone and how to authenticate
+type CloneOptions struct {
+	Ref        string      // Branch, tag, commit SHA or pull/N for a pull request, the default branch if empty
+	Credential *Credential // For private repositories, may be nil
+}
+
+// CloneRepository clones a repository from any allowed host to a local directory and returns the path
+func (gc *GitClient) CloneRepository(repoURL string, opts CloneOptions) (string, error) {
+	repo, err := ParseRepository(repoURL)
+	if err != nil {
+		return "", err
+	}
+
+	if err := ValidateRef(opts.Ref); err != nil {
+		return "", err
+	}
+	if err := opts.Credential.validate(repo); err != nil {
+		return "", err
+	}
+
+	// Every import gets a workspace of its own, even for the same repository at the same time
+	cloneDir, err := os.MkdirTemp(gc.TempDir, repo.Name+"-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create clone directory: %w", err)
+	}
+
+	// Only the fetches talk to the remote, so only they get to see the credential
+	auth, cleanup, err := opts.Credential.env(repo, providers[repo.Provider].TokenUsername())
+	if err != nil {
+		os.RemoveAll(cloneDir)
+		return "", err
+	}
+	defer cleanup()
+
+	if err := gc.fetchRef(cloneDir, repo, opts.Ref, auth); err != nil {
+		os.RemoveAll(cloneDir)
+		return "", err
+	}
+	if err := updateSubmodules(cloneDir, auth); err != nil {
+		os.RemoveAll(cloneDir)
+		return "", err
+	}
+	if err := pullLFS(cloneDir, auth); err != nil {
+		os.RemoveAll(cloneDir)
+		return "", err
+	}
+
+	return cloneDir, nil
+}
+
+// fetchRef fetches exactly ref into an empty repository at dir and checks it out, through
+// the mirror cache if there is one. auth is added to the environment of the commands
+// contacting the remote.
+func (gc *GitClient) fetchRef(dir string, repo Repository, ref string, auth []string) error {
+	if err := runGit(dir, nil, "init", "--quiet"); err != nil {
+		return err
+	}
+	// Relative submodule URLs resolve against origin, so it is the remote even when cached
+	if err := runGit(dir, nil, "remote", "add", "origin", repo.CloneURL); err != nil {
+		return err
+	}
+	if gc.Mirrors != nil {
+		return gc.Mirrors.checkout(dir, repo, ref, auth)
+	}
+
+	// Only the requested commit is fetched, with --depth 1 for faster cloning
+	if abbreviated := isHexSHA(ref) && len(ref) < 40; !abbreviated {
+		if err := runGit(dir, auth, "fetch", "--quiet", "--depth", "1", "origin", remoteRef(ref)); err != nil {
+			return err
+		}
+		return runGit(dir, nil, "checkout", "--quiet", "--detach", "FETCH_HEAD")
+	}
+
+	// Servers only hand out commits by their full SHA, an abbreviated one needs the history
+	if err := runGit(dir, auth, "fetch", "--quiet", "origin"); err != nil {
+		return err
+	}
+	return runGit(dir, nil, "checkout", "--quiet", "--detach", ref+"^{commit}")
+}
+
+// updateSubmodules checks out the submodules of the repository at dir, recursively. Each
+// level is checked before it is fetched, so submodules can only come from allowed hosts.
+func updateSubmodules(dir string, auth []string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".gitmodules")); err != nil {
+		return nil
+	}
+
+	urls, err := gitConfigValues(dir, `^submodule\..*\.url$`)
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		// Relative URLs are on the same host as their parent
+		if strings.HasPrefix(url, "./") || strings.HasPrefix(url, "../") {
+			continue
+		}
+		if _, err := ParseRepository(url); err != nil {
+			return fmt.Errorf("submodule %s cannot be imported: %w", url, err)
+		}
+	}
+
+	// Shallow like the repository itself, servers that refuse to hand out the pinned
+	// commit directly get a full fetch instead
+	if err := runGit(dir, auth, "submodule", "update", "--init", "--quiet", "--depth", "1"); err != nil {
+		if err := runGit(dir, auth, "submodule", "update", "--init", "--quiet"); err != nil {
+			return err
+		}
+	}
+
+	paths, err := gitConfigValues(dir, `^submodule\..*\.path$`)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := updateSubmodules(filepath.Join(dir, filepath.FromSlash(p)), auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitConfigValues returns the values of the .gitmodules keys of the repository at dir matching pattern
+func gitConfigValues(dir, pattern string) ([]string, error) {
+	cmd := exec.Command("git", "config", "--file", ".gitmodules", "--get-regexp", pattern)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return nil, nil // No key matched
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .gitmodules: %w", err)
+	}
+
+	var values []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if _, value, ok := strings.Cut(line, " "); ok {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// pullLFS replaces Git LFS pointers in the checkout of dir with the files they point to
+func pullLFS(dir string, auth []string) error {
+	// git grep exits with 1 when nothing matches
+	cmd := exec.Command("git", "grep", "--quiet", "-e", "filter=lfs", "--", ":(glob).gitattributes", ":(glob)**/.gitattributes")
+	cmd.Dir = dir
+	if err := cmd.Run(); err != nil {
+		return nil
+	}
+
+	if err := exec.Command("git", "lfs", "version").Run(); err != nil {
+		return fmt.Errorf("the repository uses Git LFS but git-lfs is not installed")
+	}
+	return runGit(dir, auth, "lfs", "pull")
+}
+
+// remoteRef translates ref into what to fetch from the remote
+func remoteRef(ref string) string {
+	switch {
+	case ref == "":
+		return "HEAD"
+	case strings.HasPrefix(ref, "pull/"):
+		return "refs/" + ref + "/head"
+	default:
+		// Branch and tag names, full SHAs and full refs are understood by git fetch as they are
+		return ref
+	}
+}
+
+// ValidateRef rejects refs that could be mistaken for options or refspecs
+func ValidateRef(ref string) error {
+	if strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, ": \t\n\\~^?*[") || strings.Contains(ref, "..") {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+	if strings.HasPrefix(ref, "pull/") {
+		number := strings.TrimSuffix(strings.TrimPrefix(ref, "pull/"), "/head")
+		if _, err := strconv.Atoi(number); err != nil {
+			return fmt.Errorf("invalid pull request ref %q, expected pull/<number>", ref)
+		}
+	}
+	return nil
+}
+
+// isHexSHA reports whether ref looks like a full or abbreviated commit SHA
+func isHexSHA(ref string) bool {
+	if len(ref) < 7 || len(ref) > 40 {
+		return false
+	}
+	for _, c := range ref {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// HeadCommit returns the SHA of the commit checked out in a cloned repository
+func (gc *GitClient) HeadCommit(repoPath string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve HEAD of %s: %w", repoPath, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// runGit runs a git command in dir with env added to its environment and returns its
+// output with the error if it fails
+func runGit(dir string, env []string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = gitEnv(env)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s failed: %s: %w", args[0], strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// gitEnv is the environment of git commands, with env added
+func gitEnv(env []string) []string {
+	// Never wait for someone to type a password. LFS files are fetched in one go by pullLFS
+	// rather than one by one while checking out.
+	return append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_LFS_SKIP_SMUDGE=1"), env...)
+}
+
+// ErrNoDockerfile is returned by FindDockerfile for repositories without a Dockerfile
+var ErrNoDockerfile = errors.New("no Dockerfile found in the repository")
+
+// FindDockerfile picks the Dockerfile to build when none was chosen: the shallowest file named
+// exactly Dockerfile or Containerfile, or the shallowest candidate of FindDockerfiles otherwise
+func (gc *GitClient) FindDockerfile(repoPath string) (string, error) {
+	dockerfiles, err := gc.FindDockerfiles(repoPath)
+	if err != nil {
+		return "", err
+	}
+	if len(dockerfiles) == 0 {
+		return "", ErrNoDockerfile
+	}
+
+	chosen := dockerfiles[0]
+	for _, d := range dockerfiles {
+		if name := path.Base(d.Path); name == "Dockerfile" || name == "Containerfile" {
+			chosen = d
+			break
+		}
+	}
+	return filepath.Join(repoPath, filepath.FromSlash(chosen.Path)), nil
+}
+
+// CleanupRepository removes the cloned repository directory
+func (gc *GitClient) CleanupRepository(repoPath string) error {
+	return os.RemoveAll(repoPath)
+}
@@ -0,0 +1,181 @@
+package git
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+	"github.com/moby/patternmatcher/ignorefile"
+)
+
+// ContextStats describes a build context sent to the builder
+type ContextStats struct {
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`   // Size of the files, without tar overhead
+	Ignored int   `json:"ignored"` // Files and directories left out by .dockerignore
+}
+
+// PrepareDockerBuildContext writes a tar archive of contextDir, relative to the repository
+// root, as it is checked out with its submodules and Git LFS files. Files matched by the
+// .dockerignore of the context are left out, or by <dockerfile>.dockerignore if there is one,
+// like BuildKit does. dockerfile is relative to the repository root and always included.
+// Symlinks are archived as links and refused if they lead outside the repository.
+func (gc *GitClient) PrepareDockerBuildContext(repoPath, contextDir, dockerfile string, writer io.Writer) (ContextStats, error) {
+	var stats ContextStats
+	if contextDir == "" {
+		contextDir = "."
+	}
+	repoRoot, err := filepath.EvalSymlinks(repoPath)
+	if err != nil {
+		return stats, fmt.Errorf("failed to resolve repository: %w", err)
+	}
+	root, err := ResolveRepoPath(repoRoot, contextDir)
+	if err != nil {
+		return stats, fmt.Errorf("build context %s is not a directory in the repository: %w", contextDir, err)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return stats, fmt.Errorf("build context %s is not a directory in the repository", contextDir)
+	}
+
+	// The Dockerfile is within the context, resolveDockerfile makes sure of that
+	inContext := dockerfile
+	if contextDir != "." {
+		inContext = strings.TrimPrefix(dockerfile, contextDir+"/")
+	}
+	matcher, err := dockerignore(repoRoot, contextDir, dockerfile, inContext)
+	if err != nil {
+		return stats, err
+	}
+
+	tw := tar.NewWriter(writer)
+	err = filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		// .git is a directory in the repository and a file in submodules, neither belongs in the context
+		if d.Name() == ".git" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if matcher != nil {
+			ignored, err := matcher.MatchesOrParentMatches(rel)
+			if err != nil {
+				return fmt.Errorf("failed to match %s against .dockerignore: %w", rel, err)
+			}
+			if ignored {
+				stats.Ignored++
+				// Exclusions such as !dir/keep may bring back files inside an ignored directory
+				if d.IsDir() && !matcher.Exclusions() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+			// Links are not followed here, but whatever copies the context later might
+			if filepath.IsAbs(link) || !withinDir(repoRoot, filepath.Join(filepath.Dir(p), link)) {
+				return fmt.Errorf("symlink %s points outside the repository", rel)
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", rel, err)
+		}
+		header.Name = rel
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		// Owners on the host mean nothing in the image
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", rel, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.Copy(tw, f)
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", rel, err)
+		}
+		stats.Files++
+		stats.Bytes += n
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to archive build context %s: %w", contextDir, err)
+	}
+	if err := tw.Close(); err != nil {
+		return stats, fmt.Errorf("failed to archive build context %s: %w", contextDir, err)
+	}
+	return stats, nil
+}
+
+// dockerignore reads the ignore rules of a build context, nil if there are none. The
+// Dockerfile and .dockerignore are sent anyway, as the Docker CLI does.
+func dockerignore(repoPath, contextDir, dockerfile, inContext string) (*patternmatcher.PatternMatcher, error) {
+	file, err := ResolveRepoPath(repoPath, dockerfile+".dockerignore")
+	if os.IsNotExist(err) {
+		file, err = ResolveRepoPath(repoPath, path.Join(contextDir, ".dockerignore"))
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer f.Close()
+
+	patterns, err := ignorefile.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	patterns = append(patterns, "!"+path.Clean(inContext), "!.dockerignore")
+
+	matcher, err := patternmatcher.New(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern in %s: %w", file, err)
+	}
+	return matcher, nil
+}
@@ -0,0 +1,178 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeRepo creates a repository checkout with the given files under a new directory and returns
+// its path. The directory also has an outside/secret file next to the repository.
+func writeRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	base := t.TempDir()
+	repo := filepath.Join(base, "repo")
+	for name, content := range map[string]string{"outside/secret": "do not leak"} {
+		writeFile(t, filepath.Join(base, name), content)
+	}
+	for name, content := range files {
+		writeFile(t, filepath.Join(repo, filepath.FromSlash(name)), content)
+	}
+	return repo
+}
+
+func writeFile(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// archive prepares the build context and returns the names of the archived files and directories
+func archive(t *testing.T, repo, contextDir, dockerfile string) ([]string, map[string]*tar.Header, ContextStats, error) {
+	t.Helper()
+	var buf bytes.Buffer
+	stats, err := (&GitClient{}).PrepareDockerBuildContext(repo, contextDir, dockerfile, &buf)
+	if err != nil {
+		return nil, nil, stats, err
+	}
+	var names []string
+	headers := make(map[string]*tar.Header)
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		headers[header.Name] = header
+	}
+	sort.Strings(names)
+	return names, headers, stats, nil
+}
+
+func TestBuildContextFollowsDockerignore(t *testing.T) {
+	repo := writeRepo(t, map[string]string{
+		"Dockerfile":                "FROM scratch",
+		".dockerignore":             "node_modules\n*.log\n!keep.log\nsecret/\nDockerfile\n",
+		"main.go":                   "package main",
+		"keep.log":                  "kept",
+		"debug.log":                 "ignored",
+		"node_modules/dep/index.js": "ignored",
+		"secret/key":                "ignored",
+		".git/config":               "never sent",
+	})
+
+	names, _, stats, err := archive(t, repo, "", "Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Dockerfile and .dockerignore are sent even when they match
+	want := []string{".dockerignore", "Dockerfile", "keep.log", "main.go"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("archived %v, want %v", names, want)
+	}
+	if stats.Files != 4 || stats.Ignored == 0 {
+		t.Fatalf("stats %+v, want 4 files and some ignored", stats)
+	}
+}
+
+func TestBuildContextPrefersTheDockerfilesOwnIgnoreFile(t *testing.T) {
+	repo := writeRepo(t, map[string]string{
+		"services/api/Dockerfile":              "FROM scratch",
+		"services/api/Dockerfile.dockerignore": "*.md\n",
+		"services/api/.dockerignore":           "*.go\n",
+		"services/api/main.go":                 "package main",
+		"services/api/README.md":               "ignored",
+		"services/web/index.html":              "outside the context",
+	})
+
+	names, _, _, err := archive(t, repo, "services/api", "services/api/Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".dockerignore", "Dockerfile", "Dockerfile.dockerignore", "main.go"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("archived %v, want %v", names, want)
+	}
+}
+
+func TestBuildContextKeepsSymlinksInsideTheRepository(t *testing.T) {
+	repo := writeRepo(t, map[string]string{
+		"Dockerfile":     "FROM scratch",
+		"config/app.yml": "port: 3000",
+	})
+	symlink(t, "config/app.yml", filepath.Join(repo, "app.yml"))
+	symlink(t, "../config", filepath.Join(repo, "deploy", "config"))
+
+	names, headers, _, err := archive(t, repo, "", "Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, ok := headers["app.yml"]
+	if !ok || link.Typeflag != tar.TypeSymlink || link.Linkname != "config/app.yml" {
+		t.Fatalf("archived %v, want app.yml as a link to config/app.yml", names)
+	}
+	if header, ok := headers["deploy/config"]; !ok || header.Typeflag != tar.TypeSymlink {
+		t.Fatalf("archived %v, want deploy/config as a link", names)
+	}
+}
+
+func TestBuildContextRefusesEscapingSymlinks(t *testing.T) {
+	for _, tc := range []struct {
+		link, target string
+	}{
+		{"leak", "/etc/passwd"},
+		{"leak", "../outside/secret"},
+		{"nested/leak", "../../outside"},
+		{"leak", "../repo/../outside/secret"},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			repo := writeRepo(t, map[string]string{"Dockerfile": "FROM scratch"})
+			symlink(t, tc.target, filepath.Join(repo, filepath.FromSlash(tc.link)))
+
+			if _, _, _, err := archive(t, repo, "", "Dockerfile"); err == nil || !strings.Contains(err.Error(), "outside the repository") {
+				t.Fatalf("archiving %s linked to %s: %v", tc.link, tc.target, err)
+			}
+		})
+	}
+}
+
+func TestBuildContextRefusesEscapingContextAndIgnoreFile(t *testing.T) {
+	repo := writeRepo(t, map[string]string{"Dockerfile": "FROM scratch"})
+	symlink(t, "../outside", filepath.Join(repo, "context"))
+	if _, _, _, err := archive(t, repo, "context", "context/Dockerfile"); err == nil || !strings.Contains(err.Error(), "outside the repository") {
+		t.Fatalf("archiving a context linked outside the repository: %v", err)
+	}
+	if _, _, _, err := archive(t, repo, "../outside", "Dockerfile"); err == nil {
+		t.Fatal("archived a context outside the repository")
+	}
+
+	// The ignore rules of a context must come from the repository too
+	symlink(t, "../outside/secret", filepath.Join(repo, ".dockerignore"))
+	if _, _, _, err := archive(t, repo, "", "Dockerfile"); err == nil || !strings.Contains(err.Error(), "outside the repository") {
+		t.Fatalf("reading a .dockerignore linked outside the repository: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credential gives a clone access to a private repository. It is only ever handed to the git
+// processes that fetch from the remote: never put in the URL, the repository's config, logs,
+// the build context or the container.
+type Credential struct {
+	Token  string `json:"token,omitempty"`   // Access token, e.g. a GitHub personal access or App installation token, for https URLs
+	SSHKey string `json:"ssh_key,omitempty"` // Private deploy key, for SSH URLs
+}
+
+// String keeps the secret out of anything that formats a credential
+func (c *Credential) String() string {
+	switch {
+	case c == nil:
+		return "none"
+	case c.Token != "":
+		return "token"
+	case c.SSHKey != "":
+		return "ssh key"
+	default:
+		return "none"
+	}
+}
+
+// GoString keeps the secret out of %#v
+func (c *Credential) GoString() string {
+	return "git.Credential(" + c.String() + ")"
+}
+
+// validate checks that the credential can be used to clone repo
+func (c *Credential) validate(repo Repository) error {
+	if c == nil {
+		return nil
+	}
+	switch {
+	case c.Token != "" && c.SSHKey != "":
+		return fmt.Errorf("provide either a token or an SSH key, not both")
+	case c.Token != "" && repo.SSH:
+		return fmt.Errorf("tokens can only be used with https repository URLs")
+	case c.SSHKey != "" && !repo.SSH:
+		return fmt.Errorf("SSH keys can only be used with SSH repository URLs")
+	}
+	return nil
+}
+
+// env returns the environment that makes git authenticate to repo's host with the credential,
+// sending tokens with username, and a function removing anything written to disk for it
+func (c *Credential) env(repo Repository, username string) ([]string, func(), error) {
+	noop := func() {}
+	switch {
+	case c == nil:
+		return nil, noop, nil
+
+	case c.Token != "":
+		// A credential helper reads the token from the environment, so it never appears on
+		// a command line. Configuring it through the environment keeps it out of .git/config.
+		// It only answers for the repository's host, submodules elsewhere never see the token.
+		helper := `!f() { test "$1" = get && echo "username=$K0_GIT_USERNAME" && echo "password=$K0_GIT_TOKEN"; }; f`
+		return []string{
+			"K0_GIT_USERNAME=" + username,
+			"K0_GIT_TOKEN=" + c.Token,
+			"GIT_CONFIG_COUNT=2",
+			"GIT_CONFIG_KEY_0=credential.helper",
+			"GIT_CONFIG_VALUE_0=",
+			"GIT_CONFIG_KEY_1=credential.https://" + repo.Host + ".helper",
+			"GIT_CONFIG_VALUE_1=" + helper,
+		}, noop, nil
+
+	case c.SSHKey != "":
+		dir, err := os.MkdirTemp("", "k0-ssh-")
+		if err != nil {
+			return nil, noop, fmt.Errorf("failed to create directory for SSH key: %w", err)
+		}
+		cleanup := func() { os.RemoveAll(dir) }
+
+		keyPath := filepath.Join(dir, "id")
+		key := strings.TrimSpace(c.SSHKey) + "\n"
+		if err := os.WriteFile(keyPath, []byte(key), 0600); err != nil {
+			cleanup()
+			return nil, noop, fmt.Errorf("failed to write SSH key: %w", err)
+		}
+
+		return []string{"GIT_SSH_COMMAND=" + sshCommand(keyPath, dir)}, cleanup, nil
+	}
+	return nil, noop, nil
+}
+
+// sshCommand uses only the given key. Host keys are checked against GIT_SSH_KNOWN_HOSTS if
+// set, otherwise a host's key is accepted the first time it is seen.
+func sshCommand(keyPath, dir string) string {
+	knownHosts := os.Getenv("GIT_SSH_KNOWN_HOSTS")
+	strict := "yes"
+	if knownHosts == "" {
+		knownHosts = filepath.Join(dir, "known_hosts")
+		strict = "accept-new"
+	}
+	return fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o IdentityAgent=none -o BatchMode=yes -o StrictHostKeyChecking=%s -o UserKnownHostsFile=%s",
+		shellQuote(keyPath), strict, shellQuote(knownHosts))
+}
+
+// shellQuote quotes s for the shell git runs GIT_SSH_COMMAND with
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
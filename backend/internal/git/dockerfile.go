@@ -0,0 +1,205 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DockerfileInfo describes a Dockerfile found in a repository
+type DockerfileInfo struct {
+	Path         string            `json:"path"`          // Relative to the repository root, with forward slashes
+	BaseImage    string            `json:"base_image"`    // Image the final stage is built from
+	Stages       []DockerfileStage `json:"stages"`        // Every FROM, in order
+	ExposedPorts []string          `json:"exposed_ports"` // Ports the final stage EXPOSEs, e.g. "3000/tcp"
+}
+
+// DockerfileStage is one FROM instruction of a Dockerfile, usable as a build target if named
+type DockerfileStage struct {
+	Name      string `json:"name,omitempty"`
+	BaseImage string `json:"base_image"`
+}
+
+// skippedDirs are never searched for Dockerfiles
+var skippedDirs = map[string]bool{
+	".git":         true,
+	"node_modules": true,
+	"vendor":       true,
+}
+
+// IsDockerfileName reports whether a file name looks like a Dockerfile: Dockerfile,
+// Dockerfile.*, *.Dockerfile, Containerfile or Containerfile.*
+func IsDockerfileName(name string) bool {
+	lower := strings.ToLower(name)
+	return lower == "dockerfile" || lower == "containerfile" ||
+		strings.HasPrefix(lower, "dockerfile.") || strings.HasPrefix(lower, "containerfile.") ||
+		strings.HasSuffix(lower, ".dockerfile")
+}
+
+// FindDockerfiles returns every Dockerfile in the repository, shallowest first and
+// alphabetically within the same depth
+func (gc *GitClient) FindDockerfiles(repoPath string) ([]DockerfileInfo, error) {
+	var paths []string
+	err := filepath.WalkDir(repoPath, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if skippedDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && IsDockerfileName(d.Name()) {
+			rel, err := filepath.Rel(repoPath, p)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error searching for Dockerfiles: %w", err)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		di, dj := strings.Count(paths[i], "/"), strings.Count(paths[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return paths[i] < paths[j]
+	})
+
+	dockerfiles := make([]DockerfileInfo, 0, len(paths))
+	for _, p := range paths {
+		info, err := parseDockerfile(filepath.Join(repoPath, filepath.FromSlash(p)))
+		if err != nil {
+			return nil, err
+		}
+		info.Path = p
+		dockerfiles = append(dockerfiles, info)
+	}
+	return dockerfiles, nil
+}
+
+// parseDockerfile reads the FROM and EXPOSE instructions of a Dockerfile
+func parseDockerfile(file string) (DockerfileInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return DockerfileInfo{}, fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer f.Close()
+
+	info := DockerfileInfo{Stages: []DockerfileStage{}, ExposedPorts: []string{}}
+	for _, instruction := range dockerfileInstructions(f) {
+		fields := strings.Fields(instruction)
+		if len(fields) < 2 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "FROM":
+			args := fields[1:]
+			for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+				args = args[1:] // --platform=...
+			}
+			if len(args) == 0 {
+				continue
+			}
+			stage := DockerfileStage{BaseImage: args[0]}
+			if len(args) >= 3 && strings.EqualFold(args[1], "AS") {
+				stage.Name = args[2]
+			}
+			info.Stages = append(info.Stages, stage)
+			info.BaseImage = stage.BaseImage
+			// Only the final stage's ports end up in the image
+			info.ExposedPorts = info.ExposedPorts[:0]
+		case "EXPOSE":
+			for _, port := range fields[1:] {
+				if !strings.Contains(port, "/") {
+					port += "/tcp"
+				}
+				info.ExposedPorts = append(info.ExposedPorts, port)
+			}
+		}
+	}
+	return info, nil
+}
+
+// dockerfileInstructions splits a Dockerfile into instructions, joining continued lines
+// and dropping comments. Heredoc bodies are not understood, which is fine for FROM and EXPOSE.
+func dockerfileInstructions(f *os.File) []string {
+	var instructions []string
+	var current strings.Builder
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+		if s := strings.TrimSpace(current.String()); s != "" {
+			instructions = append(instructions, s)
+		}
+		current.Reset()
+	}
+	if s := strings.TrimSpace(current.String()); s != "" {
+		instructions = append(instructions, s)
+	}
+	return instructions
+}
+
+// CleanRepoPath validates a path relative to the repository root and returns it cleaned,
+// "." for the root itself
+func CleanRepoPath(p string) (string, error) {
+	p = filepath.ToSlash(p)
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("path %q must stay inside the repository", p)
+		}
+	}
+	cleaned := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if cleaned == "" {
+		return ".", nil
+	}
+	return cleaned, nil
+}
+
+// ResolveRepoPath returns the real location of p, relative to the repository root, with every
+// symlink followed. The repository can ship symlinks pointing anywhere on the server, so the
+// result must stay inside the repository as well.
+func ResolveRepoPath(repoPath, p string) (string, error) {
+	p, err := CleanRepoPath(p)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(repoPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve repository: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(p)))
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(root, resolved) {
+		return "", fmt.Errorf("path %q leads outside the repository", p)
+	}
+	return resolved, nil
+}
+
+// withinDir reports whether p is dir or inside it, both cleaned absolute paths
+func withinDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,236 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+const defaultMirrorCacheSize = 10 << 30
+
+// MirrorCache keeps a bare mirror of every repository imported, keyed by remote URL.
+// Imports fetch into the mirror, which only transfers what changed since the last import,
+// and check out their workspace from it. The fetch goes to the remote with the importer's
+// credential every time, so a mirror never hands out a private repository to someone who
+// could not fetch it themselves.
+type MirrorCache struct {
+	Dir      string
+	MaxBytes int64 // Least recently used mirrors are evicted beyond this size
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex // Per mirror, held while it is fetched into or read from
+}
+
+// NewMirrorCache creates a cache of mirrors in dir
+func NewMirrorCache(dir string, maxBytes int64) (*MirrorCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create mirror cache directory: %w", err)
+	}
+	return &MirrorCache{Dir: dir, MaxBytes: maxBytes, locks: make(map[string]*sync.Mutex)}, nil
+}
+
+var (
+	defaultMirrors     *MirrorCache
+	defaultMirrorsOnce sync.Once
+)
+
+// DefaultMirrorCache returns the cache shared by every GitClient of the process, nil if
+// caching is disabled. It is configured by:
+//
+//	GIT_CACHE_DISABLED=true   clone every import from scratch
+//	GIT_CACHE_DIR=path        where mirrors are kept, k0-git-cache in the temp directory by default
+//	GIT_CACHE_MAX_SIZE=10GB   size beyond which the least recently used mirrors are evicted
+func DefaultMirrorCache() *MirrorCache {
+	defaultMirrorsOnce.Do(func() {
+		if disabled, _ := strconv.ParseBool(os.Getenv("GIT_CACHE_DISABLED")); disabled {
+			return
+		}
+		dir := os.Getenv("GIT_CACHE_DIR")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "k0-git-cache")
+		}
+		maxBytes := int64(defaultMirrorCacheSize)
+		if size := os.Getenv("GIT_CACHE_MAX_SIZE"); size != "" {
+			parsed, err := units.RAMInBytes(size)
+			if err != nil {
+				log.Printf("Ignoring invalid GIT_CACHE_MAX_SIZE %q: %v", size, err)
+			} else {
+				maxBytes = parsed
+			}
+		}
+
+		cache, err := NewMirrorCache(dir, maxBytes)
+		if err != nil {
+			log.Printf("Git mirror cache disabled: %v", err)
+			return
+		}
+		defaultMirrors = cache
+	})
+	return defaultMirrors
+}
+
+// mirrorLock returns the lock of the mirror at dir
+func (m *MirrorCache) mirrorLock(dir string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l, ok := m.locks[dir]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[dir] = l
+	}
+	return l
+}
+
+// mirrorDir is where the mirror of a remote is kept
+func (m *MirrorCache) mirrorDir(remoteURL string) string {
+	sum := sha256.Sum256([]byte(remoteURL))
+	return filepath.Join(m.Dir, hex.EncodeToString(sum[:16])+".git")
+}
+
+// checkout fetches ref of repo into its mirror, then fetches the commit from the mirror into
+// the empty repository at dir and checks it out. auth is only used to talk to the remote.
+func (m *MirrorCache) checkout(dir string, repo Repository, ref string, auth []string) error {
+	mirror := m.mirrorDir(repo.CloneURL)
+	l := m.mirrorLock(mirror)
+	l.Lock()
+	err := m.fetch(mirror, repo.CloneURL, ref, auth, dir)
+	l.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Outside of the lock, eviction skips mirrors that are in use
+	m.evict()
+	return nil
+}
+
+// fetch updates the mirror and checks out ref from it into dir, with the mirror's lock held
+func (m *MirrorCache) fetch(mirror, remoteURL, ref string, auth []string, dir string) error {
+	if _, err := os.Stat(filepath.Join(mirror, "HEAD")); err != nil {
+		// A previous attempt may have been interrupted halfway
+		os.RemoveAll(mirror)
+		if err := os.MkdirAll(mirror, 0700); err != nil {
+			return fmt.Errorf("failed to create mirror: %w", err)
+		}
+		if err := runGit(mirror, nil, "init", "--quiet", "--bare"); err != nil {
+			os.RemoveAll(mirror)
+			return err
+		}
+		// Workspaces fetch commits by SHA, which are not necessarily at the tip of a ref
+		if err := runGit(mirror, nil, "config", "uploadpack.allowAnySHA1InWant", "true"); err != nil {
+			os.RemoveAll(mirror)
+			return err
+		}
+	}
+	now := time.Now()
+	os.Chtimes(mirror, now, now) // Last use, for eviction
+
+	// Every ref fetched is kept under refs/k0/ so the next fetch only transfers new objects.
+	// Servers only hand out commits by their full SHA, an abbreviated one needs every branch and tag.
+	var commit string
+	if abbreviated := isHexSHA(ref) && len(ref) < 40; abbreviated {
+		if err := runGit(mirror, auth, "fetch", "--quiet", remoteURL, "+refs/heads/*:refs/k0/heads/*", "+refs/tags/*:refs/k0/tags/*"); err != nil {
+			return err
+		}
+		commit = ref + "^{commit}"
+	} else {
+		sum := sha256.Sum256([]byte(ref))
+		local := "refs/k0/fetched/" + hex.EncodeToString(sum[:8])
+		if err := runGit(mirror, auth, "fetch", "--quiet", remoteURL, "+"+remoteRef(ref)+":"+local); err != nil {
+			return err
+		}
+		commit = local + "^{commit}"
+	}
+
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", commit)
+	cmd.Dir = mirror
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("ref %q not found in the repository", ref)
+	}
+	sha := strings.TrimSpace(string(output))
+
+	// The workspace gets its own copy of the commit, so evicting the mirror later can't break it
+	if err := runGit(dir, nil, "fetch", "--quiet", "--depth", "1", "file://"+mirror, sha); err != nil {
+		return err
+	}
+	return runGit(dir, nil, "checkout", "--quiet", "--detach", sha)
+}
+
+// evict removes the least recently used mirrors until the cache fits in MaxBytes. Mirrors
+// in use are skipped.
+func (m *MirrorCache) evict() {
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		log.Printf("Failed to read mirror cache: %v", err)
+		return
+	}
+
+	type mirrorUsage struct {
+		dir      string
+		size     int64
+		lastUsed time.Time
+	}
+	var mirrors []mirrorUsage
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(m.Dir, entry.Name())
+		size := dirSize(dir)
+		mirrors = append(mirrors, mirrorUsage{dir: dir, size: size, lastUsed: info.ModTime()})
+		total += size
+	}
+	if total <= m.MaxBytes {
+		return
+	}
+
+	sort.Slice(mirrors, func(i, j int) bool { return mirrors[i].lastUsed.Before(mirrors[j].lastUsed) })
+	for _, mirror := range mirrors {
+		if total <= m.MaxBytes {
+			return
+		}
+		l := m.mirrorLock(mirror.dir)
+		if !l.TryLock() {
+			continue
+		}
+
+		log.Printf("Evicting git mirror %s (%s)", mirror.dir, units.HumanSize(float64(mirror.size)))
+		if err := os.RemoveAll(mirror.dir); err != nil {
+			log.Printf("Failed to evict git mirror %s: %v", mirror.dir, err)
+		} else {
+			total -= mirror.size
+		}
+		l.Unlock()
+	}
+}
+
+// dirSize returns the size of the files under dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
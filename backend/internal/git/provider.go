@@ -0,0 +1,221 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repository is a parsed remote repository URL
+type Repository struct {
+	Provider string `json:"provider"` // Name of the Provider hosting it
+	Host     string `json:"host"`
+	Owner    string `json:"owner"` // User, organization or group path, e.g. "group/subgroup" on GitLab
+	Name     string `json:"name"`
+	CloneURL string `json:"clone_url"` // What git clones from
+	SSH      bool   `json:"ssh"`       // Cloned over SSH rather than https
+}
+
+// FullName returns owner/name
+func (r Repository) FullName() string {
+	if r.Owner == "" {
+		return r.Name
+	}
+	return r.Owner + "/" + r.Name
+}
+
+// Metadata is what a provider knows about a repository
+type Metadata struct {
+	DefaultBranch string `json:"default_branch"`
+	Description   string `json:"description,omitempty"`
+	Private       bool   `json:"private"`
+	WebURL        string `json:"web_url,omitempty"`
+}
+
+// Provider is a kind of git hosting service
+type Provider interface {
+	// Name identifies the provider in configuration and in Repository.Provider
+	Name() string
+	// Parse splits the path of a repository URL on one of the provider's hosts into owner and name
+	Parse(host, path string) (owner, name string, ok bool)
+	// Metadata looks a repository up, authenticating with cred if it is not nil
+	Metadata(repo Repository, cred *Credential) (Metadata, error)
+	// TokenUsername is the username the provider expects with a token over https
+	TokenUsername() string
+}
+
+// defaultAllowedHosts are used unless GIT_ALLOWED_HOSTS is set
+const defaultAllowedHosts = "github=github.com,gitlab=gitlab.com,bitbucket=bitbucket.org"
+
+var (
+	providers = map[string]Provider{
+		"github":    githubProvider{},
+		"gitlab":    gitlabProvider{},
+		"bitbucket": bitbucketProvider{},
+		"gitea":     giteaProvider{},
+		"git":       genericProvider{},
+	}
+
+	hostsOnce    sync.Once
+	allowedHosts map[string]string // Host to provider name, "*" for any host
+	hostsErr     error
+)
+
+var apiClient = &http.Client{Timeout: 10 * time.Second}
+
+// AllowedHosts returns the hosts repositories may be imported from and the provider of each.
+// Operators configure them with GIT_ALLOWED_HOSTS, a comma separated list of provider=host
+// entries such as "github=github.com,gitea=git.example.com,git=*". The git provider accepts
+// any https://…/*.git remote, and * allows every host not listed otherwise.
+func AllowedHosts() (map[string]string, error) {
+	hostsOnce.Do(func() {
+		config := os.Getenv("GIT_ALLOWED_HOSTS")
+		if config == "" {
+			config = defaultAllowedHosts
+		}
+		allowedHosts, hostsErr = parseAllowedHosts(config)
+	})
+	return allowedHosts, hostsErr
+}
+
+func parseAllowedHosts(config string) (map[string]string, error) {
+	hosts := make(map[string]string)
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, host, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid GIT_ALLOWED_HOSTS entry %q, expected provider=host", entry)
+		}
+		if _, known := providers[name]; !known {
+			return nil, fmt.Errorf("unknown git provider %q in GIT_ALLOWED_HOSTS", name)
+		}
+		hosts[strings.ToLower(host)] = name
+	}
+	return hosts, nil
+}
+
+// ParseRepository validates a repository URL against the allowed hosts. Both https URLs and
+// SSH URLs, git@host:owner/name.git or ssh://git@host/owner/name.git, are accepted.
+func ParseRepository(rawURL string) (Repository, error) {
+	hosts, err := AllowedHosts()
+	if err != nil {
+		return Repository{}, err
+	}
+
+	host, path, ssh, err := splitRemote(rawURL)
+	if err != nil {
+		return Repository{}, err
+	}
+
+	name, ok := hosts[host]
+	if !ok {
+		name, ok = hosts["*"]
+	}
+	if !ok {
+		return Repository{}, fmt.Errorf("repositories on %s are not allowed", host)
+	}
+	provider := providers[name]
+
+	owner, repoName, ok := provider.Parse(host, path)
+	if !ok {
+		return Repository{}, fmt.Errorf("%s is not a %s repository URL", rawURL, name)
+	}
+
+	repo := Repository{
+		Provider: name,
+		Host:     host,
+		Owner:    owner,
+		Name:     repoName,
+		SSH:      ssh,
+	}
+	if ssh {
+		repo.CloneURL = rawURL
+	} else {
+		repo.CloneURL = "https://" + host + "/" + repo.FullName() + ".git"
+	}
+	return repo, nil
+}
+
+// LookupMetadata asks the repository's provider about it
+func LookupMetadata(repo Repository, cred *Credential) (Metadata, error) {
+	provider, ok := providers[repo.Provider]
+	if !ok {
+		return Metadata{}, fmt.Errorf("unknown git provider %q", repo.Provider)
+	}
+	return provider.Metadata(repo, cred)
+}
+
+// splitRemote returns the lowercased host and the path of a remote URL
+func splitRemote(rawURL string) (host, path string, ssh bool, err error) {
+	// scp-like SSH syntax, user@host:path
+	if user, rest, ok := strings.Cut(rawURL, "@"); ok && !strings.Contains(user, "/") && !strings.Contains(rawURL, "://") {
+		host, path, ok := strings.Cut(rest, ":")
+		if !ok || host == "" || path == "" || !validSSHUser(user) {
+			return "", "", false, fmt.Errorf("invalid SSH repository URL: %s", rawURL)
+		}
+		return strings.ToLower(host), "/" + path, true, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", false, fmt.Errorf("invalid repository URL %s: %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "https", "http":
+		// Always cloned over https
+	case "ssh":
+		ssh = true
+	default:
+		return "", "", false, fmt.Errorf("repository URLs must use https or ssh: %s", rawURL)
+	}
+	if u.User != nil && !ssh {
+		return "", "", false, fmt.Errorf("repository URLs must not contain credentials, pass them separately")
+	}
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword || !validSSHUser(u.User.Username()) {
+			return "", "", false, fmt.Errorf("invalid SSH repository URL: %s", rawURL)
+		}
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", "", false, fmt.Errorf("repository URLs must not have a query or fragment: %s", rawURL)
+	}
+	if u.Hostname() == "" {
+		return "", "", false, fmt.Errorf("repository URL without a host: %s", rawURL)
+	}
+	return strings.ToLower(u.Host), u.Path, ssh, nil
+}
+
+// validSSHUser accepts plain user names. ssh takes anything starting with a dash as an option.
+func validSSHUser(user string) bool {
+	if user == "" || strings.HasPrefix(user, "-") {
+		return false
+	}
+	for _, r := range user {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitPath splits a repository path into its segments, without a trailing .git or slash
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	path = strings.TrimSuffix(path, ".git")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// validSegment rejects path segments that are empty or could be mistaken for something else
+func validSegment(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.HasPrefix(s, "-")
+}
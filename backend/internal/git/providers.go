@@ -0,0 +1,244 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// githubProvider is github.com, owner/name
+type githubProvider struct{}
+
+func (githubProvider) Name() string          { return "github" }
+func (githubProvider) TokenUsername() string { return "x-access-token" }
+
+func (githubProvider) Parse(host, path string) (string, string, bool) {
+	return ownerAndName(path)
+}
+
+func (githubProvider) Metadata(repo Repository, cred *Credential) (Metadata, error) {
+	apiURL := "https://api." + repo.Host + "/repos/" + repo.FullName()
+	if repo.Host != "github.com" {
+		// GitHub Enterprise Server
+		apiURL = "https://" + repo.Host + "/api/v3/repos/" + repo.FullName()
+	}
+
+	var body struct {
+		DefaultBranch string `json:"default_branch"`
+		Description   string `json:"description"`
+		Private       bool   `json:"private"`
+		HTMLURL       string `json:"html_url"`
+	}
+	if err := getJSON(apiURL, "Bearer", cred, &body); err != nil {
+		return Metadata{}, err
+	}
+	return Metadata{
+		DefaultBranch: body.DefaultBranch,
+		Description:   body.Description,
+		Private:       body.Private,
+		WebURL:        body.HTMLURL,
+	}, nil
+}
+
+// gitlabProvider is gitlab.com or a self-managed GitLab, group/subgroup/.../name
+type gitlabProvider struct{}
+
+func (gitlabProvider) Name() string          { return "gitlab" }
+func (gitlabProvider) TokenUsername() string { return "oauth2" }
+
+func (gitlabProvider) Parse(host, path string) (string, string, bool) {
+	segments := splitPath(path)
+	// Anything after /-/ is a page of the project, not part of its path
+	for i, s := range segments {
+		if s == "-" {
+			segments = segments[:i]
+			break
+		}
+	}
+	if len(segments) < 2 {
+		return "", "", false
+	}
+	for _, s := range segments {
+		if !validSegment(s) {
+			return "", "", false
+		}
+	}
+	return strings.Join(segments[:len(segments)-1], "/"), segments[len(segments)-1], true
+}
+
+func (gitlabProvider) Metadata(repo Repository, cred *Credential) (Metadata, error) {
+	apiURL := "https://" + repo.Host + "/api/v4/projects/" + url.PathEscape(repo.FullName())
+
+	var body struct {
+		DefaultBranch string `json:"default_branch"`
+		Description   string `json:"description"`
+		Visibility    string `json:"visibility"`
+		WebURL        string `json:"web_url"`
+	}
+	if err := getJSON(apiURL, "Bearer", cred, &body); err != nil {
+		return Metadata{}, err
+	}
+	return Metadata{
+		DefaultBranch: body.DefaultBranch,
+		Description:   body.Description,
+		Private:       body.Visibility != "public",
+		WebURL:        body.WebURL,
+	}, nil
+}
+
+// bitbucketProvider is bitbucket.org, workspace/slug
+type bitbucketProvider struct{}
+
+func (bitbucketProvider) Name() string          { return "bitbucket" }
+func (bitbucketProvider) TokenUsername() string { return "x-token-auth" }
+
+func (bitbucketProvider) Parse(host, path string) (string, string, bool) {
+	return ownerAndName(path)
+}
+
+func (bitbucketProvider) Metadata(repo Repository, cred *Credential) (Metadata, error) {
+	apiURL := "https://api.bitbucket.org/2.0/repositories/" + repo.FullName()
+
+	var body struct {
+		Description string `json:"description"`
+		IsPrivate   bool   `json:"is_private"`
+		MainBranch  struct {
+			Name string `json:"name"`
+		} `json:"mainbranch"`
+		Links struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	}
+	if err := getJSON(apiURL, "Bearer", cred, &body); err != nil {
+		return Metadata{}, err
+	}
+	return Metadata{
+		DefaultBranch: body.MainBranch.Name,
+		Description:   body.Description,
+		Private:       body.IsPrivate,
+		WebURL:        body.Links.HTML.Href,
+	}, nil
+}
+
+// giteaProvider is a self-hosted Gitea or Forgejo, owner/name
+type giteaProvider struct{}
+
+func (giteaProvider) Name() string          { return "gitea" }
+func (giteaProvider) TokenUsername() string { return "oauth2" }
+
+func (giteaProvider) Parse(host, path string) (string, string, bool) {
+	return ownerAndName(path)
+}
+
+func (giteaProvider) Metadata(repo Repository, cred *Credential) (Metadata, error) {
+	apiURL := "https://" + repo.Host + "/api/v1/repos/" + repo.FullName()
+
+	var body struct {
+		DefaultBranch string `json:"default_branch"`
+		Description   string `json:"description"`
+		Private       bool   `json:"private"`
+		HTMLURL       string `json:"html_url"`
+	}
+	if err := getJSON(apiURL, "token", cred, &body); err != nil {
+		return Metadata{}, err
+	}
+	return Metadata{
+		DefaultBranch: body.DefaultBranch,
+		Description:   body.Description,
+		Private:       body.Private,
+		WebURL:        body.HTMLURL,
+	}, nil
+}
+
+// genericProvider is any git server, as long as the URL ends in .git. It has no API, so
+// metadata comes from the remote itself.
+type genericProvider struct{}
+
+func (genericProvider) Name() string          { return "git" }
+func (genericProvider) TokenUsername() string { return "git" }
+
+func (genericProvider) Parse(host, path string) (string, string, bool) {
+	if !strings.HasSuffix(path, ".git") {
+		return "", "", false
+	}
+	segments := splitPath(path)
+	if len(segments) == 0 {
+		return "", "", false
+	}
+	for _, s := range segments {
+		if !validSegment(s) {
+			return "", "", false
+		}
+	}
+	return strings.Join(segments[:len(segments)-1], "/"), segments[len(segments)-1], true
+}
+
+func (genericProvider) Metadata(repo Repository, cred *Credential) (Metadata, error) {
+	auth, cleanup, err := cred.env(repo, genericProvider{}.TokenUsername())
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer cleanup()
+
+	// The symbolic HEAD of the remote names its default branch
+	cmd := exec.Command("git", "ls-remote", "--symref", repo.CloneURL, "HEAD")
+	cmd.Env = gitEnv(auth)
+	output, err := cmd.Output()
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to query %s: %w", repo.CloneURL, err)
+	}
+
+	var meta Metadata
+	for _, line := range strings.Split(string(output), "\n") {
+		if ref, ok := strings.CutPrefix(line, "ref: refs/heads/"); ok {
+			meta.DefaultBranch, _, _ = strings.Cut(ref, "\t")
+		}
+	}
+	meta.Private = cred != nil
+	return meta, nil
+}
+
+// ownerAndName accepts exactly owner/name paths
+func ownerAndName(path string) (string, string, bool) {
+	segments := splitPath(path)
+	if len(segments) != 2 || !validSegment(segments[0]) || !validSegment(segments[1]) {
+		return "", "", false
+	}
+	return segments[0], segments[1], true
+}
+
+// getJSON fetches a provider API resource into v, sending the credential's token with scheme
+func getJSON(apiURL, scheme string, cred *Credential, v any) error {
+	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if cred != nil && cred.Token != "" {
+		req.Header.Set("Authorization", scheme+" "+cred.Token)
+	}
+
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %w", apiURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		// Private repositories look like missing ones without the right credential
+		return fmt.Errorf("repository not found or not accessible (%s)", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected response from %s: %s", apiURL, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %w", apiURL, err)
+	}
+	return nil
+}
@@ -136,9 +136,9 @@ func (cm *ContainerManager) ListClientContainers(clientID string) []*Container {
 
 // Removed deprecated CreateContainerFromGitHub method - use CreateContainerFromGitHubWS instead
 
-func (cm *ContainerManager) CreateContainerFromGitHubWS(clientID, imageName, githubURL string, ContainerStreams *sync.Map) (*Container, error) {
+func (cm *ContainerManager) CreateContainerFromGitHubWS(clientID, imageName, githubURL string) (*Container, error) {
 	// Start a container using the Docker client with GitHub repository
-	response, err := cm.dockerClient.BuildAndStartContainerFromGitHubWS(imageName, githubURL, ContainerStreams)
+	response, err := cm.dockerClient.BuildAndStartContainerFromGitHubWS(githubURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create container from GitHub: %w", err)
 	}
@@ -85,7 +85,7 @@ func (q *JobQueue) worker() {
 			switch job.Type {
 			case JobTypeCreate:
 				// Create a new container from GitHub (WebSocket version)
-				container, err := q.manager.CreateContainerFromGitHubWS(job.ClientID, job.ImageName, job.GitHubURL, nil)
+				container, err := q.manager.CreateContainerFromGitHubWS(job.ClientID, job.ImageName, job.GitHubURL)
 				if err != nil {
 					job.Error <- err
 					continue
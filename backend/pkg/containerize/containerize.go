@@ -0,0 +1,154 @@
+package containerize
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsupported is returned by Detect when no known kind of project is found
+var ErrUnsupported = errors.New("no supported project found, add a Dockerfile to the repository")
+
+// Project is what Detect found out about a repository without a Dockerfile
+type Project struct {
+	Language       string `json:"language"`                  // node, python, go, rust, java, ruby or static
+	Framework      string `json:"framework,omitempty"`       // e.g. next, django or spring-boot
+	PackageManager string `json:"package_manager,omitempty"` // e.g. pnpm, poetry or gradle
+	StartCommand   string `json:"start_command"`             // Run by sh -c when the container starts, empty if not found
+	Port           int    `json:"port"`                      // Exposed, and passed as PORT
+	Dockerfile     string `json:"dockerfile"`                // Generated by Generate
+
+	stages string // Everything before EXPOSE, written by the detector
+}
+
+// detectors are tried in order. Backends come before Node so that a package.json used for
+// frontend assets of e.g. a Django app does not take over.
+var detectors = []func(dir string) (*Project, error){
+	detectGo,
+	detectRust,
+	detectJava,
+	detectPython,
+	detectRuby,
+	detectNode,
+	detectStatic,
+}
+
+// Detect works out how to build and run the project in dir. The start command is empty if
+// it could not be worked out.
+func Detect(dir string) (*Project, error) {
+	for _, detect := range detectors {
+		project, err := detect(dir)
+		if err != nil {
+			return nil, err
+		}
+		if project != nil {
+			return project, nil
+		}
+	}
+	return nil, ErrUnsupported
+}
+
+// Generate detects the project in dir and writes its Dockerfile. startCommand replaces the
+// detected start command if not empty.
+func Generate(dir, startCommand string) (*Project, error) {
+	project, err := Detect(dir)
+	if err != nil {
+		return nil, err
+	}
+	if startCommand = strings.TrimSpace(startCommand); startCommand != "" {
+		project.StartCommand = startCommand
+	}
+	if project.StartCommand == "" {
+		return nil, fmt.Errorf("found a %s project but not how to start it, set a start command", project.describe())
+	}
+	project.Dockerfile = project.render()
+	return project, nil
+}
+
+// render appends the runtime configuration to the detector's stages
+func (p *Project) render() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by K0 for a %s project\n", p.describe())
+	b.WriteString(p.stages)
+	fmt.Fprintf(&b, "ENV PORT=%d\n", p.Port)
+	fmt.Fprintf(&b, "EXPOSE %d\n", p.Port)
+	// Through a shell so start commands can use && and environment variables
+	cmd, _ := json.Marshal([]string{"sh", "-c", p.StartCommand})
+	fmt.Fprintf(&b, "CMD %s\n", cmd)
+	return b.String()
+}
+
+func (p *Project) describe() string {
+	parts := []string{p.Language}
+	if p.Framework != "" {
+		parts = append(parts, p.Framework)
+	}
+	if p.PackageManager != "" {
+		parts = append(parts, p.PackageManager)
+	}
+	return strings.Join(parts, "/")
+}
+
+// exists reports whether a file or directory exists in dir
+func exists(dir string, name ...string) bool {
+	_, ok := inDir(dir, name...)
+	return ok
+}
+
+// readFile returns the contents of a regular file in dir, empty if it cannot be read
+func readFile(dir string, name ...string) string {
+	p, ok := inDir(dir, name...)
+	if !ok {
+		return ""
+	}
+	if info, err := os.Stat(p); err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// inDir returns where name in dir really is. Repositories can ship symlinks to anywhere on
+// the server, so one leading outside of dir counts as missing.
+func inDir(dir string, name ...string) (string, bool) {
+	p := filepath.Join(append([]string{dir}, name...)...)
+	info, err := os.Lstat(p)
+	if err != nil {
+		return "", false
+	}
+	if info.Mode()&os.ModeSymlink == 0 && len(name) <= 1 {
+		return p, true
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", false
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return resolved, true
+}
+
+// firstExisting returns the first of names that exists in dir
+func firstExisting(dir string, names ...string) string {
+	for _, name := range names {
+		if exists(dir, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// runtimeCACerts installs CA certificates in a slim Debian runtime stage
+const runtimeCACerts = "RUN apt-get update && apt-get install -y --no-install-recommends ca-certificates && rm -rf /var/lib/apt/lists/*\n"
@@ -0,0 +1,414 @@
+package containerize
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	goVersion  = regexp.MustCompile(`(?m)^go (\d+\.\d+)`)
+	goMain     = regexp.MustCompile(`(?m)^package main\b`)
+	railsGem   = regexp.MustCompile(`(?m)^\s*gem ['"]rails['"]`)
+	sinatraGem = regexp.MustCompile(`(?m)^\s*gem ['"]sinatra['"]`)
+)
+
+// detectGo builds the main package of a Go module into a static binary
+func detectGo(dir string) (*Project, error) {
+	goMod := readFile(dir, "go.mod")
+	if goMod == "" {
+		return nil, nil
+	}
+
+	version := "1"
+	if m := goVersion.FindStringSubmatch(goMod); m != nil {
+		version = m[1]
+	}
+
+	pkg := goMainPackage(dir)
+	stages := fmt.Sprintf(`FROM golang:%s AS build
+WORKDIR /src
+COPY . .
+RUN CGO_ENABLED=0 go build -o /out/app %s
+
+FROM debian:bookworm-slim
+%sCOPY --from=build /out/app /usr/local/bin/app
+`, version, pkg, runtimeCACerts)
+
+	return &Project{
+		Language:     "go",
+		StartCommand: "app",
+		Port:         8080,
+		stages:       stages,
+	}, nil
+}
+
+// goMainPackage finds the package to build: the module root if it is a main package,
+// otherwise the only or first directory under cmd/
+func goMainPackage(dir string) string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		if goMain.MatchString(readFile(dir, filepath.Base(file))) {
+			return "."
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "cmd"))
+	if err != nil {
+		return "."
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return "./cmd/" + entry.Name()
+		}
+	}
+	return "."
+}
+
+// detectRust installs the binary of a Cargo package
+func detectRust(dir string) (*Project, error) {
+	cargo := readFile(dir, "Cargo.toml")
+	if cargo == "" {
+		return nil, nil
+	}
+
+	// The first [[bin]] target, or the package itself
+	name := tomlValue(cargo, "bin", "name")
+	if name == "" {
+		name = tomlValue(cargo, "package", "name")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Cargo.toml has no package or binary name, workspaces need a Dockerfile")
+	}
+
+	locked := ""
+	if exists(dir, "Cargo.lock") {
+		locked = " --locked"
+	}
+	stages := fmt.Sprintf(`FROM rust:1 AS build
+WORKDIR /src
+COPY . .
+RUN cargo install%s --path . --root /out
+
+FROM debian:bookworm-slim
+%sCOPY --from=build /out/bin/ /usr/local/bin/
+`, locked, runtimeCACerts)
+
+	return &Project{
+		Language:       "rust",
+		PackageManager: "cargo",
+		StartCommand:   name,
+		Port:           8080,
+		stages:         stages,
+	}, nil
+}
+
+// tomlValue returns a quoted string value from the first occurrence of a TOML table, enough
+// for Cargo.toml and pyproject.toml without a TOML parser
+func tomlValue(toml, table, key string) string {
+	inTable := false
+	for _, line := range strings.Split(toml, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			if inTable {
+				return ""
+			}
+			name := strings.Trim(line, "[] ")
+			inTable = name == table
+			continue
+		}
+		if !inTable {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.Trim(strings.TrimSpace(v), `"'`)
+		}
+	}
+	return ""
+}
+
+// detectJava packages a Maven or Gradle project into a jar and runs it
+func detectJava(dir string) (*Project, error) {
+	var build, buildImage, jars, manager string
+	switch {
+	case exists(dir, "pom.xml"):
+		manager, buildImage, jars = "maven", "maven:3-eclipse-temurin-21", "target/*.jar"
+		build = "mvn -B -DskipTests package"
+		if exists(dir, "mvnw") {
+			build = "chmod +x mvnw && ./mvnw -B -DskipTests package"
+		}
+	case exists(dir, "build.gradle") || exists(dir, "build.gradle.kts"):
+		manager, buildImage, jars = "gradle", "gradle:8-jdk21", "build/libs/*.jar"
+		build = "gradle build -x test --no-daemon"
+		if exists(dir, "gradlew") {
+			build = "chmod +x gradlew && ./gradlew build -x test --no-daemon"
+		}
+	default:
+		return nil, nil
+	}
+
+	framework := ""
+	buildFile := readFile(dir, "pom.xml") + readFile(dir, "build.gradle") + readFile(dir, "build.gradle.kts")
+	if strings.Contains(buildFile, "spring-boot") {
+		framework = "spring-boot"
+	}
+
+	// Source, javadoc and Spring's plain jars are not runnable
+	stages := fmt.Sprintf(`FROM %s AS build
+WORKDIR /src
+COPY . .
+RUN %s
+RUN cp "$(ls %s | grep -v -e '-sources' -e '-javadoc' -e '-plain' -e '^original-' | head -n 1)" /app.jar
+
+FROM eclipse-temurin:21-jre
+COPY --from=build /app.jar /app/app.jar
+ENV SERVER_PORT=8080
+`, buildImage, build, jars)
+
+	return &Project{
+		Language:       "java",
+		Framework:      framework,
+		PackageManager: manager,
+		StartCommand:   "java -jar /app/app.jar",
+		Port:           8080,
+		stages:         stages,
+	}, nil
+}
+
+// detectPython installs the dependencies of a pip or Poetry project and runs its web
+// framework's server, or its entry script
+func detectPython(dir string) (*Project, error) {
+	pyproject := readFile(dir, "pyproject.toml")
+	requirements := readFile(dir, "requirements.txt")
+	if pyproject == "" && requirements == "" && !exists(dir, "setup.py") && !exists(dir, "manage.py") {
+		return nil, nil
+	}
+
+	project := &Project{Language: "python", Port: 8000}
+	var install string
+	switch {
+	case strings.Contains(pyproject, "[tool.poetry]"):
+		project.PackageManager = "poetry"
+		install = "pip install --no-cache-dir poetry && poetry config virtualenvs.create false && poetry install --no-interaction --no-root"
+	case requirements != "":
+		project.PackageManager = "pip"
+		install = "pip install --no-cache-dir -r requirements.txt"
+	case pyproject != "" || exists(dir, "setup.py"):
+		project.PackageManager = "pip"
+		install = "pip install --no-cache-dir ."
+	}
+
+	deps := strings.ToLower(pyproject + requirements)
+	entry := firstExisting(dir, "main.py", "app.py", "server.py", "run.py", "wsgi.py", "app/main.py", "src/main.py")
+	module := strings.ReplaceAll(strings.TrimSuffix(entry, ".py"), "/", ".")
+	port := fmt.Sprint(project.Port)
+
+	switch {
+	case exists(dir, "manage.py"):
+		project.Framework = "django"
+		project.StartCommand = "python manage.py runserver 0.0.0.0:" + port
+	case strings.Contains(deps, "fastapi") && entry != "":
+		project.Framework = "fastapi"
+		project.StartCommand = "uvicorn " + module + ":app --host 0.0.0.0 --port " + port
+		if !strings.Contains(deps, "uvicorn") {
+			install += " && pip install --no-cache-dir uvicorn"
+		}
+	case strings.Contains(deps, "flask") && entry != "":
+		project.Framework = "flask"
+		project.StartCommand = "flask --app " + module + " run --host 0.0.0.0 --port " + port
+	case strings.Contains(deps, "streamlit") && entry != "":
+		project.Framework = "streamlit"
+		project.StartCommand = "streamlit run " + entry + " --server.address 0.0.0.0 --server.port " + port
+	case entry != "":
+		project.StartCommand = "python " + entry
+	}
+
+	run := ""
+	if install != "" {
+		run = "RUN " + install + "\n"
+	}
+	project.stages = fmt.Sprintf(`FROM python:3.12-slim
+WORKDIR /app
+ENV PYTHONUNBUFFERED=1 PYTHONDONTWRITEBYTECODE=1
+COPY . .
+%s`, run)
+	return project, nil
+}
+
+// detectRuby installs gems with Bundler and runs Rails, a Rack app or an entry script
+func detectRuby(dir string) (*Project, error) {
+	gemfile := readFile(dir, "Gemfile")
+	if gemfile == "" {
+		return nil, nil
+	}
+
+	project := &Project{Language: "ruby", PackageManager: "bundler", Port: 3000}
+	port := fmt.Sprint(project.Port)
+	switch {
+	case railsGem.MatchString(gemfile):
+		project.Framework = "rails"
+		project.StartCommand = "bundle exec rails server -b 0.0.0.0 -p " + port
+	case exists(dir, "config.ru"):
+		project.Framework = "rack"
+		project.StartCommand = "bundle exec rackup -o 0.0.0.0 -p " + port
+	default:
+		entry := firstExisting(dir, "app.rb", "main.rb", "server.rb")
+		if entry == "" {
+			break
+		}
+		project.StartCommand = "bundle exec ruby " + entry
+		if sinatraGem.MatchString(gemfile) {
+			project.Framework = "sinatra"
+			project.StartCommand += " -o 0.0.0.0 -p " + port
+		}
+	}
+
+	project.stages = `FROM ruby:3.3
+WORKDIR /app
+COPY . .
+RUN bundle install
+`
+	return project, nil
+}
+
+// packageJSON is the part of package.json the Node detector reads
+type packageJSON struct {
+	Main            string            `json:"main"`
+	Scripts         map[string]string `json:"scripts"`
+	Dependencies    map[string]string `json:"dependencies"`
+	DevDependencies map[string]string `json:"devDependencies"`
+	PackageManager  string            `json:"packageManager"`
+}
+
+func (p packageJSON) dependsOn(name string) bool {
+	_, dep := p.Dependencies[name]
+	_, dev := p.DevDependencies[name]
+	return dep || dev
+}
+
+// detectNode installs with npm, pnpm or Yarn and runs the start script. Single page apps
+// without a server are built and served as a static site.
+func detectNode(dir string) (*Project, error) {
+	data := readFile(dir, "package.json")
+	if data == "" {
+		return nil, nil
+	}
+	var pkg packageJSON
+	if err := json.Unmarshal([]byte(data), &pkg); err != nil {
+		return nil, fmt.Errorf("failed to parse package.json: %w", err)
+	}
+
+	project := &Project{Language: "node", Port: 3000}
+	var install, run string
+	switch {
+	case exists(dir, "pnpm-lock.yaml") || strings.HasPrefix(pkg.PackageManager, "pnpm@"):
+		project.PackageManager = "pnpm"
+		install, run = "corepack enable && pnpm install", "pnpm run "
+		if exists(dir, "pnpm-lock.yaml") {
+			install += " --frozen-lockfile"
+		}
+	case exists(dir, "yarn.lock") || strings.HasPrefix(pkg.PackageManager, "yarn@"):
+		project.PackageManager = "yarn"
+		install, run = "corepack enable && yarn install", "yarn run "
+	default:
+		project.PackageManager = "npm"
+		install, run = "npm install", "npm run "
+		if exists(dir, "package-lock.json") || exists(dir, "npm-shrinkwrap.json") {
+			install = "npm ci"
+		}
+	}
+
+	_, hasBuild := pkg.Scripts["build"]
+	_, hasStart := pkg.Scripts["start"]
+	build := ""
+	if hasBuild {
+		build = "RUN " + run + "build\n"
+	}
+	// Installed tools such as corepack's package managers stay in the image
+	base := fmt.Sprintf(`FROM node:22-slim AS build
+WORKDIR /app
+ENV COREPACK_HOME=/usr/local/share/corepack
+COPY . .
+RUN %s
+%s`, install, build)
+
+	// Single page apps only need their build output served
+	staticOutput := ""
+	switch {
+	case pkg.dependsOn("react-scripts") && hasBuild:
+		project.Framework, staticOutput = "create-react-app", "build"
+	case pkg.dependsOn("vite") && hasBuild && !hasStart:
+		project.Framework, staticOutput = "vite", "dist"
+	}
+	if staticOutput != "" {
+		project.Port = 8080
+		project.StartCommand = staticServer(project.Port)
+		project.stages = base + "\n" + staticStage("--from=build /app/"+staticOutput)
+		return project, nil
+	}
+
+	switch {
+	case pkg.dependsOn("next"):
+		project.Framework = "next"
+	case pkg.dependsOn("nuxt"):
+		project.Framework = "nuxt"
+	case pkg.dependsOn("@nestjs/core"):
+		project.Framework = "nest"
+	case pkg.dependsOn("express"):
+		project.Framework = "express"
+	}
+
+	switch {
+	case hasStart:
+		project.StartCommand = run + "start"
+	case pkg.Main != "" && exists(dir, pkg.Main):
+		project.StartCommand = "node " + pkg.Main
+	case exists(dir, "index.js"):
+		project.StartCommand = "node index.js"
+	case exists(dir, "server.js"):
+		project.StartCommand = "node server.js"
+	default:
+		if _, hasDev := pkg.Scripts["dev"]; hasDev {
+			project.StartCommand = run + "dev"
+		}
+	}
+
+	project.stages = base + "ENV HOST=0.0.0.0 HOSTNAME=0.0.0.0\n"
+	return project, nil
+}
+
+// detectStatic serves a site of plain HTML files, from the root or public/
+func detectStatic(dir string) (*Project, error) {
+	root := ""
+	switch {
+	case exists(dir, "index.html"):
+		root = "."
+	case exists(dir, "public", "index.html"):
+		root = "public"
+	default:
+		return nil, nil
+	}
+
+	return &Project{
+		Language:     "static",
+		StartCommand: staticServer(8080),
+		Port:         8080,
+		stages:       staticStage(root),
+	}, nil
+}
+
+// staticStage copies a site from source, a path of the context or --from=stage path
+func staticStage(source string) string {
+	return fmt.Sprintf("FROM busybox:1.36\nCOPY %s /site\n", source)
+}
+
+func staticServer(port int) string {
+	return fmt.Sprintf("httpd -f -v -p %d -h /site", port)
+}
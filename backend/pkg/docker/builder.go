@@ -0,0 +1,429 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-units"
+)
+
+// BuildRequest is one image to build from a build context
+type BuildRequest struct {
+	Context    io.Reader // Tar archive of the build context
+	Dockerfile string    // Path of the Dockerfile within the context
+	Tag        string
+	Target     string
+	BuildArgs  map[string]string
+	Labels     map[string]string
+	Resources  ResourceProfile                       // Limits of RUN steps, where the builder supports them
+	OnMessage  func(message jsonmessage.JSONMessage) // Build output, may be nil
+}
+
+// Builder builds images into the daemon containers are started by. The daemon's own builder
+// runs build steps with the daemon's privileges, the rootless builders don't.
+type Builder interface {
+	Name() string
+	Build(ctx context.Context, cli *client.Client, req BuildRequest) error
+	Prune(ctx context.Context, cli *client.Client, keepBytes int64) (uint64, error) // Trims the builder's cache
+}
+
+// Builder names, see BuilderFromEnv
+const (
+	BuilderDaemon   = "daemon"
+	BuilderBuildKit = "buildkit"
+	BuilderBuildah  = "buildah"
+)
+
+// BuilderFromEnv picks the builder from the environment:
+//
+//	BUILDER=daemon                    build with the Docker daemon's ImageBuild, the default
+//	BUILDER=buildkit                  build with buildctl against a rootless buildkitd
+//	BUILDKIT_HOST=unix:///...         address of buildkitd, buildctl's default if empty
+//	BUILDKIT_LIMITS_ENFORCED=true     buildkitd runs under CPU and memory limits of its own
+//	BUILDER=buildah                   build with buildah as the server's (unprivileged) user
+//	BUILDAH_ISOLATION=rootless        how buildah isolates RUN steps, rootless or oci
+//
+// Builders that cannot keep build steps away from the server are refused: buildah's chroot
+// isolation runs them on the host, and buildctl cannot limit a single build.
+func BuilderFromEnv() (Builder, error) {
+	switch name := os.Getenv("BUILDER"); name {
+	case "", BuilderDaemon:
+		return daemonBuilder{}, nil
+
+	case BuilderBuildKit:
+		if _, err := exec.LookPath("buildctl"); err != nil {
+			return nil, fmt.Errorf("failed to find buildctl for BUILDER=buildkit: %w", err)
+		}
+		// buildctl has no per-build limits, RUN steps are only limited if buildkitd itself is
+		if enforced, _ := strconv.ParseBool(os.Getenv("BUILDKIT_LIMITS_ENFORCED")); !enforced {
+			return nil, fmt.Errorf("BUILDER=buildkit cannot apply resource profiles to builds, run buildkitd with CPU and memory limits and set BUILDKIT_LIMITS_ENFORCED=true")
+		}
+		return buildkitBuilder{Addr: os.Getenv("BUILDKIT_HOST")}, nil
+
+	case BuilderBuildah:
+		if _, err := exec.LookPath("buildah"); err != nil {
+			return nil, fmt.Errorf("failed to find buildah for BUILDER=buildah: %w", err)
+		}
+		isolation := os.Getenv("BUILDAH_ISOLATION")
+		if isolation == "" {
+			isolation = "rootless"
+		}
+		switch isolation {
+		case "rootless":
+			if os.Geteuid() == 0 {
+				return nil, fmt.Errorf("BUILDAH_ISOLATION=rootless needs the server to run as an unprivileged user, or set BUILDAH_ISOLATION=oci")
+			}
+		case "oci":
+		case "chroot":
+			// Build steps would share the server's user, network and environment
+			return nil, fmt.Errorf("BUILDAH_ISOLATION=chroot runs build steps on the server itself, use rootless or oci")
+		default:
+			return nil, fmt.Errorf("invalid BUILDAH_ISOLATION %q, expected rootless or oci", isolation)
+		}
+		return buildahBuilder{Isolation: isolation}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown BUILDER %q, expected %s, %s or %s", name, BuilderDaemon, BuilderBuildKit, BuilderBuildah)
+	}
+}
+
+// daemonBuilder builds with the daemon's ImageBuild
+type daemonBuilder struct{}
+
+func (daemonBuilder) Name() string { return BuilderDaemon }
+
+func (daemonBuilder) Build(ctx context.Context, cli *client.Client, req BuildRequest) error {
+	limits := req.Resources.hostResources()
+	response, err := cli.ImageBuild(ctx, req.Context, types.ImageBuildOptions{
+		Tags:       []string{req.Tag},
+		Dockerfile: req.Dockerfile,
+		Target:     req.Target,
+		BuildArgs:  buildArgs(req.BuildArgs),
+		Labels:     req.Labels,
+		Remove:     true,
+		// RUN steps are limited like the container itself
+		CPUPeriod:  limits.CPUPeriod,
+		CPUQuota:   limits.CPUQuota,
+		Memory:     limits.Memory,
+		MemorySwap: limits.MemorySwap,
+	})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// The build only fails through an error message in its output stream
+	return decodeBuildOutput(response.Body, req.OnMessage)
+}
+
+func (daemonBuilder) Prune(ctx context.Context, cli *client.Client, keepBytes int64) (uint64, error) {
+	report, err := cli.BuildCachePrune(ctx, types.BuildCachePruneOptions{KeepStorage: keepBytes})
+	if err != nil {
+		return 0, err
+	}
+	return report.SpaceReclaimed, nil
+}
+
+// buildkitBuilder builds with buildctl against a buildkitd running rootless, e.g. the
+// moby/buildkit:rootless image, and loads the result into the daemon. buildkitd enforces its
+// own limits on build steps, Resources are not applied per build, see BuilderFromEnv.
+type buildkitBuilder struct {
+	Addr string
+}
+
+func (buildkitBuilder) Name() string { return BuilderBuildKit }
+
+func (b buildkitBuilder) command(ctx context.Context, args ...string) *exec.Cmd {
+	if b.Addr != "" {
+		args = append([]string{"--addr", b.Addr}, args...)
+	}
+	return exec.CommandContext(ctx, "buildctl", args...)
+}
+
+func (b buildkitBuilder) Build(ctx context.Context, cli *client.Client, req BuildRequest) error {
+	dir, err := extractContext(req.Context)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{
+		"build",
+		"--frontend", "dockerfile.v0",
+		"--local", "context=" + dir,
+		"--local", "dockerfile=" + dir,
+		"--opt", "filename=" + req.Dockerfile,
+		"--output", "type=docker,name=" + req.Tag,
+		"--progress", "plain",
+	}
+	if req.Target != "" {
+		args = append(args, "--opt", "target="+req.Target)
+	}
+	for _, arg := range sortedPairs(req.BuildArgs) {
+		args = append(args, "--opt", "build-arg:"+arg)
+	}
+	for _, label := range sortedPairs(req.Labels) {
+		args = append(args, "--opt", "label:"+label)
+	}
+	cmd := b.command(ctx, args...)
+
+	// The image comes out on stdout as a docker archive, progress on stderr
+	image, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to run buildctl: %w", err)
+	}
+	progress := newProgressWriter(req.OnMessage)
+	cmd.Stderr = progress
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run buildctl: %w", err)
+	}
+
+	loadErr := loadImage(ctx, cli, image)
+	io.Copy(io.Discard, image) // Lets buildctl exit if the load stopped early
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("buildctl failed: %w%s", err, progress.lastLine())
+	}
+	progress.flush()
+	return loadErr
+}
+
+func (b buildkitBuilder) Prune(ctx context.Context, cli *client.Client, keepBytes int64) (uint64, error) {
+	output, err := b.command(ctx, "prune", "--keep-storage", strconv.FormatInt(keepBytes>>20, 10)).Output()
+	if err != nil {
+		return 0, fmt.Errorf("buildctl prune failed: %w", err)
+	}
+
+	// The last line is "Total:" and the space reclaimed
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	total, ok := strings.CutPrefix(lines[len(lines)-1], "Total:")
+	if !ok {
+		return 0, nil
+	}
+	reclaimed, err := units.FromHumanSize(strings.TrimSpace(total))
+	if err != nil {
+		return 0, nil
+	}
+	return uint64(reclaimed), nil
+}
+
+// buildahBuilder builds with buildah as the server's user and loads the result into the
+// daemon. RUN steps get namespaces of their own, their own network included. Nothing is kept
+// in buildah's storage, the daemon has every image built.
+type buildahBuilder struct {
+	Isolation string
+}
+
+func (buildahBuilder) Name() string { return BuilderBuildah }
+
+func (b buildahBuilder) Build(ctx context.Context, cli *client.Client, req BuildRequest) error {
+	dir, err := extractContext(req.Context)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{
+		"build",
+		"--isolation", b.Isolation,
+		"--network", "private",
+		"--file", filepath.Join(dir, filepath.FromSlash(req.Dockerfile)),
+		"--tag", req.Tag,
+	}
+	if req.Target != "" {
+		args = append(args, "--target", req.Target)
+	}
+	for _, arg := range sortedPairs(req.BuildArgs) {
+		args = append(args, "--build-arg", arg)
+	}
+	for _, label := range sortedPairs(req.Labels) {
+		args = append(args, "--label", label)
+	}
+	limits := req.Resources.hostResources()
+	if limits.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(limits.Memory, 10), "--memory-swap", strconv.FormatInt(limits.MemorySwap, 10))
+	}
+	if limits.CPUQuota > 0 {
+		args = append(args, "--cpu-period", strconv.FormatInt(limits.CPUPeriod, 10), "--cpu-quota", strconv.FormatInt(limits.CPUQuota, 10))
+	}
+	args = append(args, dir)
+
+	progress := newProgressWriter(req.OnMessage)
+	cmd := exec.CommandContext(ctx, "buildah", args...)
+	cmd.Stdout, cmd.Stderr = progress, progress
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("buildah failed: %w%s", err, progress.lastLine())
+	}
+	progress.flush()
+	defer exec.Command("buildah", "rmi", "--force", req.Tag).Run()
+
+	exportDir, err := os.MkdirTemp("", "k0-image-*")
+	if err != nil {
+		return fmt.Errorf("failed to create image export directory: %w", err)
+	}
+	defer os.RemoveAll(exportDir)
+	archive := filepath.Join(exportDir, "image.tar")
+	output, err := exec.CommandContext(ctx, "buildah", "push", "--quiet", req.Tag, "docker-archive:"+archive+":"+req.Tag).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to export image from buildah: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return fmt.Errorf("failed to open exported image: %w", err)
+	}
+	defer f.Close()
+	return loadImage(ctx, cli, f)
+}
+
+func (buildahBuilder) Prune(ctx context.Context, cli *client.Client, keepBytes int64) (uint64, error) {
+	return 0, nil
+}
+
+// loadImage loads a docker archive into the daemon
+func loadImage(ctx context.Context, cli *client.Client, archive io.Reader) error {
+	response, err := cli.ImageLoad(ctx, archive, client.ImageLoadWithQuiet(true))
+	if err != nil {
+		return fmt.Errorf("failed to load image: %w", err)
+	}
+	defer response.Body.Close()
+	if err := decodeBuildOutput(response.Body, func(jsonmessage.JSONMessage) {}); err != nil {
+		return fmt.Errorf("failed to load image: %w", err)
+	}
+	return nil
+}
+
+// extractContext unpacks a build context archive into a new temporary directory. Entries
+// escaping it, directly or through a symlink of the archive, are refused.
+func extractContext(archive io.Reader) (string, error) {
+	dir, err := os.MkdirTemp("", "k0-build-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create build context directory: %w", err)
+	}
+	if err := extractTar(archive, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to extract build context: %w", err)
+	}
+	// Builders reading the archive to its end is what tells the archiver it was sent
+	io.Copy(io.Discard, archive)
+	return dir, nil
+}
+
+func extractTar(archive io.Reader, dir string) error {
+	symlinks := make(map[string]bool)
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(header.Name)
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return fmt.Errorf("%s is outside of the build context", header.Name)
+		}
+		for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+			if symlinks[parent] {
+				return fmt.Errorf("%s is behind the symlink %s", header.Name, parent)
+			}
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+			symlinks[name] = true
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sortedPairs returns key=value pairs sorted by key
+func sortedPairs(values map[string]string) []string {
+	pairs := make([]string, 0, len(values))
+	for key, value := range values {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// progressWriter passes a builder's output on line by line, like ImageBuild's stream messages
+type progressWriter struct {
+	onMessage func(jsonmessage.JSONMessage)
+	partial   []byte
+	last      string
+}
+
+func newProgressWriter(onMessage func(jsonmessage.JSONMessage)) *progressWriter {
+	if onMessage == nil {
+		onMessage = func(message jsonmessage.JSONMessage) { fmt.Print(message.Stream) }
+	}
+	return &progressWriter{onMessage: onMessage}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(w.partial[:i])
+		w.partial = w.partial[i+1:]
+		if strings.TrimSpace(line) != "" {
+			w.last = line
+		}
+		w.onMessage(jsonmessage.JSONMessage{Stream: line + "\n"})
+	}
+}
+
+// flush passes on output that did not end with a newline
+func (w *progressWriter) flush() {
+	if len(w.partial) > 0 {
+		w.Write([]byte("\n"))
+	}
+}
+
+// lastLine returns the last line written, which usually says why a build failed
+func (w *progressWriter) lastLine() string {
+	w.flush()
+	if w.last == "" {
+		return ""
+	}
+	return ": " + w.last
+}
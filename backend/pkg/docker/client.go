@@ -2,54 +2,69 @@ package docker
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
-	"sync"
-
-	"github.com/ICBasecamp/K0/backend/internal/github"
-	"github.com/ICBasecamp/K0/backend/pkg/ec2"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
-	"github.com/docker/docker/api/types"
+	"github.com/ICBasecamp/K0/backend/internal/git"
+	"github.com/ICBasecamp/K0/backend/pkg/containerize"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
 )
 
 type DockerClient struct {
-	cli        *client.Client
-	ctx        context.Context
-	ec2Client  *ec2.EC2Client
-	instanceID string
-	publicIP   string
+	cli      *client.Client
+	ctx      context.Context
+	publicIP string        // Address of the EC2 host the daemon runs on, empty for the local daemon
+	sandbox  SandboxConfig // Hardening applied to every container started by StartContainer
+	builds   buildLocks    // One build per image at a time, see buildCached
+	builder  Builder       // Builds images into the daemon, see BuilderFromEnv
 }
 
 type TerminalResponse struct {
 	ID     string
 	Result io.ReadCloser
+	Ports  []PortMapping // Exposed ports of the image and the host ports they are published on
 }
 
-func getAmiIdFromSSM(ctx context.Context, ssmClient *ssm.Client) (string, error) {
-	param, err := ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
-		Name: aws.String("/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-x86_64-gp2"),
-	})
-	if err != nil {
-		return "", err
+// CreateRuntime connects to the local Docker daemon when DOCKER_MODE is local, and to the
+// pool of EC2 Docker hosts otherwise, see CreatePooledClient
+func CreateRuntime() (Runtime, error) {
+	if os.Getenv("DOCKER_MODE") == "local" {
+		return CreateDockerClient()
 	}
-	return *param.Parameter.Value, nil
+	return CreatePooledClient()
 }
 
+// CreateDockerClient connects to the local Docker daemon
 func CreateDockerClient() (*DockerClient, error) {
-	// Check if we're in local development mode
-	dockerMode := os.Getenv("DOCKER_MODE")
-	if dockerMode == "local" {
-		return createLocalDockerClient()
+	sandbox, err := SandboxFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	builder, err := BuilderFromEnv()
+	if err != nil {
+		return nil, err
 	}
-	return createEC2DockerClient()
+
+	dc, err := createLocalDockerClient()
+	if err != nil {
+		return nil, err
+	}
+	dc.sandbox = sandbox
+	dc.builder = builder
+	fmt.Printf("Building images with the %s builder\n", builder.Name())
+	return dc, nil
 }
 
 // createLocalDockerClient creates a Docker client that connects to local Docker daemon
@@ -75,132 +90,120 @@ func createLocalDockerClient() (*DockerClient, error) {
 	fmt.Println("✅ Successfully connected to local Docker daemon!")
 
 	return &DockerClient{
-		cli:        cli,
-		ctx:        context.Background(),
-		ec2Client:  nil, // No EC2 client needed for local mode
-		instanceID: "",  // No instance ID for local mode
-		publicIP:   "",  // No public IP for local mode
+		cli: cli,
+		ctx: context.Background(),
 	}, nil
 }
 
-// createEC2DockerClient creates a Docker client that connects to EC2 instance (production)
-func createEC2DockerClient() (*DockerClient, error) {
-	fmt.Println("☁️ Using EC2 Docker daemon for production...")
-
-	ec2Client, err := ec2.NewEC2Client()
+// createHostDockerClient creates a Docker client for the daemon of an EC2 host, listening on port 2375
+func createHostDockerClient(address string) (*DockerClient, error) {
+	cli, err := client.NewClientWithOpts(
+		client.FromEnv,
+		client.WithHost(fmt.Sprintf("tcp://%s:2375", address)),
+		client.WithAPIVersionNegotiation(),
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create EC2 client: %w", err)
+		return nil, fmt.Errorf("failed to create Docker client for %s: %w", address, err)
 	}
+	return &DockerClient{
+		cli:      cli,
+		ctx:      context.Background(),
+		publicIP: address,
+	}, nil
+}
 
-	// Dynamically fetch the latest Amazon Linux 2 AMI ID for the current region
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config for SSM: %w", err)
-	}
-	ssmClient := ssm.NewFromConfig(cfg)
-	amiID, err := getAmiIdFromSSM(context.Background(), ssmClient)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get latest Amazon Linux 2 AMI ID: %w", err)
-	}
+// StartOptions configures how a container is started
+type StartOptions struct {
+	Pull      bool            // Pull the image from its registry first
+	Resources ResourceProfile // Limits of the container, unlimited if zero
+	RoomID    string          // Puts the container on the room's network, the default bridge if empty
+	Egress    EgressPolicy    // What the container may reach outside of its room, see ParseEgressPolicy
+}
 
-	// Create instance and wait for it to be ready
-	instanceId, err := ec2Client.CreateInstance(
-		"Docker-Sandbox",
-		amiID,
-		"t3.micro",
-		"subnet-0988a47a3010e4968", // your subnet ID
-		"sg-042b1651131eb71d2",     // your security group ID
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create instance: %w", err)
+// StartContainer creates and starts a container from imageName and follows its logs
+func (dc *DockerClient) StartContainer(imageName string, opts StartOptions) (TerminalResponse, error) {
+	if opts.Pull {
+		out, err := dc.cli.ImagePull(dc.ctx, imageName, image.PullOptions{})
+		if err != nil {
+			return TerminalResponse{}, fmt.Errorf("failed to pull image: %w", err)
+		}
+		io.Copy(io.Discard, out)
+		defer out.Close()
 	}
 
-	// Get instance details to get the public IP
-	describeResult, err := ec2Client.DescribeInstance(instanceId)
+	// Publish whatever the image EXPOSEs so the app can be reached through the preview proxy
+	exposedPorts, err := dc.ExposedPorts(imageName)
 	if err != nil {
-		ec2Client.TerminateInstance(instanceId)
-		return nil, fmt.Errorf("failed to get instance IP: %w", err)
+		return TerminalResponse{}, err
 	}
-	publicIP := *describeResult.Reservations[0].Instances[0].PublicIpAddress
 
-	// Get system logs to check Docker status
-	logs, err := ec2Client.GetInstanceLogs(instanceId)
+	// Candidate code is untrusted, refuse images the sandbox cannot contain
+	imageUser, err := dc.sandboxImage(imageName)
 	if err != nil {
-		fmt.Printf("Warning: Failed to get system logs: %v\n", err)
-	} else {
-		fmt.Println("Checking system logs for Docker status...")
-		fmt.Println(logs)
+		return TerminalResponse{}, err
 	}
 
-	fmt.Printf("Attempting to connect to Docker daemon at %s:2375...\n", publicIP)
-
-	// Create Docker client that connects to remote instance
-	cli, err := client.NewClientWithOpts(
-		client.FromEnv,
-		client.WithHost(fmt.Sprintf("tcp://%s:2375", publicIP)),
-		client.WithAPIVersionNegotiation(),
-	)
-	if err != nil {
-		ec2Client.TerminateInstance(instanceId)
-		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	config := &container.Config{
+		Image:  imageName,
+		Labels: map[string]string{resourceProfileLabel: opts.Resources.Name},
 	}
-
-	// Try to ping the Docker daemon
-	_, err = cli.Ping(context.Background())
-	if err != nil {
-		cli.Close()
-		ec2Client.TerminateInstance(instanceId)
-		return nil, fmt.Errorf("failed to connect to Docker daemon: %w", err)
+	hostConfig := &container.HostConfig{
+		PortBindings: dc.portBindings(exposedPorts),
+		Resources:    opts.Resources.hostResources(),
+		StorageOpt:   opts.Resources.storageOpt(),
 	}
+	dc.sandbox.apply(config, hostConfig, imageUser)
 
-	fmt.Println("Successfully connected to Docker daemon!")
-
-	return &DockerClient{
-		cli:        cli,
-		ctx:        context.Background(),
-		ec2Client:  ec2Client,
-		instanceID: instanceId,
-		publicIP:   publicIP,
-	}, nil
-}
-
-func (dc *DockerClient) StartContainer(imageName string, pull bool) (TerminalResponse, error) {
-	if pull {
-		out, err := dc.cli.ImagePull(dc.ctx, imageName, image.PullOptions{})
+	if opts.RoomID != "" {
+		policy, err := ParseEgressPolicy(string(opts.Egress))
 		if err != nil {
-			return TerminalResponse{}, fmt.Errorf("failed to pull image: %w", err)
+			return TerminalResponse{}, err
 		}
-		io.Copy(io.Discard, out)
-		defer out.Close()
+		networkName, env, err := dc.roomNetwork(opts.RoomID, policy)
+		if err != nil {
+			return TerminalResponse{}, err
+		}
+		hostConfig.NetworkMode = container.NetworkMode(networkName)
+		config.Env = append(config.Env, env...)
+		config.Labels[roomLabel] = opts.RoomID
+		config.Labels[egressLabel] = string(policy)
 	}
 
-	resp, err := dc.cli.ContainerCreate(dc.ctx, &container.Config{
-		Image: imageName,
-	}, nil, nil, nil, "")
+	resp, err := dc.cli.ContainerCreate(dc.ctx, config, hostConfig, nil, nil, "")
 	if err != nil {
 		return TerminalResponse{}, fmt.Errorf("failed to create container: %w", err)
 	}
 
 	if err := dc.cli.ContainerStart(dc.ctx, resp.ID, container.StartOptions{}); err != nil {
+		dc.RemoveContainer(resp.ID)
 		return TerminalResponse{}, fmt.Errorf("failed to start container: %w", err)
 	}
 
-	options := container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Follow:     true,
+	ports, err := dc.publishedPorts(resp.ID, exposedPorts)
+	if err != nil {
+		dc.RemoveContainer(resp.ID)
+		return TerminalResponse{}, err
 	}
 
-	logs, err := dc.cli.ContainerLogs(dc.ctx, resp.ID, options)
+	logs, err := dc.FollowLogs(resp.ID, time.Time{})
 	if err != nil {
-		return TerminalResponse{}, fmt.Errorf("failed to get container logs: %w", err)
+		dc.RemoveContainer(resp.ID)
+		return TerminalResponse{}, err
 	}
 	return TerminalResponse{
 		ID:     resp.ID,
 		Result: logs,
+		Ports:  ports,
 	}, nil
 }
 
+// CopyLogs demultiplexes the log stream of a container started without a TTY, where
+// Docker prefixes every frame with a header naming its stream, into stdout and stderr
+func CopyLogs(stdout, stderr io.Writer, logs io.Reader) error {
+	_, err := stdcopy.StdCopy(stdout, stderr, logs)
+	return err
+}
+
 // Removed unused debugging functions: PrintTerminalResponse and ListImages
 
 // StopContainer stops a running container
@@ -208,64 +211,309 @@ func (dc *DockerClient) StopContainer(id string) error {
 	return dc.cli.ContainerStop(dc.ctx, id, container.StopOptions{})
 }
 
-// RemoveContainer removes a container
+// RemoveContainer removes a container and its anonymous volumes, stopping it first if it is still running
 func (dc *DockerClient) RemoveContainer(id string) error {
-	return dc.cli.ContainerRemove(dc.ctx, id, container.RemoveOptions{})
+	return dc.cli.ContainerRemove(dc.ctx, id, container.RemoveOptions{Force: true, RemoveVolumes: true})
 }
 
 // Removed BuildAndStartContainerFromGitHub - only used by deprecated container manager
 
+// Cleanup closes the client. EC2 hosts are left running for the pool to reuse.
 func (dc *DockerClient) Cleanup() error {
-	// Only cleanup EC2 instance if we're using EC2 mode
-	if dc.instanceID != "" && dc.ec2Client != nil {
-		fmt.Println("🧹 Cleaning up EC2 instance...")
-		return dc.ec2Client.TerminateInstance(dc.instanceID)
-	}
-
-	// For local mode, just close the Docker client
 	if dc.cli != nil {
-		fmt.Println("🧹 Closing local Docker client...")
+		fmt.Println("🧹 Closing Docker client...")
 		return dc.cli.Close()
 	}
-
 	return nil
 }
 
-// BuildAndStartContainerFromGitHubWS builds a Docker container from a GitHub repository and starts/returns a websocket connection to the container output
-func (dc *DockerClient) BuildAndStartContainerFromGitHubWS(imageName string, githubURL string, ContainerStreams *sync.Map) (TerminalResponse, error) {
+// BuildPhase is a step of turning a repository into a running container
+type BuildPhase string
+
+const (
+	PhaseCloning  BuildPhase = "cloning"
+	PhaseBuilding BuildPhase = "building"
+)
+
+// BuildOptions configures how a repository is cloned and built
+type BuildOptions struct {
+	OnPhase      func(phase BuildPhase)                // Called when a phase starts, may be nil
+	OnMessage    func(message jsonmessage.JSONMessage) // Called for every decoded ImageBuild message, may be nil
+	Resources    ResourceProfile                       // Limits of the build containers, unlimited if zero
+	Ref          string                                // Branch, tag, commit SHA or pull/N to build, the default branch if empty
+	Credential   *git.Credential                       // Only used to clone, may be nil for public repositories
+	Dockerfile   string                                // Relative to the repository root, picked by FindDockerfile if empty
+	ContextDir   string                                // Relative to the repository root, the Dockerfile's directory if empty
+	Target       string                                // Stage to build, the last one if empty
+	BuildArgs    map[string]string                     // Values for ARG instructions
+	Generate     bool                                  // Generate a Dockerfile even if the repository has one
+	StartCommand string                                // Replaces the start command of a generated Dockerfile
+	ComposeFile  string                                // Compose file to run, found at the root if no Dockerfile is chosen either
+	RoomID       string                                // Room the image is for, pooled hosts build on the room's host
+}
+
+// BuildResult describes what was built
+type BuildResult struct {
+	Image      string // Image to start, empty for compose projects whose services each have one
+	Cached     bool   // The image existed already and was not rebuilt
+	Commit     string // SHA of the commit the image was built from
+	Dockerfile string // Dockerfile used, relative to the repository root
+	ContextDir string // Build context used, relative to the repository root
+	Context    git.ContextStats
+	Generated  *containerize.Project // What the Dockerfile was generated for, nil if the repository had one
+	Compose    *ComposeProject       // Set instead of Dockerfile for compose projects, see StartStack
+}
+
+// buildSource is what a build is made of, paths are relative to the repository root
+type buildSource struct {
+	Dockerfile string
+	ContextDir string
+	InContext  string                // Path of the Dockerfile within the context
+	Generated  *containerize.Project // Set if the Dockerfile was generated
+}
+
+// generatedDockerfile is where a generated Dockerfile is written in the build context
+const generatedDockerfile = "Dockerfile.k0"
+
+// resolveDockerfile works out which Dockerfile to build with which context. Repositories
+// without a Dockerfile get one generated in the context, the repository root by default.
+func resolveDockerfile(gitClient *git.GitClient, repoPath string, opts BuildOptions) (buildSource, error) {
+	var source buildSource
+	var err error
+	switch {
+	case opts.Dockerfile != "":
+		if source.Dockerfile, err = git.CleanRepoPath(opts.Dockerfile); err != nil {
+			return source, err
+		}
+		resolved, err := git.ResolveRepoPath(repoPath, source.Dockerfile)
+		if err != nil {
+			return source, fmt.Errorf("Dockerfile %s not found in the repository: %w", source.Dockerfile, err)
+		}
+		info, err := os.Stat(resolved)
+		if err != nil || !info.Mode().IsRegular() {
+			return source, fmt.Errorf("Dockerfile %s not found in the repository", source.Dockerfile)
+		}
+
+	case !opts.Generate:
+		found, err := gitClient.FindDockerfile(repoPath)
+		if errors.Is(err, git.ErrNoDockerfile) {
+			return generateDockerfile(repoPath, opts)
+		}
+		if err != nil {
+			return source, err
+		}
+		rel, err := filepath.Rel(repoPath, found)
+		if err != nil {
+			return source, err
+		}
+		source.Dockerfile = filepath.ToSlash(rel)
+
+	default:
+		return generateDockerfile(repoPath, opts)
+	}
+
+	source.ContextDir = path.Dir(source.Dockerfile)
+	if opts.ContextDir != "" {
+		if source.ContextDir, err = git.CleanRepoPath(opts.ContextDir); err != nil {
+			return source, err
+		}
+	}
+
+	// The Dockerfile is sent as part of the context
+	source.InContext = source.Dockerfile
+	if source.ContextDir != "." {
+		source.InContext = strings.TrimPrefix(source.Dockerfile, source.ContextDir+"/")
+		if source.InContext == source.Dockerfile {
+			return source, fmt.Errorf("Dockerfile %s is outside of the build context %s", source.Dockerfile, source.ContextDir)
+		}
+	}
+	return source, nil
+}
+
+// generateDockerfile detects the project in the build context and writes a Dockerfile for it there
+func generateDockerfile(repoPath string, opts BuildOptions) (buildSource, error) {
+	source := buildSource{ContextDir: ".", InContext: generatedDockerfile}
+	if opts.ContextDir != "" {
+		var err error
+		if source.ContextDir, err = git.CleanRepoPath(opts.ContextDir); err != nil {
+			return source, err
+		}
+	}
+	source.Dockerfile = path.Join(source.ContextDir, generatedDockerfile)
+
+	contextPath, err := git.ResolveRepoPath(repoPath, source.ContextDir)
+	if err != nil {
+		return source, fmt.Errorf("build context %s is not a directory in the repository: %w", source.ContextDir, err)
+	}
+	project, err := containerize.Generate(contextPath, opts.StartCommand)
+	if err != nil {
+		return source, err
+	}
+	if err := writeGeneratedDockerfile(filepath.Join(contextPath, generatedDockerfile), project.Dockerfile); err != nil {
+		return source, fmt.Errorf("failed to write generated Dockerfile: %w", err)
+	}
+	source.Generated = project
+	return source, nil
+}
+
+// writeGeneratedDockerfile replaces whatever the repository has at file. It may be a symlink
+// to anywhere on the server, so it is removed rather than written through, and the new file
+// is created exclusively, which never follows a symlink.
+func writeGeneratedDockerfile(file, dockerfile string) error {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(dockerfile); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (o BuildOptions) phase(phase BuildPhase) {
+	if o.OnPhase != nil {
+		o.OnPhase(phase)
+	}
+}
+
+// BuildAndStartContainerFromGitHubWS builds a Docker container from a GitHub repository and starts it.
+// The returned Result is the container's log stream, which the caller is responsible for consuming and closing.
+func (dc *DockerClient) BuildAndStartContainerFromGitHubWS(githubURL string) (TerminalResponse, error) {
+	resources, err := LookupResourceProfile(DefaultResourceProfile)
+	if err != nil {
+		return TerminalResponse{}, err
+	}
+
+	result, err := dc.BuildImageFromGitHub(githubURL, BuildOptions{Resources: resources})
+	if err != nil {
+		return TerminalResponse{}, err
+	}
+
+	// Start the container
+	startResponse, err := dc.StartContainer(result.Image, StartOptions{Resources: resources})
+	if err != nil {
+		return TerminalResponse{}, fmt.Errorf("failed to start container %s: %w", result.Image, err)
+	}
+
+	return startResponse, nil
+}
+
+// BuildImageFromGitHub clones a GitHub repository at opts.Ref and builds its Dockerfile. The
+// image is tagged by what it was built from, see ImageCacheRepository, and reused if it exists.
+func (dc *DockerClient) BuildImageFromGitHub(githubURL string, opts BuildOptions) (BuildResult, error) {
+	repo, err := git.ParseRepository(githubURL)
+	if err != nil {
+		return BuildResult{}, err
+	}
+
 	// Create a git client
-	gitClient, err := github.NewGitClient("")
+	gitClient, err := git.NewGitClient("")
 	if err != nil {
-		return TerminalResponse{}, fmt.Errorf("failed to create git client: %w", err)
+		return BuildResult{}, fmt.Errorf("failed to create git client: %w", err)
 	}
 
 	// Clone the repository
-	repoPath, err := gitClient.CloneRepository(githubURL)
+	opts.phase(PhaseCloning)
+	repoPath, err := gitClient.CloneRepository(githubURL, git.CloneOptions{
+		Ref:        opts.Ref,
+		Credential: opts.Credential,
+	})
 	if err != nil {
-		return TerminalResponse{}, fmt.Errorf("failed to clone repository: %w", err)
+		return BuildResult{}, fmt.Errorf("failed to clone repository: %w", err)
 	}
 	defer gitClient.CleanupRepository(repoPath) // Clean up after ourselves
 
-	// Find Dockerfile in the cloned repository
-	dockerfilePath, err := gitClient.FindDockerfile(repoPath)
+	commit, err := gitClient.HeadCommit(repoPath)
+	if err != nil {
+		return BuildResult{}, err
+	}
+
+	// A compose file is run as a stack unless a Dockerfile was asked for
+	composeFile := opts.ComposeFile
+	if composeFile == "" && opts.Dockerfile == "" && !opts.Generate {
+		composeFile = FindComposeFile(repoPath)
+	}
+	if composeFile != "" {
+		project, contextStats, err := dc.buildCompose(gitClient, repoPath, cacheSource{Remote: repo.CloneURL, Commit: commit}, composeFile, opts)
+		if err != nil {
+			return BuildResult{}, err
+		}
+		return BuildResult{Commit: commit, Context: contextStats, Compose: project}, nil
+	}
+
+	// Find the Dockerfile to build in the cloned repository
+	source, err := resolveDockerfile(gitClient, repoPath, opts)
+	if err != nil {
+		return BuildResult{}, fmt.Errorf("failed to find Dockerfile: %w", err)
+	}
+	// Viewers see what is built before the build starts
+	if source.Generated != nil && opts.OnMessage != nil {
+		opts.OnMessage(jsonmessage.JSONMessage{Stream: fmt.Sprintf("No Dockerfile in the repository, generated %s:\n%s\n", source.Dockerfile, source.Generated.Dockerfile)})
+	}
+
+	cache := cacheSource{
+		Remote:     repo.CloneURL,
+		Commit:     commit,
+		Dockerfile: source.Dockerfile,
+		ContextDir: source.ContextDir,
+		Target:     opts.Target,
+		BuildArgs:  opts.BuildArgs,
+	}
+	if source.Generated != nil {
+		cache.Generated = source.Generated.Dockerfile
+	}
+	result := BuildResult{
+		Image:      cache.imageName(),
+		Commit:     commit,
+		Dockerfile: source.Dockerfile,
+		ContextDir: source.ContextDir,
+		Generated:  source.Generated,
+	}
+
+	opts.phase(PhaseBuilding)
+	result.Context, result.Cached, err = dc.buildCached(gitClient, repoPath, source, cache, opts)
 	if err != nil {
-		return TerminalResponse{}, fmt.Errorf("failed to find Dockerfile in %s: %w", repoPath, err)
+		return BuildResult{}, err
 	}
+	return result, nil
+}
+
+// buildCached builds source unless its image exists already, and reports whether it did
+func (dc *DockerClient) buildCached(gitClient *git.GitClient, repoPath string, source buildSource, cache cacheSource, opts BuildOptions) (git.ContextStats, bool, error) {
+	imageName := cache.imageName()
+	unlock := dc.builds.lock(imageName)
+	defer unlock()
 
-	localCodePath := "code_context.tar.gz"
-	localCodeFile, err := os.Create(localCodePath)
+	exists, err := dc.imageExists(imageName)
 	if err != nil {
-		return TerminalResponse{}, fmt.Errorf("failed to create local code file %s: %w", localCodePath, err)
+		return git.ContextStats{}, false, err
 	}
-	defer localCodeFile.Close() // Clean up after ourselves
+	if exists {
+		if opts.OnMessage != nil {
+			opts.OnMessage(jsonmessage.JSONMessage{Stream: fmt.Sprintf("Reusing %s, already built from %s at %s\n", imageName, source.Dockerfile, cache.Commit)})
+		}
+		return git.ContextStats{}, true, nil
+	}
+
+	stats, err := dc.buildImage(gitClient, repoPath, imageName, source, cache, opts)
+	return stats, false, err
+}
+
+// buildImage builds source into imageName, streaming the build context from the checkout
+func (dc *DockerClient) buildImage(gitClient *git.GitClient, repoPath, imageName string, source buildSource, cache cacheSource, opts BuildOptions) (git.ContextStats, error) {
+	dockerfile, contextDir := source.Dockerfile, source.ContextDir
 
 	// Create pipe for tar stream
 	pr, pw := io.Pipe()
 
-	multiWriter := io.MultiWriter(localCodeFile, pw)
 	tarErrChan := make(chan error, 1)
+	var contextStats git.ContextStats
 
-	// Stream the build context (which is the directory of the Dockerfile)
+	// Stream the build context, the Dockerfile's directory unless chosen otherwise
 	go func() {
 		var tarErr error
 		defer func() {
@@ -273,54 +521,153 @@ func (dc *DockerClient) BuildAndStartContainerFromGitHubWS(imageName string, git
 			tarErrChan <- tarErr
 		}()
 
-		// Using the multiWriter, we can write to both the local file and the pipe
-		tarErr = gitClient.PrepareDockerBuildContext(dockerfilePath, multiWriter)
+		contextStats, tarErr = gitClient.PrepareDockerBuildContext(repoPath, contextDir, dockerfile, pw)
 		if tarErr != nil {
-			fmt.Fprintf(os.Stderr, "Error preparing Docker build context from %s: %v\n", filepath.Dir(dockerfilePath), tarErr)
+			fmt.Fprintf(os.Stderr, "Error preparing Docker build context from %s: %v\n", contextDir, tarErr)
 		}
 	}()
 
-	// Build the image
-	buildOptions := types.ImageBuildOptions{
-		Tags:       []string{imageName},
-		Dockerfile: filepath.Base(dockerfilePath), // Dockerfile name relative to the context (its own dir)
-		Remove:     true,
-	}
-
-	response, buildErr := dc.cli.ImageBuild(dc.ctx, pr, buildOptions)
+	// Announced once the builder has read all of it
+	sent := &eofReader{r: pr, onEOF: func() {
+		if opts.OnMessage != nil {
+			opts.OnMessage(jsonmessage.JSONMessage{Stream: fmt.Sprintf("Sent build context %s: %d files, %s, %d paths excluded by .dockerignore\n",
+				contextDir, contextStats.Files, units.HumanSize(float64(contextStats.Bytes)), contextStats.Ignored)})
+		}
+	}}
+
+	buildErr := dc.builder.Build(dc.ctx, dc.cli, BuildRequest{
+		Context:    sent,
+		Dockerfile: source.InContext, // Dockerfile path relative to the context
+		Tag:        imageName,
+		Target:     cache.Target,
+		BuildArgs:  cache.BuildArgs,
+		Labels:     cache.labels(),
+		Resources:  opts.Resources,
+		OnMessage:  opts.OnMessage,
+	})
+	pr.Close()                 // Unblocks the tarring goroutine if the builder stopped reading early
 	tarringErr := <-tarErrChan // Wait for the tarring goroutine to finish and get its error status
 
-	if tarringErr != nil {
-		return TerminalResponse{}, fmt.Errorf("failed to prepare and write Docker build context: %w (docker build error: %v)", tarringErr, buildErr)
+	if tarringErr != nil && !errors.Is(tarringErr, io.ErrClosedPipe) {
+		return contextStats, fmt.Errorf("failed to prepare and write Docker build context: %w (docker build error: %v)", tarringErr, buildErr)
 	}
-
 	if buildErr != nil {
-		return TerminalResponse{}, fmt.Errorf("failed to build image using Dockerfile %s: %w", dockerfilePath, buildErr)
+		return contextStats, fmt.Errorf("failed to build image using Dockerfile %s: %w", dockerfile, buildErr)
 	}
+	return contextStats, nil
+}
 
-	// fmt.Println("Image built successfully to ", imageName)
+// eofReader calls onEOF once when r is read to its end
+type eofReader struct {
+	r     io.Reader
+	onEOF func()
+	done  bool
+}
 
-	// Show build output
-	fmt.Println("=== Docker Build Output ===")
-	io.Copy(os.Stdout, response.Body)
-	fmt.Println("=== End Docker Build Output ===")
-	defer response.Body.Close()
+func (e *eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF && !e.done {
+		e.done = true
+		e.onEOF()
+	}
+	return n, err
+}
 
-	// Start the container
-	startResponse, err := dc.StartContainer(imageName, false)
+// buildCompose builds the images of every service of a compose file that has a build
+// section, or reuses them, and pulls the images the others run. base has the remote and commit.
+func (dc *DockerClient) buildCompose(gitClient *git.GitClient, repoPath string, base cacheSource, composeFile string, opts BuildOptions) (*ComposeProject, git.ContextStats, error) {
+	var total git.ContextStats
+	project, err := LoadCompose(repoPath, composeFile)
 	if err != nil {
-		return TerminalResponse{}, fmt.Errorf("failed to start container %s: %w", imageName, err)
+		return nil, total, fmt.Errorf("failed to load compose file: %w", err)
+	}
+	order, err := project.StartOrder()
+	if err != nil {
+		return nil, total, err
 	}
 
-	fmt.Println("starting container output to image name / websocket connection name: ", imageName)
+	opts.phase(PhaseBuilding)
+	for _, name := range order {
+		service := project.Services[name]
+		if service.Build == nil {
+			if err := dc.pullImage(service.Image, opts.OnMessage); err != nil {
+				return nil, total, fmt.Errorf("service %s: %w", name, err)
+			}
+			continue
+		}
 
-	// Show container output
-	go func() {
-		// gotta return this somehow instead of printing
-		ContainerStreams.Store(imageName, startResponse.Result)
-	}()
+		source := buildSource{Dockerfile: service.Build.Dockerfile, ContextDir: service.Build.ContextDir, InContext: service.Build.Dockerfile}
+		if source.ContextDir != "." {
+			source.InContext = strings.TrimPrefix(source.Dockerfile, source.ContextDir+"/")
+			if source.InContext == source.Dockerfile {
+				return nil, total, fmt.Errorf("service %s: Dockerfile %s is outside of the build context %s", name, source.Dockerfile, source.ContextDir)
+			}
+		}
+		cache := base
+		cache.Dockerfile, cache.ContextDir = source.Dockerfile, source.ContextDir
+		cache.Target, cache.BuildArgs = service.Build.Target, service.Build.Args
+		service.Image = cache.imageName()
 
-	return startResponse, nil
+		if opts.OnMessage != nil {
+			opts.OnMessage(jsonmessage.JSONMessage{Stream: fmt.Sprintf("Building service %s from %s\n", name, source.Dockerfile)})
+		}
+		stats, _, err := dc.buildCached(gitClient, repoPath, source, cache, opts)
+		if err != nil {
+			return nil, total, fmt.Errorf("service %s: %w", name, err)
+		}
+		total.Files += stats.Files
+		total.Bytes += stats.Bytes
+		total.Ignored += stats.Ignored
+	}
+	return project, total, nil
 }
 
-// Removed commented S3 and example code
+// pullImage pulls an image unless it is already present
+func (dc *DockerClient) pullImage(imageName string, onMessage func(jsonmessage.JSONMessage)) error {
+	if _, err := dc.cli.ImageInspect(dc.ctx, imageName); err == nil {
+		return nil
+	}
+	reader, err := dc.cli.ImagePull(dc.ctx, imageName, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", imageName, err)
+	}
+	defer reader.Close()
+	if err := decodeBuildOutput(reader, onMessage); err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", imageName, err)
+	}
+	return nil
+}
+
+// buildArgs converts build args to what ImageBuild expects
+func buildArgs(args map[string]string) map[string]*string {
+	converted := make(map[string]*string, len(args))
+	for key, value := range args {
+		converted[key] = &value
+	}
+	return converted
+}
+
+// decodeBuildOutput reads the JSON message stream of ImageBuild until it ends, passing every
+// message to onMessage. It returns the first error reported by the build.
+func decodeBuildOutput(body io.Reader, onMessage func(jsonmessage.JSONMessage)) error {
+	decoder := json.NewDecoder(body)
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read build output: %w", err)
+		}
+
+		if onMessage != nil {
+			onMessage(message)
+		} else if message.Stream != "" {
+			fmt.Print(message.Stream)
+		}
+
+		if message.Error != nil {
+			return message.Error
+		}
+	}
+}
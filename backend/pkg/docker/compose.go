@@ -0,0 +1,647 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/internal/git"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"gopkg.in/yaml.v3"
+)
+
+// ComposeFileNames are the compose files looked for at the root of a repository, in order
+var ComposeFileNames = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+// Conditions a service can wait for in depends_on
+const (
+	ConditionStarted   = "service_started"
+	ConditionHealthy   = "service_healthy"
+	ConditionCompleted = "service_completed_successfully"
+)
+
+// ComposeProject is the subset of a compose file K0 runs. Every service joins the room's
+// network under its name; host networking, bind mounts and fixed host ports are not
+// available, published ports get ephemeral host ports like single containers do.
+type ComposeProject struct {
+	File     string // Relative to the repository root
+	Services map[string]*ComposeService
+	Volumes  []string // Named volumes, created for the stack and removed with it
+}
+
+// ComposeService is one service of a compose file
+type ComposeService struct {
+	Name        string
+	Image       string        // Pulled if Build is nil, otherwise the built image's name
+	Build       *ComposeBuild // Nil for services that only run an image
+	Command     []string
+	Entrypoint  []string
+	Environment []string // KEY=value
+	WorkingDir  string
+	User        string
+	Ports       []nat.Port        // Container ports to publish
+	DependsOn   map[string]string // Service name to condition
+	Healthcheck *container.HealthConfig
+	Volumes     []ComposeVolume
+}
+
+// ComposeBuild is how a service's image is built, paths relative to the repository root
+type ComposeBuild struct {
+	ContextDir string
+	Dockerfile string
+	Target     string
+	Args       map[string]string
+}
+
+// ComposeVolume mounts a named volume of the stack into a service
+type ComposeVolume struct {
+	Name     string
+	Target   string
+	ReadOnly bool
+}
+
+// FindComposeFile returns the compose file at the root of a repository, empty if there is none
+func FindComposeFile(repoPath string) string {
+	for _, name := range ComposeFileNames {
+		if f, err := openRepoFile(repoPath, name); err == nil {
+			f.Close()
+			return name
+		}
+	}
+	return ""
+}
+
+// composeFile mirrors the YAML of a compose file. Fields with several syntaxes are decoded
+// into yaml.Node and normalized by LoadCompose.
+type composeFile struct {
+	Services map[string]struct {
+		Image       string    `yaml:"image"`
+		Build       yaml.Node `yaml:"build"`
+		Command     yaml.Node `yaml:"command"`
+		Entrypoint  yaml.Node `yaml:"entrypoint"`
+		Environment yaml.Node `yaml:"environment"`
+		EnvFile     yaml.Node `yaml:"env_file"`
+		WorkingDir  string    `yaml:"working_dir"`
+		User        string    `yaml:"user"`
+		Ports       yaml.Node `yaml:"ports"`
+		DependsOn   yaml.Node `yaml:"depends_on"`
+		Healthcheck *struct {
+			Test        yaml.Node `yaml:"test"`
+			Interval    string    `yaml:"interval"`
+			Timeout     string    `yaml:"timeout"`
+			Retries     int       `yaml:"retries"`
+			StartPeriod string    `yaml:"start_period"`
+			Disable     bool      `yaml:"disable"`
+		} `yaml:"healthcheck"`
+		Volumes     []yaml.Node `yaml:"volumes"`
+		Profiles    []string    `yaml:"profiles"`
+		Privileged  bool        `yaml:"privileged"`
+		NetworkMode string      `yaml:"network_mode"`
+	} `yaml:"services"`
+	Volumes map[string]yaml.Node `yaml:"volumes"`
+}
+
+// LoadCompose reads a compose file of a cloned repository. Variables are interpolated from
+// the .env file next to it, never from the server's environment. Every file the compose file
+// refers to must be in the repository, symlinks included.
+func LoadCompose(repoPath, file string) (*ComposeProject, error) {
+	file, err := git.CleanRepoPath(file)
+	if err != nil {
+		return nil, err
+	}
+	dir := path.Dir(file)
+
+	f, err := openRepoFile(repoPath, file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	dotenv, err := readEnvFile(repoPath, path.Join(dir, ".env"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var raw composeFile
+	if err := yaml.Unmarshal([]byte(interpolate(string(data), dotenv)), &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	if len(raw.Services) == 0 {
+		return nil, fmt.Errorf("%s has no services", file)
+	}
+
+	project := &ComposeProject{File: file, Services: make(map[string]*ComposeService)}
+	for name := range raw.Volumes {
+		project.Volumes = append(project.Volumes, name)
+	}
+	sort.Strings(project.Volumes)
+
+	for name, s := range raw.Services {
+		// Like docker compose up, services behind a profile only run when it is enabled
+		if len(s.Profiles) > 0 {
+			continue
+		}
+		if !serviceName.MatchString(name) {
+			return nil, fmt.Errorf("invalid service name %q", name)
+		}
+		if s.Privileged {
+			return nil, fmt.Errorf("service %s: privileged containers are not allowed", name)
+		}
+		if s.NetworkMode != "" {
+			return nil, fmt.Errorf("service %s: network_mode is not supported, services share the room network", name)
+		}
+
+		service := &ComposeService{Name: name, Image: s.Image, WorkingDir: s.WorkingDir, User: s.User}
+		if service.Build, err = composeBuild(s.Build, dir); err != nil {
+			return nil, fmt.Errorf("service %s: %w", name, err)
+		}
+		if service.Build != nil {
+			if _, err := git.ResolveRepoPath(repoPath, service.Build.ContextDir); err != nil {
+				return nil, fmt.Errorf("service %s: invalid build context: %w", name, err)
+			}
+		}
+		if service.Build == nil && service.Image == "" {
+			return nil, fmt.Errorf("service %s needs an image or a build", name)
+		}
+		if service.Command, err = commandList(s.Command); err != nil {
+			return nil, fmt.Errorf("service %s: invalid command: %w", name, err)
+		}
+		if service.Entrypoint, err = commandList(s.Entrypoint); err != nil {
+			return nil, fmt.Errorf("service %s: invalid entrypoint: %w", name, err)
+		}
+
+		// env_file comes first so environment overrides it
+		envFiles, err := stringList(s.EnvFile)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: invalid env_file: %w", name, err)
+		}
+		for _, envFile := range envFiles {
+			p, err := git.CleanRepoPath(path.Join(dir, envFile))
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %w", name, err)
+			}
+			values, err := readEnvFile(repoPath, p)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %w", name, err)
+			}
+			service.Environment = append(service.Environment, envList(values)...)
+		}
+		environment, err := keyValues(s.Environment)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: invalid environment: %w", name, err)
+		}
+		service.Environment = append(service.Environment, envList(environment)...)
+
+		if service.Ports, err = composePorts(s.Ports); err != nil {
+			return nil, fmt.Errorf("service %s: %w", name, err)
+		}
+		if service.DependsOn, err = dependsOn(s.DependsOn); err != nil {
+			return nil, fmt.Errorf("service %s: invalid depends_on: %w", name, err)
+		}
+		if s.Healthcheck != nil && !s.Healthcheck.Disable {
+			test, err := stringList(s.Healthcheck.Test)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: invalid healthcheck: %w", name, err)
+			}
+			if s.Healthcheck.Test.Kind == yaml.ScalarNode {
+				test = append([]string{"CMD-SHELL"}, test...)
+			}
+			service.Healthcheck = &container.HealthConfig{Test: test, Retries: s.Healthcheck.Retries}
+			for _, d := range []struct {
+				value string
+				into  *time.Duration
+			}{
+				{s.Healthcheck.Interval, &service.Healthcheck.Interval},
+				{s.Healthcheck.Timeout, &service.Healthcheck.Timeout},
+				{s.Healthcheck.StartPeriod, &service.Healthcheck.StartPeriod},
+			} {
+				if d.value == "" {
+					continue
+				}
+				if *d.into, err = time.ParseDuration(d.value); err != nil {
+					return nil, fmt.Errorf("service %s: invalid healthcheck duration %q", name, d.value)
+				}
+			}
+		}
+		for _, v := range s.Volumes {
+			volume, err := composeVolume(v, raw.Volumes)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %w", name, err)
+			}
+			service.Volumes = append(service.Volumes, volume)
+		}
+
+		project.Services[name] = service
+	}
+
+	for name, service := range project.Services {
+		for dependency := range service.DependsOn {
+			if _, ok := project.Services[dependency]; !ok {
+				return nil, fmt.Errorf("service %s depends on unknown service %s", name, dependency)
+			}
+		}
+	}
+	return project, nil
+}
+
+var serviceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// StartOrder returns the services so that each comes after the services it depends on,
+// alphabetically where the order does not matter
+func (p *ComposeProject) StartOrder() ([]string, error) {
+	names := make([]string, 0, len(p.Services))
+	for name := range p.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var order []string
+	started := make(map[string]bool)
+	for len(order) < len(names) {
+		progress := false
+		for _, name := range names {
+			if started[name] {
+				continue
+			}
+			ready := true
+			for dependency := range p.Services[name].DependsOn {
+				ready = ready && started[dependency]
+			}
+			if ready {
+				order = append(order, name)
+				started[name] = true
+				progress = true
+			}
+		}
+		if !progress {
+			var cycle []string
+			for _, name := range names {
+				if !started[name] {
+					cycle = append(cycle, name)
+				}
+			}
+			return nil, fmt.Errorf("services %s depend on each other", strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
+
+// composeBuild normalizes the short (context path) and long syntax of build
+func composeBuild(node yaml.Node, dir string) (*ComposeBuild, error) {
+	var long struct {
+		Context    string    `yaml:"context"`
+		Dockerfile string    `yaml:"dockerfile"`
+		Target     string    `yaml:"target"`
+		Args       yaml.Node `yaml:"args"`
+	}
+	switch node.Kind {
+	case 0:
+		return nil, nil
+	case yaml.ScalarNode:
+		long.Context = node.Value
+	case yaml.MappingNode:
+		if err := node.Decode(&long); err != nil {
+			return nil, fmt.Errorf("invalid build: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid build")
+	}
+	if strings.Contains(long.Context, "://") {
+		return nil, fmt.Errorf("build contexts must be in the repository, not %s", long.Context)
+	}
+	if long.Context == "" {
+		long.Context = "."
+	}
+	if long.Dockerfile == "" {
+		long.Dockerfile = "Dockerfile"
+	}
+
+	contextDir, err := git.CleanRepoPath(path.Join(dir, long.Context))
+	if err != nil {
+		return nil, err
+	}
+	dockerfile, err := git.CleanRepoPath(path.Join(contextDir, long.Dockerfile))
+	if err != nil {
+		return nil, err
+	}
+	args, err := keyValues(long.Args)
+	if err != nil {
+		return nil, fmt.Errorf("invalid build args: %w", err)
+	}
+	return &ComposeBuild{ContextDir: contextDir, Dockerfile: dockerfile, Target: long.Target, Args: args}, nil
+}
+
+// composePorts returns the container side of "8080:80", "127.0.0.1:8080:80/tcp", "80" or {target: 80}
+func composePorts(node yaml.Node) ([]nat.Port, error) {
+	var ports []nat.Port
+	for _, item := range node.Content {
+		var spec string
+		switch item.Kind {
+		case yaml.ScalarNode:
+			spec = item.Value
+			if i := strings.LastIndex(spec, ":"); i >= 0 {
+				spec = spec[i+1:]
+			}
+		case yaml.MappingNode:
+			var long struct {
+				Target   string `yaml:"target"`
+				Protocol string `yaml:"protocol"`
+			}
+			if err := item.Decode(&long); err != nil {
+				return nil, fmt.Errorf("invalid port: %w", err)
+			}
+			spec = long.Target
+			if long.Protocol != "" {
+				spec += "/" + long.Protocol
+			}
+		}
+		port, proto, _ := strings.Cut(spec, "/")
+		if proto == "" {
+			proto = "tcp"
+		}
+		p, err := nat.NewPort(proto, port)
+		if err != nil || p.Int() == 0 {
+			return nil, fmt.Errorf("invalid port %q, port ranges are not supported", item.Value)
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// composeVolume accepts named volumes declared at the top level, in short or long syntax
+func composeVolume(node yaml.Node, declared map[string]yaml.Node) (ComposeVolume, error) {
+	var volume ComposeVolume
+	switch node.Kind {
+	case yaml.ScalarNode:
+		parts := strings.Split(node.Value, ":")
+		if len(parts) < 2 {
+			// A bare path is an anonymous volume, which the image's VOLUME would be anyway
+			return ComposeVolume{Target: node.Value}, nil
+		}
+		volume.Name, volume.Target = parts[0], parts[1]
+		volume.ReadOnly = len(parts) > 2 && strings.Contains(parts[2], "ro")
+	case yaml.MappingNode:
+		var long struct {
+			Type     string `yaml:"type"`
+			Source   string `yaml:"source"`
+			Target   string `yaml:"target"`
+			ReadOnly bool   `yaml:"read_only"`
+		}
+		if err := node.Decode(&long); err != nil {
+			return volume, fmt.Errorf("invalid volume: %w", err)
+		}
+		if long.Type != "" && long.Type != "volume" {
+			return volume, fmt.Errorf("%s mounts are not supported, only named volumes", long.Type)
+		}
+		volume = ComposeVolume{Name: long.Source, Target: long.Target, ReadOnly: long.ReadOnly}
+	default:
+		return volume, fmt.Errorf("invalid volume")
+	}
+
+	if volume.Name == "" {
+		return volume, nil
+	}
+	if _, ok := declared[volume.Name]; !ok {
+		return volume, fmt.Errorf("volume %s is not a named volume of the compose file, bind mounts are not supported", volume.Name)
+	}
+	return volume, nil
+}
+
+// dependsOn normalizes the list and the map syntax of depends_on
+func dependsOn(node yaml.Node) (map[string]string, error) {
+	dependencies := make(map[string]string)
+	switch node.Kind {
+	case 0:
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			dependencies[item.Value] = ConditionStarted
+		}
+	case yaml.MappingNode:
+		var long map[string]struct {
+			Condition string `yaml:"condition"`
+		}
+		if err := node.Decode(&long); err != nil {
+			return nil, err
+		}
+		for name, d := range long {
+			switch d.Condition {
+			case "":
+				d.Condition = ConditionStarted
+			case ConditionStarted, ConditionHealthy, ConditionCompleted:
+			default:
+				return nil, fmt.Errorf("unknown condition %q", d.Condition)
+			}
+			dependencies[name] = d.Condition
+		}
+	default:
+		return nil, fmt.Errorf("expected a list or a map")
+	}
+	return dependencies, nil
+}
+
+// commandList turns a command given as a list or a string into arguments, splitting strings
+// like a shell would without running one
+func commandList(node yaml.Node) ([]string, error) {
+	if node.Kind == yaml.ScalarNode {
+		return splitCommand(node.Value)
+	}
+	return stringList(node)
+}
+
+// stringList decodes a string or a list of strings
+func stringList(node yaml.Node) ([]string, error) {
+	switch node.Kind {
+	case 0:
+		return nil, nil
+	case yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		var list []string
+		err := node.Decode(&list)
+		return list, err
+	default:
+		return nil, fmt.Errorf("expected a string or a list")
+	}
+}
+
+// keyValues decodes the map and the KEY=value list syntax of environment and build args
+func keyValues(node yaml.Node) (map[string]string, error) {
+	values := make(map[string]string)
+	switch node.Kind {
+	case 0:
+	case yaml.MappingNode:
+		var m map[string]*string
+		if err := node.Decode(&m); err != nil {
+			return nil, err
+		}
+		for key, value := range m {
+			if value != nil {
+				values[key] = *value
+			}
+		}
+	case yaml.SequenceNode:
+		var list []string
+		if err := node.Decode(&list); err != nil {
+			return nil, err
+		}
+		for _, item := range list {
+			// A bare KEY takes its value from the host in compose, which is not shared here
+			if key, value, ok := strings.Cut(item, "="); ok {
+				values[key] = value
+			}
+		}
+	default:
+		return nil, fmt.Errorf("expected a map or a list")
+	}
+	return values, nil
+}
+
+// envList turns values into KEY=value pairs, sorted for a stable container configuration
+func envList(values map[string]string) []string {
+	list := make([]string, 0, len(values))
+	for key, value := range values {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// readEnvFile reads the KEY=value lines of a file of the repository, ignoring comments and blank lines
+func readEnvFile(repoPath, file string) (map[string]string, error) {
+	f, err := openRepoFile(repoPath, file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	return values, nil
+}
+
+var variable = regexp.MustCompile(`\$\$|\$\{([a-zA-Z_][a-zA-Z0-9_]*)(?:(:?[-?+])([^}]*))?\}|\$([a-zA-Z_][a-zA-Z0-9_]*)`)
+
+// interpolate substitutes $VAR, ${VAR}, ${VAR:-default} and ${VAR-default} with values, $$ is a literal $
+func interpolate(s string, values map[string]string) string {
+	return variable.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		m := variable.FindStringSubmatch(match)
+		name, op, fallback := m[1], m[2], m[3]
+		if name == "" {
+			name = m[4]
+		}
+		value, set := values[name]
+		switch op {
+		case ":-":
+			if value == "" {
+				return fallback
+			}
+		case "-":
+			if !set {
+				return fallback
+			}
+		case ":+":
+			if value != "" {
+				return fallback
+			}
+			return ""
+		case "+":
+			if set {
+				return fallback
+			}
+			return ""
+		}
+		return value
+	})
+}
+
+// splitCommand splits a command line into arguments, honoring quotes and backslashes
+func splitCommand(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// openRepoFile opens a regular file of the repository, file being relative to its root. Symlinks
+// are followed but must not lead outside the repository, which holds the server's secrets.
+func openRepoFile(repoPath, file string) (*os.File, error) {
+	resolved, err := git.ResolveRepoPath(repoPath, file)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", file)
+	}
+	return os.Open(resolved)
+}
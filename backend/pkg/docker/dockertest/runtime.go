@@ -0,0 +1,756 @@
+// Package dockertest provides an in-memory docker.Runtime for running the server, its job
+// pipeline and its websockets without a Docker daemon.
+package dockertest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/pkg/docker"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Repository is what the fake builds for a remote
+type Repository struct {
+	Commit  string                 // Derived from the remote and ref if empty
+	Ports   []string               // Container ports the image exposes, e.g. "3000/tcp"
+	Output  string                 // Written to stdout by every container started from the image
+	Compose *docker.ComposeProject // Built as a stack if set, services with a Build get an image
+}
+
+// Runtime is a deterministic docker.Runtime. IDs and host ports are handed out in sequence,
+// builds succeed instantly and containers run until stopped or told to exit with Exit.
+type Runtime struct {
+	Repositories map[string]Repository // By remote URL as given to BuildImageFromGitHub
+	Now          func() time.Time      // time.Now if nil
+
+	mu         sync.Mutex
+	seq        int
+	nextPort   int
+	errors     map[string]error
+	images     map[string]*image
+	containers map[string]*container
+	execs      map[string]*execShell
+	networks   map[string]bool
+	volumes    map[string]string // Name to stack
+}
+
+type image struct {
+	id      string
+	ports   []string
+	output  string
+	created time.Time
+	cache   docker.CachedImage
+}
+
+type container struct {
+	summary   docker.ContainerSummary
+	ports     []docker.PortMapping
+	running   bool
+	exitCode  int
+	startedAt time.Time
+	stoppedAt time.Time
+	output    []logEntry
+	followers []*follower
+}
+
+type logEntry struct {
+	at     time.Time
+	stream stdcopy.StdType
+	data   []byte
+}
+
+// follower is a log stream of one or more containers. Output is buffered until read, so
+// containers never wait on their readers.
+type follower struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	prefix  map[string]string // Per container, for stacks
+	streams int               // Containers still running, the stream ends at zero
+	closed  bool
+}
+
+// New returns an empty fake runtime
+func New() *Runtime {
+	return &Runtime{
+		Repositories: make(map[string]Repository),
+		nextPort:     32768,
+		errors:       make(map[string]error),
+		images:       make(map[string]*image),
+		containers:   make(map[string]*container),
+		execs:        make(map[string]*execShell),
+		networks:     make(map[string]bool),
+		volumes:      make(map[string]string),
+	}
+}
+
+var _ docker.Runtime = (*Runtime)(nil)
+
+// FailNext makes the next call of method, e.g. "StartContainer", return err
+func (r *Runtime) FailNext(method string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors[method] = err
+}
+
+// takeError returns and clears the error injected for method, with r.mu held
+func (r *Runtime) takeError(method string) error {
+	err := r.errors[method]
+	delete(r.errors, method)
+	return err
+}
+
+func (r *Runtime) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+// nextID returns a new ID with r.mu held
+func (r *Runtime) nextID(kind string) string {
+	r.seq++
+	return fmt.Sprintf("fake-%s-%d", kind, r.seq)
+}
+
+func notFound(kind, id string) error {
+	return errdefs.NotFound(fmt.Errorf("no such %s: %s", kind, id))
+}
+
+// BuildImageFromGitHub "builds" the repository registered for githubURL. Identical builds
+// reuse the image like DockerClient does.
+func (r *Runtime) BuildImageFromGitHub(githubURL string, opts docker.BuildOptions) (docker.BuildResult, error) {
+	r.mu.Lock()
+	err := r.takeError("BuildImageFromGitHub")
+	repo := r.Repositories[githubURL]
+	r.mu.Unlock()
+
+	if opts.OnPhase != nil {
+		opts.OnPhase(docker.PhaseCloning)
+	}
+	if err != nil {
+		return docker.BuildResult{}, err
+	}
+	if repo.Commit == "" {
+		sum := sha1.Sum([]byte(githubURL + "@" + opts.Ref))
+		repo.Commit = hex.EncodeToString(sum[:])
+	}
+	if opts.OnPhase != nil {
+		opts.OnPhase(docker.PhaseBuilding)
+	}
+
+	result := docker.BuildResult{Commit: repo.Commit}
+	if repo.Compose != nil {
+		// Every build gets its own copy of the project, like parsing it again would
+		project := *repo.Compose
+		project.Services = make(map[string]*docker.ComposeService, len(repo.Compose.Services))
+		for _, name := range sortedServices(repo.Compose) {
+			service := *repo.Compose.Services[name]
+			if service.Build != nil {
+				service.Image, _ = r.build(githubURL, repo, service.Build.Dockerfile, opts)
+			}
+			project.Services[name] = &service
+		}
+		result.Compose = &project
+		return result, nil
+	}
+
+	result.Dockerfile = opts.Dockerfile
+	if result.Dockerfile == "" {
+		result.Dockerfile = "Dockerfile"
+	}
+	result.ContextDir = path.Dir(result.Dockerfile)
+	result.Image, result.Cached = r.build(githubURL, repo, result.Dockerfile, opts)
+	if opts.OnMessage != nil {
+		opts.OnMessage(jsonmessage.JSONMessage{Stream: "Successfully built " + result.Image + "\n"})
+	}
+	return result, nil
+}
+
+// build registers the image of a build unless it exists, and reports whether it did
+func (r *Runtime) build(remote string, repo Repository, dockerfile string, opts docker.BuildOptions) (string, bool) {
+	args := make([]string, 0, len(opts.BuildArgs))
+	for name, value := range opts.BuildArgs {
+		args = append(args, name+"="+value)
+	}
+	sort.Strings(args)
+	sum := sha1.Sum([]byte(strings.Join(append([]string{remote, repo.Commit, dockerfile, opts.Target}, args...), "\n")))
+	key := hex.EncodeToString(sum[:16])
+	reference := docker.ImageCacheRepository + ":" + key
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.images[reference]; ok {
+		return reference, true
+	}
+	now := r.now()
+	r.images[reference] = &image{
+		id:      r.nextID("image"),
+		ports:   repo.Ports,
+		output:  repo.Output,
+		created: now,
+		cache: docker.CachedImage{
+			Reference:  reference,
+			Key:        key,
+			Remote:     remote,
+			Commit:     repo.Commit,
+			Dockerfile: dockerfile,
+			Created:    now,
+		},
+	}
+	return reference, false
+}
+
+// StartContainer starts a container from a built image, or any other image as if pulled
+func (r *Runtime) StartContainer(imageName string, opts docker.StartOptions) (docker.TerminalResponse, error) {
+	r.mu.Lock()
+	if err := r.takeError("StartContainer"); err != nil {
+		r.mu.Unlock()
+		return docker.TerminalResponse{}, err
+	}
+	id := r.start(imageName, opts, "")
+	r.mu.Unlock()
+
+	r.writeInitialOutput(id)
+	logs, err := r.FollowLogs(id, time.Time{})
+	if err != nil {
+		return docker.TerminalResponse{}, err
+	}
+	return docker.TerminalResponse{ID: id, Result: logs, Ports: r.containerPorts(id)}, nil
+}
+
+// start creates a running container with r.mu held
+func (r *Runtime) start(imageName string, opts docker.StartOptions, stack string) string {
+	img, ok := r.images[imageName]
+	if !ok {
+		img = &image{id: r.nextID("image"), created: r.now()}
+		r.images[imageName] = img
+	}
+	if opts.RoomID != "" {
+		r.networks[opts.RoomID] = true
+	}
+
+	id := r.nextID("container")
+	now := r.now()
+	c := &container{
+		summary: docker.ContainerSummary{
+			ID:      id,
+			Image:   imageName,
+			State:   "running",
+			Created: now,
+			RoomID:  opts.RoomID,
+			Stack:   stack,
+		},
+		running:   true,
+		startedAt: now,
+	}
+	for _, port := range img.ports {
+		c.ports = append(c.ports, docker.PortMapping{ContainerPort: port, HostPort: fmt.Sprint(r.nextPort)})
+		r.nextPort++
+	}
+	r.containers[id] = c
+	return id
+}
+
+// writeInitialOutput writes the image's output once its container started
+func (r *Runtime) writeInitialOutput(id string) {
+	r.mu.Lock()
+	c := r.containers[id]
+	output := r.images[c.summary.Image].output
+	r.mu.Unlock()
+	if output != "" {
+		r.WriteOutput(id, stdcopy.Stdout, output)
+	}
+}
+
+func (r *Runtime) containerPorts(id string) []docker.PortMapping {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]docker.PortMapping(nil), r.containers[id].ports...)
+}
+
+// StartStack starts every service of a project in start order. Services without ports of
+// their own in the project get the ports of their image.
+func (r *Runtime) StartStack(stackName string, project *docker.ComposeProject, opts docker.StartOptions) (docker.StackResponse, error) {
+	order, err := project.StartOrder()
+	if err != nil {
+		return docker.StackResponse{}, err
+	}
+
+	r.mu.Lock()
+	if err := r.takeError("StartStack"); err != nil {
+		r.mu.Unlock()
+		return docker.StackResponse{}, err
+	}
+	for _, name := range project.Volumes {
+		r.volumes[docker.StackVolumeName(stackName, name)] = stackName
+	}
+	var services []docker.StackService
+	for _, name := range order {
+		service := project.Services[name]
+		id := r.start(service.Image, opts, stackName)
+		c := r.containers[id]
+		if len(service.Ports) > 0 {
+			c.ports = nil
+			for _, port := range service.Ports {
+				c.ports = append(c.ports, docker.PortMapping{ContainerPort: string(port), HostPort: fmt.Sprint(r.nextPort)})
+				r.nextPort++
+			}
+		}
+		services = append(services, docker.StackService{
+			Name:        name,
+			ContainerID: id,
+			Image:       service.Image,
+			Ports:       append([]docker.PortMapping(nil), c.ports...),
+		})
+	}
+	r.mu.Unlock()
+
+	primary := services[len(services)-1]
+	for _, s := range services {
+		if len(s.Ports) > 0 {
+			primary = s
+		}
+	}
+	logs, err := r.FollowStackLogs(services, time.Time{})
+	if err != nil {
+		return docker.StackResponse{}, err
+	}
+	for _, s := range services {
+		r.writeInitialOutput(s.ContainerID)
+	}
+	return docker.StackResponse{
+		TerminalResponse: docker.TerminalResponse{ID: primary.ContainerID, Result: logs, Ports: primary.Ports},
+		Services:         services,
+	}, nil
+}
+
+// WaitReady reports running containers as ready and stopped ones by their exit code, right away
+func (r *Runtime) WaitReady(containerID string, ports []docker.PortMapping, timeout time.Duration) (docker.ReadyStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.takeError("WaitReady"); err != nil {
+		return docker.ReadyStatus{}, err
+	}
+	c, ok := r.containers[containerID]
+	if !ok {
+		return docker.ReadyStatus{}, notFound("container", containerID)
+	}
+
+	switch {
+	case c.running:
+		return docker.ReadyStatus{State: docker.ReadyStateReady, Probe: "running"}, nil
+	case c.exitCode == 0:
+		return docker.ReadyStatus{State: docker.ReadyStateExited, Probe: "exit"}, nil
+	default:
+		return docker.ReadyStatus{State: docker.ReadyStateCrashed, Probe: "exit", ExitCode: c.exitCode}, nil
+	}
+}
+
+// WriteOutput makes a container write to stdout or stderr
+func (r *Runtime) WriteOutput(containerID string, stream stdcopy.StdType, data string) error {
+	r.mu.Lock()
+	c, ok := r.containers[containerID]
+	if !ok {
+		r.mu.Unlock()
+		return notFound("container", containerID)
+	}
+	c.output = append(c.output, logEntry{at: r.now(), stream: stream, data: []byte(data)})
+	followers := append([]*follower(nil), c.followers...)
+	r.mu.Unlock()
+
+	for _, f := range followers {
+		f.write(containerID, stream, []byte(data))
+	}
+	return nil
+}
+
+// Exit stops a running container as if its process exited with code
+func (r *Runtime) Exit(containerID string, code int) error {
+	r.mu.Lock()
+	c, ok := r.containers[containerID]
+	if !ok {
+		r.mu.Unlock()
+		return notFound("container", containerID)
+	}
+	followers := r.stop(c)
+	c.exitCode = code
+	r.mu.Unlock()
+
+	for _, f := range followers {
+		f.done()
+	}
+	return nil
+}
+
+// stop marks a container stopped and detaches its followers, with r.mu held
+func (r *Runtime) stop(c *container) []*follower {
+	if !c.running {
+		return nil
+	}
+	c.running = false
+	c.summary.State = "exited"
+	c.stoppedAt = r.now()
+	followers := c.followers
+	c.followers = nil
+	return followers
+}
+
+// FollowLogs replays a container's output from since and follows it until the container stops
+func (r *Runtime) FollowLogs(containerID string, since time.Time) (io.ReadCloser, error) {
+	return r.follow(map[string]string{containerID: ""}, since)
+}
+
+// FollowStackLogs follows every service, each write prefixed with the service's name
+func (r *Runtime) FollowStackLogs(services []docker.StackService, since time.Time) (io.ReadCloser, error) {
+	prefixes := make(map[string]string, len(services))
+	for _, s := range services {
+		prefixes[s.ContainerID] = s.Name + " | "
+	}
+	return r.follow(prefixes, since)
+}
+
+func (r *Runtime) follow(prefixes map[string]string, since time.Time) (io.ReadCloser, error) {
+	f := &follower{prefix: prefixes}
+	f.cond = sync.NewCond(&f.mu)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.takeError("FollowLogs"); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(prefixes))
+	for id := range prefixes {
+		if _, ok := r.containers[id]; !ok {
+			return nil, notFound("container", id)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		c := r.containers[id]
+		for _, entry := range c.output {
+			if !entry.at.Before(since) {
+				f.write(id, entry.stream, entry.data)
+			}
+		}
+		if c.running {
+			c.followers = append(c.followers, f)
+			f.streams++
+		}
+	}
+	return f, nil
+}
+
+// write buffers one frame for the reader
+func (f *follower) write(containerID string, stream stdcopy.StdType, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	stdcopy.NewStdWriter(&f.buf, stream).Write(append([]byte(f.prefix[containerID]), data...))
+	f.cond.Broadcast()
+}
+
+// done ends the stream once every container it follows has stopped
+func (f *follower) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streams--
+	f.cond.Broadcast()
+}
+
+func (f *follower) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.buf.Len() == 0 && f.streams > 0 && !f.closed {
+		f.cond.Wait()
+	}
+	if f.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if f.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return f.buf.Read(p)
+}
+
+func (f *follower) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.buf.Reset()
+	f.cond.Broadcast()
+	return nil
+}
+
+// execShell is a shell that echoes its input, like a TTY does
+type execShell struct {
+	pr *io.PipeReader
+	pw *io.PipeWriter
+}
+
+func (s *execShell) Read(p []byte) (int, error)  { return s.pr.Read(p) }
+func (s *execShell) Write(p []byte) (int, error) { return s.pw.Write(p) }
+func (s *execShell) Close() error {
+	s.pw.Close()
+	return s.pr.Close()
+}
+
+// ExecShell starts a shell echoing its input in a running container
+func (r *Runtime) ExecShell(containerID string, cols, rows uint) (*docker.ExecSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.takeError("ExecShell"); err != nil {
+		return nil, err
+	}
+	c, ok := r.containers[containerID]
+	if !ok {
+		return nil, notFound("container", containerID)
+	}
+	if !c.running {
+		return nil, fmt.Errorf("container %s is not running", containerID)
+	}
+
+	pr, pw := io.Pipe()
+	shell := &execShell{pr: pr, pw: pw}
+	id := r.nextID("exec")
+	r.execs[id] = shell
+	return docker.NewExecSession(id, shell), nil
+}
+
+// ResizeExec accepts any size for a known exec session
+func (r *Runtime) ResizeExec(execID string, cols, rows uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.execs[execID]; !ok {
+		return notFound("exec", execID)
+	}
+	return nil
+}
+
+// StopContainer stops a container with exit code 0
+func (r *Runtime) StopContainer(id string) error {
+	return r.Exit(id, 0)
+}
+
+// RestartContainer stops a container if needed and starts it again with the same ports
+func (r *Runtime) RestartContainer(id string) error {
+	if err := r.Exit(id, 0); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	c := r.containers[id]
+	c.running = true
+	c.exitCode = 0
+	c.summary.State = "running"
+	c.startedAt = r.now()
+	r.mu.Unlock()
+
+	r.writeInitialOutput(id)
+	return nil
+}
+
+// RemoveContainer removes a container, stopping it first
+func (r *Runtime) RemoveContainer(id string) error {
+	if err := r.Exit(id, 137); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.containers, id)
+	return nil
+}
+
+// RemoveStack removes the services of a stack and its volumes
+func (r *Runtime) RemoveStack(stackName string, services []docker.StackService) error {
+	for i := len(services) - 1; i >= 0; i-- {
+		if err := r.RemoveContainer(services[i].ContainerID); err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, stack := range r.volumes {
+		if stack == stackName {
+			delete(r.volumes, name)
+		}
+	}
+	return nil
+}
+
+// RemoveImage removes an image no container uses
+func (r *Runtime) RemoveImage(imageName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.images[imageName]; !ok {
+		return notFound("image", imageName)
+	}
+	for _, c := range r.containers {
+		if c.summary.Image == imageName {
+			return errdefs.Conflict(fmt.Errorf("image %s is used by container %s", imageName, c.summary.ID))
+		}
+	}
+	delete(r.images, imageName)
+	return nil
+}
+
+// RemoveRoomNetwork forgets a room's network
+func (r *Runtime) RemoveRoomNetwork(roomID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.networks, roomID)
+	return nil
+}
+
+// RemoveStackVolume removes a volume of a stack
+func (r *Runtime) RemoveStackVolume(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.volumes[name]; !ok {
+		return notFound("volume", name)
+	}
+	delete(r.volumes, name)
+	return nil
+}
+
+// RemoveCachedImage evicts a built image
+func (r *Runtime) RemoveCachedImage(reference string) error {
+	if !strings.HasPrefix(reference, docker.ImageCacheRepository+":") {
+		return fmt.Errorf("%s is not a cached image", reference)
+	}
+	return r.RemoveImage(reference)
+}
+
+// PruneBuildCache has no cache to prune
+func (r *Runtime) PruneBuildCache(keepBytes int64) (uint64, error) {
+	return 0, nil
+}
+
+// InspectContainer reports the state and ports of a container
+func (r *Runtime) InspectContainer(id string) (docker.ContainerInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.containers[id]
+	if !ok {
+		return docker.ContainerInfo{}, notFound("container", id)
+	}
+
+	info := docker.ContainerInfo{
+		ID:        id,
+		Image:     c.summary.Image,
+		State:     c.summary.State,
+		Running:   c.running,
+		ExitCode:  c.exitCode,
+		StartedAt: c.startedAt,
+		Ports:     append([]docker.PortMapping(nil), c.ports...),
+	}
+	if c.running {
+		info.Uptime = r.now().Sub(c.startedAt).Seconds()
+		info.Usage = &docker.ResourceUsage{}
+	} else {
+		info.FinishedAt = c.stoppedAt
+	}
+	return info, nil
+}
+
+// Host is where the fake's ports would be published
+func (r *Runtime) Host(containerID string) string {
+	return "127.0.0.1"
+}
+
+// ListContainers lists containers like DockerClient.ListContainers, oldest first
+func (r *Runtime) ListContainers(imagePrefixes ...string) ([]docker.ContainerSummary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var summaries []docker.ContainerSummary
+	for _, c := range r.containers {
+		matches := c.summary.Stack != ""
+		for _, prefix := range imagePrefixes {
+			matches = matches || strings.HasPrefix(c.summary.Image, prefix)
+		}
+		if matches {
+			summaries = append(summaries, c.summary)
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ID < summaries[j].ID })
+	return summaries, nil
+}
+
+// ListImages returns the images with a tag matching reference, which may contain wildcards
+func (r *Runtime) ListImages(reference string) ([]docker.ImageSummary, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var summaries []docker.ImageSummary
+	for name, img := range r.images {
+		if ok, _ := path.Match(reference, name); ok {
+			summaries = append(summaries, docker.ImageSummary{ID: img.id, Tags: []string{name}, Created: img.created})
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Tags[0] < summaries[j].Tags[0] })
+	return summaries, nil
+}
+
+// ListCachedImages returns the built images, newest first
+func (r *Runtime) ListCachedImages() ([]docker.CachedImage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var cached []docker.CachedImage
+	for _, img := range r.images {
+		if img.cache.Reference != "" {
+			cached = append(cached, img.cache)
+		}
+	}
+	sort.Slice(cached, func(i, j int) bool {
+		if !cached[i].Created.Equal(cached[j].Created) {
+			return cached[i].Created.After(cached[j].Created)
+		}
+		return cached[i].Reference < cached[j].Reference
+	})
+	return cached, nil
+}
+
+// RoomNetworks returns the rooms with a network, sorted
+func (r *Runtime) RoomNetworks() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rooms := make([]string, 0, len(r.networks))
+	for room := range r.networks {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+// StackVolumes returns the volumes of stacks and the stack each belongs to
+func (r *Runtime) StackVolumes() (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	volumes := make(map[string]string, len(r.volumes))
+	for name, stack := range r.volumes {
+		volumes[name] = stack
+	}
+	return volumes, nil
+}
+
+func sortedServices(project *docker.ComposeProject) []string {
+	names := make([]string, 0, len(project.Services))
+	for name := range project.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,89 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// shellCommand starts the best shell available in the container
+var shellCommand = []string{"/bin/sh", "-c", "if command -v bash >/dev/null 2>&1; then exec bash; else exec sh; fi"}
+
+// ExecSession is an interactive shell running inside a container with a TTY attached.
+// Writes go to the shell's stdin and reads return its raw terminal output.
+type ExecSession struct {
+	ID    string
+	r     io.Reader
+	w     io.Writer
+	close func() error
+}
+
+// NewExecSession wraps the TTY of a shell started by a Runtime other than DockerClient
+func NewExecSession(id string, tty io.ReadWriteCloser) *ExecSession {
+	return &ExecSession{ID: id, r: tty, w: tty, close: tty.Close}
+}
+
+// Read reads raw terminal output from the shell
+func (es *ExecSession) Read(p []byte) (int, error) {
+	return es.r.Read(p)
+}
+
+// Write sends input to the shell
+func (es *ExecSession) Write(p []byte) (int, error) {
+	return es.w.Write(p)
+}
+
+// Close detaches from the shell, which ends it once its stdin is gone
+func (es *ExecSession) Close() error {
+	return es.close()
+}
+
+var _ io.ReadWriteCloser = (*ExecSession)(nil)
+
+// ExecShell starts an interactive shell in a running container with a TTY of the given size
+func (dc *DockerClient) ExecShell(containerID string, cols, rows uint) (*ExecSession, error) {
+	var consoleSize *[2]uint
+	if cols > 0 && rows > 0 {
+		consoleSize = &[2]uint{rows, cols}
+	}
+
+	exec, err := dc.cli.ContainerExecCreate(dc.ctx, containerID, container.ExecOptions{
+		Tty:          true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		ConsoleSize:  consoleSize,
+		Env:          []string{"TERM=xterm-256color"},
+		Cmd:          shellCommand,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create exec in container %s: %w", containerID, err)
+	}
+
+	conn, err := dc.cli.ContainerExecAttach(dc.ctx, exec.ID, container.ExecAttachOptions{
+		Tty:         true,
+		ConsoleSize: consoleSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to exec %s: %w", exec.ID, err)
+	}
+
+	return &ExecSession{
+		ID: exec.ID,
+		r:  conn.Reader,
+		w:  conn.Conn,
+		close: func() error {
+			conn.Close()
+			return nil
+		},
+	}, nil
+}
+
+// ResizeExec changes the TTY size of an exec session
+func (dc *DockerClient) ResizeExec(execID string, cols, rows uint) error {
+	return dc.cli.ContainerExecResize(dc.ctx, execID, container.ResizeOptions{
+		Height: rows,
+		Width:  cols,
+	})
+}
@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+)
+
+// ImageCacheRepository is the repository every built image is tagged in. Tags are derived
+// from what was built, so building the same thing twice reuses the first image.
+const ImageCacheRepository = "k0-cache"
+
+// Labels describing what a cached image was built from
+const (
+	cacheKeyLabel        = "k0.cache.key"
+	cacheRemoteLabel     = "k0.cache.remote"
+	cacheCommitLabel     = "k0.cache.commit"
+	cacheDockerfileLabel = "k0.cache.dockerfile"
+)
+
+// CachedImage is an image of the build cache
+type CachedImage struct {
+	Reference  string    `json:"reference"` // k0-cache:<key>
+	Key        string    `json:"key"`
+	Remote     string    `json:"remote"`
+	Commit     string    `json:"commit"`
+	Dockerfile string    `json:"dockerfile"` // Relative to the repository root
+	Size       int64     `json:"size"`
+	Created    time.Time `json:"created"`
+}
+
+// cacheSource is what makes two builds identical. Compose services building the same
+// Dockerfile as a single container share its image.
+type cacheSource struct {
+	Remote     string
+	Commit     string
+	Dockerfile string
+	ContextDir string
+	Target     string
+	BuildArgs  map[string]string
+	Generated  string // Contents of a generated Dockerfile, which depend on more than the commit
+}
+
+// key hashes the source into the tag of its image
+func (s cacheSource) key() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "remote=%s\ncommit=%s\ndockerfile=%s\ncontext=%s\ntarget=%s\n", s.Remote, s.Commit, s.Dockerfile, s.ContextDir, s.Target)
+	names := make([]string, 0, len(s.BuildArgs))
+	for name := range s.BuildArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "arg=%s=%s\n", name, s.BuildArgs[name])
+	}
+	fmt.Fprintf(h, "generated=%s\n", s.Generated)
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// labels are set on the image built from the source
+func (s cacheSource) labels() map[string]string {
+	return map[string]string{
+		cacheKeyLabel:        s.key(),
+		cacheRemoteLabel:     s.Remote,
+		cacheCommitLabel:     s.Commit,
+		cacheDockerfileLabel: s.Dockerfile,
+	}
+}
+
+// imageName is the reference of the image built from the source
+func (s cacheSource) imageName() string {
+	return ImageCacheRepository + ":" + s.key()
+}
+
+// imageExists reports whether an image is present
+func (dc *DockerClient) imageExists(imageName string) (bool, error) {
+	_, err := dc.cli.ImageInspect(dc.ctx, imageName)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+	}
+	return true, nil
+}
+
+// buildLocks serializes builds of the same key, so identical requests arriving together build
+// once and the later ones reuse the image
+type buildLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock takes the lock of key and returns its unlock function
+func (b *buildLocks) lock(key string) func() {
+	b.mu.Lock()
+	if b.locks == nil {
+		b.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := b.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		b.locks[key] = l
+	}
+	b.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// ListCachedImages returns every image of the build cache, newest first
+func (dc *DockerClient) ListCachedImages() ([]CachedImage, error) {
+	images, err := dc.cli.ImageList(dc.ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", ImageCacheRepository+":*")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cached images: %w", err)
+	}
+
+	var cached []CachedImage
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if !strings.HasPrefix(tag, ImageCacheRepository+":") {
+				continue
+			}
+			cached = append(cached, CachedImage{
+				Reference:  tag,
+				Key:        img.Labels[cacheKeyLabel],
+				Remote:     img.Labels[cacheRemoteLabel],
+				Commit:     img.Labels[cacheCommitLabel],
+				Dockerfile: img.Labels[cacheDockerfileLabel],
+				Size:       img.Size,
+				Created:    time.Unix(img.Created, 0),
+			})
+		}
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].Created.After(cached[j].Created) })
+	return cached, nil
+}
+
+// RemoveCachedImage evicts an image of the build cache. Layers other images share are kept,
+// and so is the BuildKit cache, so rebuilding it is quick.
+func (dc *DockerClient) RemoveCachedImage(reference string) error {
+	if !strings.HasPrefix(reference, ImageCacheRepository+":") {
+		return fmt.Errorf("%s is not a cached image", reference)
+	}
+	_, err := dc.cli.ImageRemove(dc.ctx, reference, image.RemoveOptions{PruneChildren: true})
+	return err
+}
+
+// PruneBuildCache trims the builder's cache down to keepBytes, least recently used first
+func (dc *DockerClient) PruneBuildCache(keepBytes int64) (uint64, error) {
+	reclaimed, err := dc.builder.Prune(dc.ctx, dc.cli, keepBytes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune build cache: %w", err)
+	}
+	return reclaimed, nil
+}
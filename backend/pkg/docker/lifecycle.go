@@ -0,0 +1,236 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+// ContainerInfo is the state of a container as reported by the lifecycle API
+type ContainerInfo struct {
+	ID         string          `json:"id"`
+	Image      string          `json:"image"`
+	State      string          `json:"state"` // created, running, paused, restarting, removing, exited or dead
+	Running    bool            `json:"running"`
+	ExitCode   int             `json:"exit_code"`
+	OOMKilled  bool            `json:"oom_killed"`
+	Health     string          `json:"health,omitempty"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt time.Time       `json:"finished_at,omitempty"`
+	Uptime     float64         `json:"uptime_seconds"` // Zero unless running
+	Ports      []PortMapping   `json:"ports"`
+	Usage      *ResourceUsage  `json:"usage,omitempty"` // Only set while running
+	Limits     ResourceProfile `json:"limits"`
+	Egress     EgressPolicy    `json:"egress,omitempty"` // Empty for containers on the default bridge
+}
+
+// ResourceUsage is a point-in-time sample of a container's resource consumption
+type ResourceUsage struct {
+	CPUPercent       float64 `json:"cpu_percent"` // 100 means one full core
+	MemoryBytes      uint64  `json:"memory_bytes"`
+	MemoryLimitBytes uint64  `json:"memory_limit_bytes"`
+	PIDs             uint64  `json:"pids"`
+}
+
+// IsNotFound reports whether err means the container or image does not exist
+func IsNotFound(err error) bool {
+	return client.IsErrNotFound(err)
+}
+
+// FollowLogs streams a container's stdout and stderr from since onwards, see CopyLogs
+func (dc *DockerClient) FollowLogs(containerID string, since time.Time) (io.ReadCloser, error) {
+	options := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	}
+	if !since.IsZero() {
+		options.Since = since.Format(time.RFC3339Nano)
+	}
+
+	logs, err := dc.cli.ContainerLogs(dc.ctx, containerID, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container logs: %w", err)
+	}
+	return logs, nil
+}
+
+// RestartContainer stops a container if it is running and starts it again
+func (dc *DockerClient) RestartContainer(id string) error {
+	return dc.cli.ContainerRestart(dc.ctx, id, container.StopOptions{})
+}
+
+// RemoveImage deletes an image that no container uses anymore
+func (dc *DockerClient) RemoveImage(imageName string) error {
+	_, err := dc.cli.ImageRemove(dc.ctx, imageName, image.RemoveOptions{PruneChildren: true})
+	return err
+}
+
+// InspectContainer returns the state, published ports and, while running, the resource usage of a container
+func (dc *DockerClient) InspectContainer(id string) (ContainerInfo, error) {
+	inspect, err := dc.cli.ContainerInspect(dc.ctx, id)
+	if err != nil {
+		return ContainerInfo{}, fmt.Errorf("failed to inspect container %s: %w", id, err)
+	}
+
+	info := ContainerInfo{
+		ID:     inspect.ID,
+		Image:  inspect.Config.Image,
+		Limits: resourceLimits(inspect.Config.Labels, inspect.HostConfig),
+		Egress: EgressPolicy(inspect.Config.Labels[egressLabel]),
+	}
+	if state := inspect.State; state != nil {
+		info.State = state.Status
+		info.Running = state.Running
+		info.ExitCode = state.ExitCode
+		info.OOMKilled = state.OOMKilled
+		info.StartedAt, _ = time.Parse(time.RFC3339Nano, state.StartedAt)
+		if finishedAt, err := time.Parse(time.RFC3339Nano, state.FinishedAt); err == nil && finishedAt.After(info.StartedAt) {
+			info.FinishedAt = finishedAt
+		}
+		if state.Health != nil {
+			info.Health = state.Health.Status
+		}
+		if state.Running {
+			info.Uptime = time.Since(info.StartedAt).Seconds()
+		}
+	}
+
+	if inspect.NetworkSettings != nil {
+		for port, bindings := range inspect.NetworkSettings.Ports {
+			if len(bindings) > 0 {
+				info.Ports = append(info.Ports, PortMapping{ContainerPort: string(port), HostPort: bindings[0].HostPort})
+			}
+		}
+		sort.Slice(info.Ports, func(i, j int) bool {
+			return info.Ports[i].ContainerPort < info.Ports[j].ContainerPort
+		})
+	}
+
+	if info.Running {
+		usage, err := dc.resourceUsage(id)
+		if err != nil {
+			return ContainerInfo{}, err
+		}
+		info.Usage = &usage
+	}
+
+	return info, nil
+}
+
+// resourceUsage samples a container's stats. The non-streaming stats call waits for a
+// second sample so that CPU usage can be computed from the difference.
+func (dc *DockerClient) resourceUsage(id string) (ResourceUsage, error) {
+	resp, err := dc.cli.ContainerStats(dc.ctx, id, false)
+	if err != nil {
+		return ResourceUsage{}, fmt.Errorf("failed to get stats of container %s: %w", id, err)
+	}
+	defer resp.Body.Close()
+
+	var stats container.StatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return ResourceUsage{}, fmt.Errorf("failed to decode stats of container %s: %w", id, err)
+	}
+
+	usage := ResourceUsage{
+		MemoryBytes:      stats.MemoryStats.Usage,
+		MemoryLimitBytes: stats.MemoryStats.Limit,
+		PIDs:             stats.PidsStats.Current,
+	}
+	// Page cache counts towards usage but can be reclaimed, report what docker stats shows
+	if cache, ok := stats.MemoryStats.Stats["inactive_file"]; ok && cache < usage.MemoryBytes {
+		usage.MemoryBytes -= cache
+	}
+
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	onlineCPUs := float64(stats.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		usage.CPUPercent = cpuDelta / systemDelta * onlineCPUs * 100
+	}
+
+	return usage, nil
+}
+
+// ContainerSummary is a container as listed by ListContainers
+type ContainerSummary struct {
+	ID      string
+	Image   string
+	State   string
+	Created time.Time
+	RoomID  string // Room whose network the container is on, if any
+	Stack   string // Compose stack the container is a service of, if any
+}
+
+// ImageSummary is an image as listed by ListImages
+type ImageSummary struct {
+	ID      string
+	Tags    []string
+	Created time.Time
+}
+
+// ListContainers returns every container, running or not, whose image name starts with one of
+// imagePrefixes, and the services of compose stacks
+func (dc *DockerClient) ListContainers(imagePrefixes ...string) ([]ContainerSummary, error) {
+	containers, err := dc.cli.ContainerList(dc.ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var summaries []ContainerSummary
+	for _, c := range containers {
+		// Services of a stack may run images that are not ours, such as postgres
+		if !hasAnyPrefix(c.Image, imagePrefixes) && c.Labels[stackLabel] == "" {
+			continue
+		}
+		summaries = append(summaries, ContainerSummary{
+			ID:      c.ID,
+			Image:   c.Image,
+			State:   c.State,
+			Created: time.Unix(c.Created, 0),
+			RoomID:  c.Labels[roomLabel],
+			Stack:   c.Labels[stackLabel],
+		})
+	}
+	return summaries, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListImages returns the images with a tag matching reference, which may contain wildcards
+func (dc *DockerClient) ListImages(reference string) ([]ImageSummary, error) {
+	images, err := dc.cli.ImageList(dc.ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", reference)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	summaries := make([]ImageSummary, 0, len(images))
+	for _, img := range images {
+		summaries = append(summaries, ImageSummary{
+			ID:      img.ID,
+			Tags:    img.RepoTags,
+			Created: time.Unix(img.Created, 0),
+		})
+	}
+	return summaries, nil
+}
@@ -0,0 +1,237 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+// EgressPolicy decides what a room's containers may reach outside of the room
+type EgressPolicy string
+
+const (
+	EgressNone      EgressPolicy = "none"      // Nothing outside the room
+	EgressAllowlist EgressPolicy = "allowlist" // Allowlisted hosts such as package registries, over HTTP(S)
+	EgressFull      EgressPolicy = "full"      // Anything
+)
+
+const (
+	roomLabel   = "k0.room"
+	egressLabel = "k0.egress"
+
+	defaultEgressProxyImage = "k0-egress-proxy"
+	egressProxyAlias        = "egress-proxy"
+	egressProxyPort         = "3128"
+)
+
+// defaultEgressAllowlist are the package registries common project setups install from.
+// A leading dot allows every subdomain.
+var defaultEgressAllowlist = []string{
+	"registry.npmjs.org", "registry.yarnpkg.com",
+	"pypi.org", "files.pythonhosted.org",
+	"proxy.golang.org", "sum.golang.org",
+	"crates.io", "static.crates.io", "index.crates.io",
+	"repo.maven.apache.org", "repo1.maven.org", "plugins.gradle.org", "services.gradle.org",
+	"rubygems.org", "index.rubygems.org",
+	"github.com", "codeload.github.com", "objects.githubusercontent.com",
+	"deb.debian.org", "security.debian.org", "archive.ubuntu.com", "dl-cdn.alpinelinux.org",
+}
+
+// ParseEgressPolicy validates a policy chosen for a room, EGRESS_DEFAULT_POLICY or
+// allowlist if empty
+func ParseEgressPolicy(s string) (EgressPolicy, error) {
+	if s == "" {
+		s = os.Getenv("EGRESS_DEFAULT_POLICY")
+	}
+	switch policy := EgressPolicy(s); policy {
+	case "":
+		return EgressAllowlist, nil
+	case EgressNone, EgressAllowlist, EgressFull:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown egress policy %q, expected none, allowlist or full", s)
+	}
+}
+
+// RoomNetworkName is the Docker network shared by all containers of a room
+func RoomNetworkName(roomID string) string {
+	return "k0-room-" + roomID
+}
+
+func egressProxyName(roomID string) string {
+	return "k0-egress-" + roomID
+}
+
+// egressAllowlist returns the hosts allowlisted rooms may reach, from EGRESS_ALLOWLIST if set
+func egressAllowlist() []string {
+	if hosts := os.Getenv("EGRESS_ALLOWLIST"); hosts != "" {
+		return strings.Split(hosts, ",")
+	}
+	return defaultEgressAllowlist
+}
+
+// roomNetwork makes sure the room's network exists with the given policy and returns the
+// environment containers on it need. Containers on the network reach each other by name,
+// and published ports keep working for the preview proxy whatever the policy.
+//
+// Without egress the network's traffic is not masqueraded, so nothing it sends can get an
+// answer from outside the host. With the allowlist, an egress proxy on the network is the
+// only way out. The Docker host itself, including its API, and the EC2 metadata endpoint are
+// kept out of reach by the firewall pool hosts install, see ec2.LaunchInstance.
+func (dc *DockerClient) roomNetwork(roomID string, policy EgressPolicy) (string, []string, error) {
+	name := RoomNetworkName(roomID)
+
+	existing, err := dc.cli.NetworkInspect(dc.ctx, name, network.InspectOptions{})
+	switch {
+	case err == nil && existing.Labels[egressLabel] == string(policy):
+		// Reuse it, other containers of the room may be on it
+	case err == nil:
+		if len(existing.Containers) > 0 && !dc.onlyEgressProxy(roomID, existing) {
+			return "", nil, fmt.Errorf("room network %s is in use with egress policy %s", name, existing.Labels[egressLabel])
+		}
+		if err := dc.RemoveRoomNetwork(roomID); err != nil {
+			return "", nil, err
+		}
+		if err := dc.createRoomNetwork(roomID, policy); err != nil {
+			return "", nil, err
+		}
+	case errdefs.IsNotFound(err):
+		if err := dc.createRoomNetwork(roomID, policy); err != nil {
+			return "", nil, err
+		}
+	default:
+		return "", nil, fmt.Errorf("failed to inspect network %s: %w", name, err)
+	}
+
+	if policy != EgressAllowlist {
+		return name, nil, nil
+	}
+	if err := dc.startEgressProxy(roomID, name); err != nil {
+		return "", nil, err
+	}
+
+	proxyURL := "http://" + egressProxyAlias + ":" + egressProxyPort
+	return name, []string{
+		"HTTP_PROXY=" + proxyURL, "HTTPS_PROXY=" + proxyURL,
+		"http_proxy=" + proxyURL, "https_proxy=" + proxyURL,
+		"NO_PROXY=localhost,127.0.0.1", "no_proxy=localhost,127.0.0.1",
+	}, nil
+}
+
+// onlyEgressProxy reports whether the room's egress proxy is the only container on its network
+func (dc *DockerClient) onlyEgressProxy(roomID string, n network.Inspect) bool {
+	for _, endpoint := range n.Containers {
+		if endpoint.Name != egressProxyName(roomID) {
+			return false
+		}
+	}
+	return true
+}
+
+func (dc *DockerClient) createRoomNetwork(roomID string, policy EgressPolicy) error {
+	options := map[string]string{"com.docker.network.bridge.enable_icc": "true"}
+	if policy != EgressFull {
+		options["com.docker.network.bridge.enable_ip_masquerade"] = "false"
+	}
+
+	_, err := dc.cli.NetworkCreate(dc.ctx, RoomNetworkName(roomID), network.CreateOptions{
+		Driver:  "bridge",
+		Options: options,
+		Labels:  map[string]string{roomLabel: roomID, egressLabel: string(policy)},
+	})
+	if err != nil && !errdefs.IsConflict(err) {
+		return fmt.Errorf("failed to create network for room %s: %w", roomID, err)
+	}
+	return nil
+}
+
+// startEgressProxy runs the room's egress proxy unless it is already running. It sits on the
+// room network and on the default bridge, which it uses to reach the allowlisted hosts.
+func (dc *DockerClient) startEgressProxy(roomID, networkName string) error {
+	name := egressProxyName(roomID)
+	if inspect, err := dc.cli.ContainerInspect(dc.ctx, name); err == nil {
+		if inspect.State != nil && inspect.State.Running {
+			return nil
+		}
+		return dc.cli.ContainerStart(dc.ctx, inspect.ID, container.StartOptions{})
+	}
+
+	proxyImage := os.Getenv("EGRESS_PROXY_IMAGE")
+	if proxyImage == "" {
+		proxyImage = defaultEgressProxyImage
+	}
+	if _, err := dc.cli.ImageInspect(dc.ctx, proxyImage); errdefs.IsNotFound(err) {
+		out, err := dc.cli.ImagePull(dc.ctx, proxyImage, image.PullOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to pull egress proxy image %s: %w", proxyImage, err)
+		}
+		io.Copy(io.Discard, out)
+		out.Close()
+	}
+
+	resp, err := dc.cli.ContainerCreate(dc.ctx, &container.Config{
+		Image:  proxyImage,
+		Env:    []string{"EGRESS_ALLOWLIST=" + strings.Join(egressAllowlist(), ",")},
+		Labels: map[string]string{roomLabel: roomID},
+	}, &container.HostConfig{
+		RestartPolicy:  container.RestartPolicy{Name: container.RestartPolicyUnlessStopped},
+		CapDrop:        []string{"ALL"},
+		SecurityOpt:    []string{"no-new-privileges"},
+		ReadonlyRootfs: true,
+	}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			// The default bridge provides the route out
+			network.NetworkBridge: {GwPriority: 1},
+		},
+	}, nil, name)
+	if err != nil {
+		return fmt.Errorf("failed to create egress proxy for room %s: %w", roomID, err)
+	}
+
+	if err := dc.cli.NetworkConnect(dc.ctx, networkName, resp.ID, &network.EndpointSettings{
+		Aliases: []string{egressProxyAlias},
+	}); err != nil {
+		dc.RemoveContainer(resp.ID)
+		return fmt.Errorf("failed to connect egress proxy to %s: %w", networkName, err)
+	}
+
+	if err := dc.cli.ContainerStart(dc.ctx, resp.ID, container.StartOptions{}); err != nil {
+		dc.RemoveContainer(resp.ID)
+		return fmt.Errorf("failed to start egress proxy for room %s: %w", roomID, err)
+	}
+	return nil
+}
+
+// RemoveRoomNetwork removes a room's egress proxy and network once its containers are gone
+func (dc *DockerClient) RemoveRoomNetwork(roomID string) error {
+	if err := dc.RemoveContainer(egressProxyName(roomID)); err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("failed to remove egress proxy of room %s: %w", roomID, err)
+	}
+	if err := dc.cli.NetworkRemove(dc.ctx, RoomNetworkName(roomID)); err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("failed to remove network of room %s: %w", roomID, err)
+	}
+	return nil
+}
+
+// RoomNetworks returns the ids of the rooms that have a network
+func (dc *DockerClient) RoomNetworks() ([]string, error) {
+	networks, err := dc.cli.NetworkList(dc.ctx, network.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", roomLabel)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list room networks: %w", err)
+	}
+
+	rooms := make([]string, 0, len(networks))
+	for _, n := range networks {
+		rooms = append(rooms, n.Labels[roomLabel])
+	}
+	return rooms, nil
+}
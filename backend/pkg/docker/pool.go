@@ -0,0 +1,555 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/pkg/ec2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/docker/docker/errdefs"
+)
+
+const defaultQueueTimeout = 20 * time.Minute
+
+// PooledClient runs rooms on a pool of EC2 Docker hosts, see ec2.HostPool. A room is placed
+// on a host when its first image is built, and everything of the room runs there until its
+// network is removed.
+type PooledClient struct {
+	pool         *ec2.HostPool
+	sandbox      SandboxConfig
+	builder      Builder
+	queueTimeout time.Duration // How long a build waits for a host before it fails
+
+	mu         sync.Mutex
+	clients    map[string]*DockerClient // By instance ID
+	containers map[string]string        // Container ID to instance ID
+	execs      map[string]string        // Exec ID to instance ID
+}
+
+var _ Runtime = (*PooledClient)(nil)
+
+func getAmiIdFromSSM(ctx context.Context, ssmClient *ssm.Client) (string, error) {
+	param, err := ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
+		Name: aws.String("/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-x86_64-gp2"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return *param.Parameter.Value, nil
+}
+
+// CreatePooledClient starts managing the pool of EC2 Docker hosts configured by
+// ec2.PoolConfigFromEnv, picking up the hosts and rooms left by a previous run.
+// HOST_POOL_QUEUE_TIMEOUT is how long a build waits for a host, 20m by default.
+func CreatePooledClient() (*PooledClient, error) {
+	fmt.Println("☁️ Using a pool of EC2 Docker hosts for production...")
+
+	sandbox, err := SandboxFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	builder, err := BuilderFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	poolConfig, err := ec2.PoolConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	queueTimeout := defaultQueueTimeout
+	if timeout := os.Getenv("HOST_POOL_QUEUE_TIMEOUT"); timeout != "" {
+		if queueTimeout, err = time.ParseDuration(timeout); err != nil {
+			return nil, fmt.Errorf("invalid HOST_POOL_QUEUE_TIMEOUT %q: %w", timeout, err)
+		}
+	}
+
+	ec2Client, err := ec2.NewEC2Client()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create EC2 client: %w", err)
+	}
+
+	// Dynamically fetch the latest Amazon Linux 2 AMI ID for the current region
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config for SSM: %w", err)
+	}
+	ssmClient := ssm.NewFromConfig(cfg)
+	poolConfig.Launch.ImageID, err = getAmiIdFromSSM(context.Background(), ssmClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest Amazon Linux 2 AMI ID: %w", err)
+	}
+
+	pc := &PooledClient{
+		sandbox:      sandbox,
+		builder:      builder,
+		queueTimeout: queueTimeout,
+		clients:      make(map[string]*DockerClient),
+		containers:   make(map[string]string),
+		execs:        make(map[string]string),
+	}
+	poolConfig.Probe = pc.probe
+	pc.pool = ec2.NewHostPool(ec2Client, poolConfig)
+	if err := pc.pool.Start(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to start host pool: %w", err)
+	}
+	fmt.Printf("Building images with the %s builder\n", builder.Name())
+	return pc, nil
+}
+
+// probe checks that a host's daemon answers and returns the rooms that have a network on it
+func (pc *PooledClient) probe(ctx context.Context, host ec2.Host) ([]string, error) {
+	dc, err := pc.client(host)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := dc.cli.Ping(ctx); err != nil {
+		return nil, fmt.Errorf("failed to reach Docker on %s: %w", host.InstanceID, err)
+	}
+	return dc.RoomNetworks()
+}
+
+// client returns the Docker client of a host
+func (pc *PooledClient) client(host ec2.Host) (*DockerClient, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if dc, ok := pc.clients[host.InstanceID]; ok && dc.publicIP == host.Address {
+		return dc, nil
+	}
+	if old, ok := pc.clients[host.InstanceID]; ok {
+		old.Cleanup()
+	}
+	dc, err := createHostDockerClient(host.Address)
+	if err != nil {
+		return nil, err
+	}
+	dc.sandbox = pc.sandbox
+	dc.builder = pc.builder
+	pc.clients[host.InstanceID] = dc
+	return dc, nil
+}
+
+// roomClient returns the client of a room's host, placing the room on one if needed
+func (pc *PooledClient) roomClient(roomID string) (*DockerClient, ec2.Host, error) {
+	if roomID == "" {
+		return nil, ec2.Host{}, fmt.Errorf("pooled hosts need the room to run for")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pc.queueTimeout)
+	defer cancel()
+	host, err := pc.pool.Acquire(ctx, roomID)
+	if err != nil {
+		return nil, host, err
+	}
+	dc, err := pc.client(host)
+	return dc, host, err
+}
+
+// releaseUnused takes a room off its host again if nothing of it was left running there
+func (pc *PooledClient) releaseUnused(dc *DockerClient, roomID string) {
+	rooms, err := dc.RoomNetworks()
+	if err != nil {
+		return
+	}
+	for _, room := range rooms {
+		if room == roomID {
+			return
+		}
+	}
+	pc.pool.Release(roomID)
+}
+
+// hostClients returns the clients of the hosts that may run containers
+func (pc *PooledClient) hostClients() []*DockerClient {
+	var clients []*DockerClient
+	for _, host := range pc.pool.Hosts() {
+		if host.State == ec2.HostProvisioning {
+			continue
+		}
+		if dc, err := pc.client(host); err == nil {
+			clients = append(clients, dc)
+		}
+	}
+	return clients
+}
+
+// containerClient returns the client of the host a container runs on. Containers started
+// before the server restarted are looked for on every host.
+func (pc *PooledClient) containerClient(containerID string) (*DockerClient, error) {
+	pc.mu.Lock()
+	instanceID, ok := pc.containers[containerID]
+	pc.mu.Unlock()
+	if ok {
+		if host, ok := pc.pool.Host(instanceID); ok {
+			return pc.client(host)
+		}
+	}
+
+	for _, host := range pc.pool.Hosts() {
+		if host.State == ec2.HostProvisioning {
+			continue
+		}
+		dc, err := pc.client(host)
+		if err != nil {
+			continue
+		}
+		if _, err := dc.cli.ContainerInspect(dc.ctx, containerID); err == nil {
+			pc.track(host.InstanceID, containerID)
+			return dc, nil
+		}
+	}
+	return nil, errdefs.NotFound(fmt.Errorf("container %s not found on any host", containerID))
+}
+
+// track remembers which host containers run on
+func (pc *PooledClient) track(instanceID string, containerIDs ...string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for _, id := range containerIDs {
+		pc.containers[id] = instanceID
+	}
+}
+
+// forget drops containers that were removed
+func (pc *PooledClient) forget(containerIDs ...string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for _, id := range containerIDs {
+		delete(pc.containers, id)
+	}
+}
+
+// BuildImageFromGitHub builds on the host of opts.RoomID, waiting in the queued phase while
+// there is no host with room to spare
+func (pc *PooledClient) BuildImageFromGitHub(githubURL string, opts BuildOptions) (BuildResult, error) {
+	dc, _, err := pc.roomClient(opts.RoomID)
+	if err != nil {
+		return BuildResult{}, err
+	}
+	result, err := dc.BuildImageFromGitHub(githubURL, opts)
+	if err != nil {
+		pc.releaseUnused(dc, opts.RoomID)
+	}
+	return result, err
+}
+
+func (pc *PooledClient) StartContainer(imageName string, opts StartOptions) (TerminalResponse, error) {
+	dc, host, err := pc.roomClient(opts.RoomID)
+	if err != nil {
+		return TerminalResponse{}, err
+	}
+	response, err := dc.StartContainer(imageName, opts)
+	if err != nil {
+		pc.releaseUnused(dc, opts.RoomID)
+		return response, err
+	}
+	pc.track(host.InstanceID, response.ID)
+	return response, nil
+}
+
+func (pc *PooledClient) StartStack(stackName string, project *ComposeProject, opts StartOptions) (StackResponse, error) {
+	dc, host, err := pc.roomClient(opts.RoomID)
+	if err != nil {
+		return StackResponse{}, err
+	}
+	response, err := dc.StartStack(stackName, project, opts)
+	if err != nil {
+		pc.releaseUnused(dc, opts.RoomID)
+		return response, err
+	}
+	for _, service := range response.Services {
+		pc.track(host.InstanceID, service.ContainerID)
+	}
+	return response, nil
+}
+
+func (pc *PooledClient) WaitReady(containerID string, ports []PortMapping, timeout time.Duration) (ReadyStatus, error) {
+	dc, err := pc.containerClient(containerID)
+	if err != nil {
+		return ReadyStatus{}, err
+	}
+	return dc.WaitReady(containerID, ports, timeout)
+}
+
+func (pc *PooledClient) FollowLogs(containerID string, since time.Time) (io.ReadCloser, error) {
+	dc, err := pc.containerClient(containerID)
+	if err != nil {
+		return nil, err
+	}
+	return dc.FollowLogs(containerID, since)
+}
+
+// FollowStackLogs follows a stack on the host of its services
+func (pc *PooledClient) FollowStackLogs(services []StackService, since time.Time) (io.ReadCloser, error) {
+	if len(services) == 0 {
+		return nil, fmt.Errorf("stack has no services")
+	}
+	dc, err := pc.containerClient(services[0].ContainerID)
+	if err != nil {
+		return nil, err
+	}
+	return dc.FollowStackLogs(services, since)
+}
+
+func (pc *PooledClient) ExecShell(containerID string, cols, rows uint) (*ExecSession, error) {
+	dc, err := pc.containerClient(containerID)
+	if err != nil {
+		return nil, err
+	}
+	session, err := dc.ExecShell(containerID, cols, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	pc.mu.Lock()
+	pc.execs[session.ID] = pc.containers[containerID]
+	pc.mu.Unlock()
+	return session, nil
+}
+
+func (pc *PooledClient) ResizeExec(execID string, cols, rows uint) error {
+	pc.mu.Lock()
+	instanceID, ok := pc.execs[execID]
+	pc.mu.Unlock()
+	host, found := pc.pool.Host(instanceID)
+	if !ok || !found {
+		return errdefs.NotFound(fmt.Errorf("exec session %s not found", execID))
+	}
+	dc, err := pc.client(host)
+	if err != nil {
+		return err
+	}
+	return dc.ResizeExec(execID, cols, rows)
+}
+
+func (pc *PooledClient) StopContainer(id string) error {
+	dc, err := pc.containerClient(id)
+	if err != nil {
+		return err
+	}
+	return dc.StopContainer(id)
+}
+
+func (pc *PooledClient) RestartContainer(id string) error {
+	dc, err := pc.containerClient(id)
+	if err != nil {
+		return err
+	}
+	return dc.RestartContainer(id)
+}
+
+func (pc *PooledClient) RemoveContainer(id string) error {
+	dc, err := pc.containerClient(id)
+	if err != nil {
+		return err
+	}
+	if err := dc.RemoveContainer(id); err != nil {
+		return err
+	}
+	pc.forget(id)
+	return nil
+}
+
+func (pc *PooledClient) RemoveStack(stackName string, services []StackService) error {
+	if len(services) == 0 {
+		return nil
+	}
+	dc, err := pc.containerClient(services[0].ContainerID)
+	if err != nil {
+		return err
+	}
+	if err := dc.RemoveStack(stackName, services); err != nil {
+		return err
+	}
+	for _, service := range services {
+		pc.forget(service.ContainerID)
+	}
+	return nil
+}
+
+// RemoveRoomNetwork removes the room's network from every host and takes the room off its
+// host, which is how a room ends
+func (pc *PooledClient) RemoveRoomNetwork(roomID string) error {
+	err := pc.onEveryHost(func(dc *DockerClient) error { return dc.RemoveRoomNetwork(roomID) })
+	if err == nil || errdefs.IsNotFound(err) {
+		pc.pool.Release(roomID)
+		return nil
+	}
+	return err
+}
+
+func (pc *PooledClient) RemoveImage(imageName string) error {
+	return pc.onEveryHost(func(dc *DockerClient) error { return dc.RemoveImage(imageName) })
+}
+
+func (pc *PooledClient) RemoveStackVolume(name string) error {
+	return pc.onEveryHost(func(dc *DockerClient) error { return dc.RemoveStackVolume(name) })
+}
+
+func (pc *PooledClient) RemoveCachedImage(reference string) error {
+	return pc.onEveryHost(func(dc *DockerClient) error { return dc.RemoveCachedImage(reference) })
+}
+
+// onEveryHost runs remove on every host. It fails with the first error other than not found,
+// or not found if nothing was found anywhere.
+func (pc *PooledClient) onEveryHost(remove func(dc *DockerClient) error) error {
+	var notFound, failed error
+	found := false
+	for _, dc := range pc.hostClients() {
+		err := remove(dc)
+		switch {
+		case err == nil:
+			found = true
+		case errdefs.IsNotFound(err):
+			notFound = err
+		case failed == nil:
+			failed = err
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	if !found && notFound != nil {
+		return notFound
+	}
+	return nil
+}
+
+// PruneBuildCache prunes the cache of every host down to keepBytes
+func (pc *PooledClient) PruneBuildCache(keepBytes int64) (uint64, error) {
+	var total uint64
+	var errs []error
+	for _, dc := range pc.hostClients() {
+		reclaimed, err := dc.PruneBuildCache(keepBytes)
+		total += reclaimed
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return total, errors.Join(errs...)
+}
+
+func (pc *PooledClient) InspectContainer(id string) (ContainerInfo, error) {
+	dc, err := pc.containerClient(id)
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+	return dc.InspectContainer(id)
+}
+
+// Host returns the address of the host a container runs on
+func (pc *PooledClient) Host(containerID string) string {
+	dc, err := pc.containerClient(containerID)
+	if err != nil {
+		return ""
+	}
+	return dc.Host(containerID)
+}
+
+// ListContainers lists the containers of every host
+func (pc *PooledClient) ListContainers(imagePrefixes ...string) ([]ContainerSummary, error) {
+	var all []ContainerSummary
+	for _, host := range pc.pool.Hosts() {
+		if host.State == ec2.HostProvisioning {
+			continue
+		}
+		dc, err := pc.client(host)
+		if err != nil {
+			return nil, err
+		}
+		containers, err := dc.ListContainers(imagePrefixes...)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", host.InstanceID, err)
+		}
+		for _, c := range containers {
+			pc.track(host.InstanceID, c.ID)
+		}
+		all = append(all, containers...)
+	}
+	return all, nil
+}
+
+// ListImages lists the images of every host, an image on several hosts once
+func (pc *PooledClient) ListImages(reference string) ([]ImageSummary, error) {
+	seen := make(map[string]bool)
+	var all []ImageSummary
+	for _, dc := range pc.hostClients() {
+		images, err := dc.ListImages(reference)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range images {
+			if !seen[img.ID] {
+				seen[img.ID] = true
+				all = append(all, img)
+			}
+		}
+	}
+	return all, nil
+}
+
+// ListCachedImages lists the build cache of every host, newest first. An image built on
+// several hosts is listed once, with its newest copy.
+func (pc *PooledClient) ListCachedImages() ([]CachedImage, error) {
+	newest := make(map[string]CachedImage)
+	for _, dc := range pc.hostClients() {
+		images, err := dc.ListCachedImages()
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range images {
+			if existing, ok := newest[img.Reference]; !ok || img.Created.After(existing.Created) {
+				newest[img.Reference] = img
+			}
+		}
+	}
+
+	cached := make([]CachedImage, 0, len(newest))
+	for _, img := range newest {
+		cached = append(cached, img)
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].Created.After(cached[j].Created) })
+	return cached, nil
+}
+
+// RoomNetworks returns the rooms with a network on any host
+func (pc *PooledClient) RoomNetworks() ([]string, error) {
+	seen := make(map[string]bool)
+	var rooms []string
+	for _, dc := range pc.hostClients() {
+		networks, err := dc.RoomNetworks()
+		if err != nil {
+			return nil, err
+		}
+		for _, room := range networks {
+			if !seen[room] {
+				seen[room] = true
+				rooms = append(rooms, room)
+			}
+		}
+	}
+	return rooms, nil
+}
+
+// StackVolumes returns the stack volumes of every host
+func (pc *PooledClient) StackVolumes() (map[string]string, error) {
+	all := make(map[string]string)
+	for _, dc := range pc.hostClients() {
+		volumes, err := dc.StackVolumes()
+		if err != nil {
+			return nil, err
+		}
+		for name, stack := range volumes {
+			all[name] = stack
+		}
+	}
+	return all, nil
+}
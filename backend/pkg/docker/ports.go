@@ -0,0 +1,78 @@
+package docker
+
+import (
+	"fmt"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// PortMapping is a container port published on the Docker host
+type PortMapping struct {
+	ContainerPort string `json:"container_port"` // Port and protocol inside the container, e.g. "3000/tcp"
+	HostPort      string `json:"host_port"`      // Port on the Docker host that forwards to it
+}
+
+// Host returns the address other services use to reach ports published by this client's daemon,
+// the same for every container
+func (dc *DockerClient) Host(containerID string) string {
+	if dc.publicIP != "" {
+		return dc.publicIP
+	}
+	return "127.0.0.1"
+}
+
+// ExposedPorts returns the ports an image declares with EXPOSE, lowest first
+func (dc *DockerClient) ExposedPorts(imageName string) ([]nat.Port, error) {
+	inspect, err := dc.cli.ImageInspect(dc.ctx, imageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+	}
+	if inspect.Config == nil {
+		return nil, nil
+	}
+
+	ports := make([]nat.Port, 0, len(inspect.Config.ExposedPorts))
+	for port := range inspect.Config.ExposedPorts {
+		ports = append(ports, port)
+	}
+	nat.Sort(ports, func(i, j nat.Port) bool {
+		return i.Int() < j.Int()
+	})
+	return ports, nil
+}
+
+// portBindings publishes every port on an ephemeral host port. Locally they are only
+// reachable from this machine; on EC2 the server reaches them over the instance's address,
+// and the host's security group lets nothing else in, see ec2.LaunchOptions.
+func (dc *DockerClient) portBindings(ports []nat.Port) nat.PortMap {
+	hostIP := "127.0.0.1"
+	if dc.publicIP != "" {
+		hostIP = ""
+	}
+
+	bindings := nat.PortMap{}
+	for _, port := range ports {
+		bindings[port] = []nat.PortBinding{{HostIP: hostIP, HostPort: ""}}
+	}
+	return bindings
+}
+
+// publishedPorts returns the host ports Docker assigned to a started container, in the order of ports
+func (dc *DockerClient) publishedPorts(containerID string, ports []nat.Port) ([]PortMapping, error) {
+	inspect, err := dc.cli.ContainerInspect(dc.ctx, containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+
+	var mappings []PortMapping
+	for _, port := range ports {
+		for _, binding := range inspect.NetworkSettings.Ports[port] {
+			mappings = append(mappings, PortMapping{
+				ContainerPort: string(port),
+				HostPort:      binding.HostPort,
+			})
+			break
+		}
+	}
+	return mappings, nil
+}
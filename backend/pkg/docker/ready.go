@@ -0,0 +1,161 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// DefaultReadyTimeout is how long WaitReady waits when no timeout is configured
+const DefaultReadyTimeout = 60 * time.Second
+
+const (
+	readyPollInterval = 500 * time.Millisecond
+	probeTimeout      = 2 * time.Second
+	runningGrace      = 3 * time.Second // How long a container without probes must stay up to count as ready
+)
+
+// ReadyState is the outcome of waiting for a container to become ready
+type ReadyState string
+
+const (
+	ReadyStateReady     ReadyState = "ready"     // The app is serving or its healthcheck passed
+	ReadyStateUnhealthy ReadyState = "unhealthy" // The image's HEALTHCHECK reports failure
+	ReadyStateExited    ReadyState = "exited"    // The container finished successfully, e.g. a CLI project
+	ReadyStateCrashed   ReadyState = "crashed"   // The container exited with a non-zero code
+	ReadyStateTimeout   ReadyState = "timed_out" // Nothing conclusive happened before the timeout
+)
+
+// ReadyStatus describes how a container started up
+type ReadyStatus struct {
+	State    ReadyState `json:"state"`
+	Probe    string     `json:"probe,omitempty"` // What established the state: healthcheck, http, tcp, running or exit
+	ExitCode int        `json:"exit_code,omitempty"`
+	Detail   string     `json:"detail,omitempty"`
+}
+
+// ReadyTimeout returns the readiness timeout configured with READY_TIMEOUT, e.g. "90s"
+func ReadyTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("READY_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return DefaultReadyTimeout
+}
+
+// WaitReady waits until a started container is ready to be used. The image's Docker
+// HEALTHCHECK is honored if it has one; otherwise the published ports are probed over
+// HTTP and then TCP, and a container without ports counts as ready once it stays up.
+// An early exit is reported as soon as it is noticed.
+func (dc *DockerClient) WaitReady(containerID string, ports []PortMapping, timeout time.Duration) (ReadyStatus, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		inspect, err := dc.cli.ContainerInspect(dc.ctx, containerID)
+		if err != nil {
+			return ReadyStatus{}, fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+		}
+
+		if status, done := checkState(inspect.State, ports, dc.Host(containerID)); done {
+			return status, nil
+		}
+
+		if time.Now().After(deadline) {
+			return ReadyStatus{
+				State:  ReadyStateTimeout,
+				Detail: fmt.Sprintf("container did not become ready within %s", timeout),
+			}, nil
+		}
+		time.Sleep(readyPollInterval)
+	}
+}
+
+// checkState reports whether the container's state is conclusive and what it is
+func checkState(state *container.State, ports []PortMapping, host string) (ReadyStatus, bool) {
+	if state == nil {
+		return ReadyStatus{}, false
+	}
+
+	if !state.Running && (state.Status == "exited" || state.Status == "dead") {
+		status := ReadyStatus{State: ReadyStateCrashed, Probe: "exit", ExitCode: state.ExitCode, Detail: state.Error}
+		if state.ExitCode == 0 && !state.OOMKilled {
+			status.State = ReadyStateExited
+		}
+		if state.OOMKilled {
+			status.Detail = "container was killed for running out of memory"
+		}
+		return status, true
+	}
+	if !state.Running {
+		return ReadyStatus{}, false
+	}
+
+	if state.Health != nil {
+		switch state.Health.Status {
+		case container.Healthy:
+			return ReadyStatus{State: ReadyStateReady, Probe: "healthcheck"}, true
+		case container.Unhealthy:
+			status := ReadyStatus{State: ReadyStateUnhealthy, Probe: "healthcheck"}
+			if n := len(state.Health.Log); n > 0 {
+				status.Detail = state.Health.Log[n-1].Output
+			}
+			return status, true
+		}
+		return ReadyStatus{}, false
+	}
+
+	for _, port := range ports {
+		addr := net.JoinHostPort(host, port.HostPort)
+		if probeHTTP(addr) {
+			return ReadyStatus{State: ReadyStateReady, Probe: "http", Detail: port.ContainerPort}, true
+		}
+		if probeTCP(addr) {
+			return ReadyStatus{State: ReadyStateReady, Probe: "tcp", Detail: port.ContainerPort}, true
+		}
+	}
+	if len(ports) > 0 {
+		return ReadyStatus{}, false
+	}
+
+	startedAt, err := time.Parse(time.RFC3339Nano, state.StartedAt)
+	if err == nil && time.Since(startedAt) >= runningGrace {
+		return ReadyStatus{State: ReadyStateReady, Probe: "running"}, true
+	}
+	return ReadyStatus{}, false
+}
+
+// probeHTTP reports whether anything answers HTTP on addr, whatever the status code
+func probeHTTP(addr string) bool {
+	client := http.Client{
+		Timeout: probeTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get("http://" + addr + "/")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// probeTCP reports whether a non-HTTP server is listening on addr. Docker's port proxy
+// accepts connections even when nothing listens in the container and then closes them
+// right away, so a connection only counts if it stays open or the server speaks first.
+func probeTCP(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	return err == nil || (errors.As(err, &netErr) && netErr.Timeout())
+}
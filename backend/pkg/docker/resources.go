@@ -0,0 +1,173 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// DefaultResourceProfile is used for rooms that do not ask for a profile
+const DefaultResourceProfile = "medium"
+
+// resourceProfileLabel records on a container which profile it was started with
+const resourceProfileLabel = "k0.resource-profile"
+
+const cpuPeriod = 100000 // Microseconds, the CFS default
+
+// ResourceProfile caps what a single room may use on the shared host. Zero fields are unlimited.
+type ResourceProfile struct {
+	Name         string  `json:"name"`
+	CPUs         float64 `json:"cpus"`          // Number of cores, e.g. 0.5
+	MemoryBytes  int64   `json:"memory_bytes"`  // Hard memory limit
+	SwapBytes    int64   `json:"swap_bytes"`    // Swap allowed on top of MemoryBytes
+	PIDs         int64   `json:"pids"`          // Maximum number of processes and threads
+	StorageBytes int64   `json:"storage_bytes"` // Size of the writable layer, needs a storage driver that supports it
+}
+
+// resourceProfiles are the built-in profiles, see LoadResourceProfiles to change them
+var resourceProfiles = map[string]ResourceProfile{
+	"small": {
+		Name:         "small",
+		CPUs:         0.5,
+		MemoryBytes:  512 << 20,
+		PIDs:         256,
+		StorageBytes: 2 << 30,
+	},
+	"medium": {
+		Name:         "medium",
+		CPUs:         1,
+		MemoryBytes:  1 << 30,
+		SwapBytes:    512 << 20,
+		PIDs:         512,
+		StorageBytes: 5 << 30,
+	},
+	"large": {
+		Name:         "large",
+		CPUs:         2,
+		MemoryBytes:  2 << 30,
+		SwapBytes:    1 << 30,
+		PIDs:         1024,
+		StorageBytes: 10 << 30,
+	},
+}
+
+// LoadResourceProfiles adds the profiles in a JSON file, an array of ResourceProfile, replacing
+// built-in profiles with the same name
+func LoadResourceProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read resource profiles: %w", err)
+	}
+
+	var profiles []ResourceProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("failed to parse resource profiles %s: %w", path, err)
+	}
+	for _, p := range profiles {
+		if p.Name == "" {
+			return fmt.Errorf("resource profile without a name in %s", path)
+		}
+		resourceProfiles[p.Name] = p
+	}
+	return nil
+}
+
+// LookupResourceProfile returns the profile with the given name, DefaultResourceProfile if name is empty
+func LookupResourceProfile(name string) (ResourceProfile, error) {
+	if name == "" {
+		name = DefaultResourceProfile
+	}
+	p, ok := resourceProfiles[name]
+	if !ok {
+		return ResourceProfile{}, fmt.Errorf("unknown resource profile %q", name)
+	}
+	return p, nil
+}
+
+// ResourceProfiles returns every known profile, smallest first
+func ResourceProfiles() []ResourceProfile {
+	profiles := make([]ResourceProfile, 0, len(resourceProfiles))
+	for _, p := range resourceProfiles {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		if profiles[i].MemoryBytes != profiles[j].MemoryBytes {
+			return profiles[i].MemoryBytes < profiles[j].MemoryBytes
+		}
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles
+}
+
+// storageLimitsEnabled reports whether the daemon can limit the size of a container's writable
+// layer. Docker only supports it on overlay2 over xfs with project quotas, so it is opt in.
+func storageLimitsEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("CONTAINER_STORAGE_LIMITS"))
+	return enabled
+}
+
+func (p ResourceProfile) cpuQuota() int64 {
+	return int64(p.CPUs * cpuPeriod)
+}
+
+func (p ResourceProfile) memorySwap() int64 {
+	if p.MemoryBytes == 0 {
+		return 0
+	}
+	// Docker's MemorySwap is memory plus swap
+	return p.MemoryBytes + p.SwapBytes
+}
+
+// hostResources returns the cgroup limits of the profile
+func (p ResourceProfile) hostResources() container.Resources {
+	r := container.Resources{
+		Memory:     p.MemoryBytes,
+		MemorySwap: p.memorySwap(),
+	}
+	if p.CPUs > 0 {
+		r.CPUPeriod = cpuPeriod
+		r.CPUQuota = p.cpuQuota()
+	}
+	if p.PIDs > 0 {
+		pids := p.PIDs
+		r.PidsLimit = &pids
+	}
+	return r
+}
+
+// storageOpt returns the storage driver options limiting the writable layer, if enabled
+func (p ResourceProfile) storageOpt() map[string]string {
+	if p.StorageBytes == 0 || !storageLimitsEnabled() {
+		return nil
+	}
+	return map[string]string{"size": strconv.FormatInt(p.StorageBytes, 10)}
+}
+
+// resourceLimits reads back the limits a container was created with
+func resourceLimits(labels map[string]string, host *container.HostConfig) ResourceProfile {
+	p := ResourceProfile{Name: labels[resourceProfileLabel]}
+	if host == nil {
+		return p
+	}
+
+	p.MemoryBytes = host.Memory
+	if host.MemorySwap > host.Memory {
+		p.SwapBytes = host.MemorySwap - host.Memory
+	}
+	if host.CPUQuota > 0 && host.CPUPeriod > 0 {
+		p.CPUs = float64(host.CPUQuota) / float64(host.CPUPeriod)
+	} else if host.NanoCPUs > 0 {
+		p.CPUs = float64(host.NanoCPUs) / 1e9
+	}
+	if host.PidsLimit != nil {
+		p.PIDs = *host.PidsLimit
+	}
+	if size, ok := host.StorageOpt["size"]; ok {
+		p.StorageBytes, _ = strconv.ParseInt(size, 10, 64)
+	}
+	return p
+}
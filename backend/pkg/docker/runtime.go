@@ -0,0 +1,51 @@
+package docker
+
+import (
+	"io"
+	"time"
+)
+
+// Runtime builds repositories into images and runs them for rooms. DockerClient implements it
+// against a Docker daemon; dockertest.Runtime is an in-memory fake for running the server
+// without one.
+type Runtime interface {
+	// Build
+	BuildImageFromGitHub(githubURL string, opts BuildOptions) (BuildResult, error)
+
+	// Start
+	StartContainer(imageName string, opts StartOptions) (TerminalResponse, error)
+	StartStack(stackName string, project *ComposeProject, opts StartOptions) (StackResponse, error)
+	WaitReady(containerID string, ports []PortMapping, timeout time.Duration) (ReadyStatus, error)
+
+	// Logs, streamed like CopyLogs expects
+	FollowLogs(containerID string, since time.Time) (io.ReadCloser, error)
+	FollowStackLogs(services []StackService, since time.Time) (io.ReadCloser, error)
+
+	// Exec
+	ExecShell(containerID string, cols, rows uint) (*ExecSession, error)
+	ResizeExec(execID string, cols, rows uint) error
+
+	// Stop
+	StopContainer(id string) error
+	RestartContainer(id string) error
+
+	// Remove
+	RemoveContainer(id string) error
+	RemoveStack(stackName string, services []StackService) error
+	RemoveImage(imageName string) error
+	RemoveRoomNetwork(roomID string) error
+	RemoveStackVolume(name string) error
+	RemoveCachedImage(reference string) error
+	PruneBuildCache(keepBytes int64) (uint64, error)
+
+	// Inspect
+	InspectContainer(id string) (ContainerInfo, error)
+	Host(containerID string) string // Address the container's published ports are reachable on
+	ListContainers(imagePrefixes ...string) ([]ContainerSummary, error)
+	ListImages(reference string) ([]ImageSummary, error)
+	ListCachedImages() ([]CachedImage, error)
+	RoomNetworks() ([]string, error)
+	StackVolumes() (map[string]string, error)
+}
+
+var _ Runtime = (*DockerClient)(nil)
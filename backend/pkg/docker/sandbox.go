@@ -0,0 +1,224 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// defaultSandboxUser is who untrusted code runs as when the image would run it as root
+const defaultSandboxUser = "65534:65534"
+
+// ErrPrivilegedImage is returned for images that cannot work without privileges the sandbox withholds
+var ErrPrivilegedImage = errors.New("image needs privileged features")
+
+// PrivilegedImageError explains why an image was refused
+type PrivilegedImageError struct {
+	Image   string
+	Reasons []string
+}
+
+func (e *PrivilegedImageError) Error() string {
+	return fmt.Sprintf("%s: %s needs privileges the sandbox does not grant: %s",
+		ErrPrivilegedImage, e.Image, strings.Join(e.Reasons, "; "))
+}
+
+func (e *PrivilegedImageError) Unwrap() error {
+	return ErrPrivilegedImage
+}
+
+// SandboxConfig is the hardened profile containers running candidate code are started with
+type SandboxConfig struct {
+	Disabled       bool     // Run with Docker defaults, only meant for local development
+	Runtime        string   // OCI runtime such as runsc, Docker's default if empty
+	SeccompProfile string   // JSON seccomp profile, Docker's default profile if empty
+	User           string   // User for images that would run as root
+	ReadOnlyRootfs bool     // Mount the image read-only, with tmpfs scratch space at TmpfsPaths
+	TmpfsPaths     []string // Writable scratch directories
+	TmpfsSize      string   // Size of each scratch directory, e.g. "256m"
+	ServiceImages  []string // Images compose services may run with their own user, see applyService
+}
+
+// defaultServiceImages are the databases and caches compose files commonly pull. Their
+// entrypoints prepare data directories as root and then drop to their own user.
+var defaultServiceImages = []string{
+	"postgres", "mysql", "mariadb", "mongo", "redis", "valkey/valkey", "memcached", "rabbitmq",
+}
+
+// SandboxFromEnv reads the sandbox profile from the environment:
+//
+//	SANDBOX_DISABLED=true             run with Docker defaults
+//	SANDBOX_RUNTIME=runsc             OCI runtime to use
+//	SANDBOX_SECCOMP_PROFILE=path      seccomp profile JSON file
+//	SANDBOX_USER=65534:65534          user for images that run as root
+//	SANDBOX_READ_ONLY=false           keep the root filesystem writable
+//	SANDBOX_TMPFS=/tmp,/run           writable scratch directories
+//	SANDBOX_TMPFS_SIZE=256m           size of each scratch directory
+//	SANDBOX_SERVICE_IMAGES=postgres   images compose services may run as their own user
+func SandboxFromEnv() (SandboxConfig, error) {
+	cfg := SandboxConfig{
+		Runtime:        os.Getenv("SANDBOX_RUNTIME"),
+		User:           os.Getenv("SANDBOX_USER"),
+		ReadOnlyRootfs: true,
+		TmpfsPaths:     []string{"/tmp", "/var/tmp", "/run"},
+		TmpfsSize:      os.Getenv("SANDBOX_TMPFS_SIZE"),
+		ServiceImages:  defaultServiceImages,
+	}
+	cfg.Disabled, _ = strconv.ParseBool(os.Getenv("SANDBOX_DISABLED"))
+	if readOnly, err := strconv.ParseBool(os.Getenv("SANDBOX_READ_ONLY")); err == nil {
+		cfg.ReadOnlyRootfs = readOnly
+	}
+	if paths := os.Getenv("SANDBOX_TMPFS"); paths != "" {
+		cfg.TmpfsPaths = strings.Split(paths, ",")
+	}
+	if images := os.Getenv("SANDBOX_SERVICE_IMAGES"); images != "" {
+		cfg.ServiceImages = strings.Split(images, ",")
+	}
+	if cfg.User == "" {
+		cfg.User = defaultSandboxUser
+	}
+	if cfg.TmpfsSize == "" {
+		cfg.TmpfsSize = "256m"
+	}
+
+	// The API takes the profile itself rather than a path
+	if path := os.Getenv("SANDBOX_SECCOMP_PROFILE"); path != "" {
+		profile, err := os.ReadFile(path)
+		if err != nil {
+			return SandboxConfig{}, fmt.Errorf("failed to read seccomp profile: %w", err)
+		}
+		cfg.SeccompProfile = string(profile)
+	}
+	return cfg, nil
+}
+
+// apply hardens the configuration of a container about to be created from an image
+// whose default user is imageUser
+func (s SandboxConfig) apply(config *container.Config, host *container.HostConfig, imageUser string) {
+	if s.Disabled {
+		return
+	}
+
+	host.CapDrop = []string{"ALL"}
+	host.SecurityOpt = append(host.SecurityOpt, "no-new-privileges")
+	if s.SeccompProfile != "" {
+		host.SecurityOpt = append(host.SecurityOpt, "seccomp="+s.SeccompProfile)
+	}
+	host.Runtime = s.Runtime
+
+	if s.ReadOnlyRootfs {
+		host.ReadonlyRootfs = true
+		host.Tmpfs = make(map[string]string, len(s.TmpfsPaths))
+		for _, path := range s.TmpfsPaths {
+			host.Tmpfs[strings.TrimSpace(path)] = "rw,nosuid,nodev,size=" + s.TmpfsSize
+		}
+	}
+
+	if isRootUser(imageUser) {
+		config.User = s.User
+		// Whoever we run as has no home directory in the image
+		config.Env = append(config.Env, "HOME=/tmp")
+	}
+}
+
+// applyService hardens a compose service running one of ServiceImages. It keeps the image's
+// user and a writable root filesystem, and only the capabilities needed to drop to that user.
+func (s SandboxConfig) applyService(host *container.HostConfig) {
+	if s.Disabled {
+		return
+	}
+
+	host.CapDrop = []string{"ALL"}
+	host.CapAdd = []string{"CHOWN", "DAC_OVERRIDE", "FOWNER", "SETUID", "SETGID"}
+	host.SecurityOpt = append(host.SecurityOpt, "no-new-privileges")
+	if s.SeccompProfile != "" {
+		host.SecurityOpt = append(host.SecurityOpt, "seccomp="+s.SeccompProfile)
+	}
+	host.Runtime = s.Runtime
+}
+
+// trustsServiceImage reports whether image is one of ServiceImages, whatever its tag
+func (s SandboxConfig) trustsServiceImage(image string) bool {
+	repository := strings.TrimPrefix(image, "docker.io/")
+	repository = strings.TrimPrefix(repository, "library/")
+	repository, _, _ = strings.Cut(repository, "@")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	for _, trusted := range s.ServiceImages {
+		if strings.TrimSpace(trusted) == repository {
+			return true
+		}
+	}
+	return false
+}
+
+func isRootUser(user string) bool {
+	name, _, _ := strings.Cut(user, ":")
+	return name == "" || name == "root" || name == "0"
+}
+
+// privilegedFeatures lists what an image would need the sandbox to grant, judging by its
+// configuration. It cannot catch everything, but explains the common cases up front instead
+// of letting them fail in confusing ways at runtime.
+func privilegedFeatures(volumes map[string]struct{}, command []string, stopSignal string) []string {
+	var reasons []string
+
+	paths := make([]string, 0, len(volumes))
+	for volume := range volumes {
+		paths = append(paths, volume)
+	}
+	sort.Strings(paths)
+	for _, volume := range paths {
+		switch {
+		case volume == "/var/lib/docker":
+			reasons = append(reasons, "it runs a Docker daemon (volume /var/lib/docker)")
+		case volume == "/var/run/docker.sock" || volume == "/run/docker.sock":
+			reasons = append(reasons, "it expects the host's Docker socket at "+volume)
+		case strings.HasPrefix(volume, "/sys/fs/cgroup"):
+			reasons = append(reasons, "it manages cgroups (volume "+volume+")")
+		case strings.HasPrefix(volume, "/dev"):
+			reasons = append(reasons, "it needs host devices (volume "+volume+")")
+		}
+	}
+
+	if len(command) > 0 {
+		switch base := command[0][strings.LastIndex(command[0], "/")+1:]; base {
+		case "dockerd", "dockerd-entrypoint.sh":
+			reasons = append(reasons, "it starts a Docker daemon")
+		case "init", "systemd":
+			reasons = append(reasons, "it boots an init system ("+command[0]+")")
+		}
+	}
+
+	if stopSignal == "SIGRTMIN+3" {
+		reasons = append(reasons, "it is stopped like systemd (SIGRTMIN+3)")
+	}
+
+	return reasons
+}
+
+// sandboxImage refuses images the sandbox cannot run and returns the user the image runs as
+func (dc *DockerClient) sandboxImage(imageName string) (string, error) {
+	inspect, err := dc.cli.ImageInspect(dc.ctx, imageName)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+	}
+	if inspect.Config == nil {
+		return "", nil
+	}
+	if dc.sandbox.Disabled {
+		return inspect.Config.User, nil
+	}
+
+	command := append(append([]string{}, inspect.Config.Entrypoint...), inspect.Config.Cmd...)
+	if reasons := privilegedFeatures(inspect.Config.Volumes, command, inspect.Config.StopSignal); len(reasons) > 0 {
+		return "", &PrivilegedImageError{Image: imageName, Reasons: reasons}
+	}
+	return inspect.Config.User, nil
+}
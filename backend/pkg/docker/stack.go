@@ -0,0 +1,368 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+)
+
+const (
+	stackLabel   = "k0.stack"
+	serviceLabel = "k0.service"
+)
+
+// StackService is a container of a running compose stack
+type StackService struct {
+	Name        string        `json:"name"`
+	ContainerID string        `json:"container_id"`
+	Image       string        `json:"image"`
+	Ports       []PortMapping `json:"ports"`
+}
+
+// StackResponse is a started compose stack
+type StackResponse struct {
+	TerminalResponse                // The primary service, with the logs of every service as Result
+	Services         []StackService // In start order
+}
+
+// StackVolumeName is the Docker volume backing a named volume of a stack
+func StackVolumeName(stackName, name string) string {
+	return stackName + "_" + name
+}
+
+// StartStack starts every service of a compose project on the room's network, each after
+// the services it depends on meet their condition. Services reach each other by name.
+// The primary service is the last one started that publishes ports, which is usually the
+// app in front of the others; the preview and terminal use it.
+func (dc *DockerClient) StartStack(stackName string, project *ComposeProject, opts StartOptions) (StackResponse, error) {
+	if opts.RoomID == "" {
+		return StackResponse{}, fmt.Errorf("compose stacks need a room network")
+	}
+	order, err := project.StartOrder()
+	if err != nil {
+		return StackResponse{}, err
+	}
+
+	policy, err := ParseEgressPolicy(string(opts.Egress))
+	if err != nil {
+		return StackResponse{}, err
+	}
+	networkName, proxyEnv, err := dc.roomNetwork(opts.RoomID, policy)
+	if err != nil {
+		return StackResponse{}, err
+	}
+
+	for _, name := range project.Volumes {
+		_, err := dc.cli.VolumeCreate(dc.ctx, volume.CreateOptions{
+			Name:   StackVolumeName(stackName, name),
+			Labels: map[string]string{stackLabel: stackName, roomLabel: opts.RoomID},
+		})
+		if err != nil {
+			dc.RemoveStack(stackName, nil)
+			return StackResponse{}, fmt.Errorf("failed to create volume %s: %w", name, err)
+		}
+	}
+
+	var services []StackService
+	fail := func(err error) (StackResponse, error) {
+		dc.RemoveStack(stackName, services)
+		return StackResponse{}, err
+	}
+
+	for _, name := range order {
+		service := project.Services[name]
+		for dependency, condition := range service.DependsOn {
+			if err := dc.waitCondition(services, dependency, condition); err != nil {
+				return fail(fmt.Errorf("service %s: %w", name, err))
+			}
+		}
+
+		started, err := dc.startService(stackName, service, opts, policy, networkName, proxyEnv)
+		if err != nil {
+			return fail(fmt.Errorf("failed to start service %s: %w", name, err))
+		}
+		services = append(services, started)
+	}
+
+	primary := services[len(services)-1]
+	for _, s := range services {
+		if len(s.Ports) > 0 {
+			primary = s
+		}
+	}
+
+	logs, err := dc.FollowStackLogs(services, time.Time{})
+	if err != nil {
+		return fail(err)
+	}
+	return StackResponse{
+		TerminalResponse: TerminalResponse{ID: primary.ContainerID, Result: logs, Ports: primary.Ports},
+		Services:         services,
+	}, nil
+}
+
+// startService creates and starts the container of one service
+func (dc *DockerClient) startService(stackName string, service *ComposeService, opts StartOptions, policy EgressPolicy, networkName string, proxyEnv []string) (StackService, error) {
+	imageUser, err := dc.sandboxImage(service.Image)
+	if err != nil {
+		return StackService{}, err
+	}
+
+	exposed := nat.PortSet{}
+	for _, port := range service.Ports {
+		exposed[port] = struct{}{}
+	}
+	config := &container.Config{
+		Image:        service.Image,
+		Cmd:          service.Command,
+		Entrypoint:   service.Entrypoint,
+		Env:          append(append([]string{}, service.Environment...), proxyEnv...),
+		WorkingDir:   service.WorkingDir,
+		User:         service.User,
+		Healthcheck:  service.Healthcheck,
+		ExposedPorts: exposed,
+		Labels: map[string]string{
+			resourceProfileLabel: opts.Resources.Name,
+			roomLabel:            opts.RoomID,
+			egressLabel:          string(policy),
+			stackLabel:           stackName,
+			serviceLabel:         service.Name,
+		},
+	}
+	hostConfig := &container.HostConfig{
+		NetworkMode:  container.NetworkMode(networkName),
+		PortBindings: dc.portBindings(service.Ports),
+		Resources:    opts.Resources.hostResources(),
+		StorageOpt:   opts.Resources.storageOpt(),
+	}
+	for _, v := range service.Volumes {
+		m := mount.Mount{Type: mount.TypeVolume, Target: v.Target, ReadOnly: v.ReadOnly}
+		if v.Name != "" {
+			m.Source = StackVolumeName(stackName, v.Name)
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, m)
+	}
+
+	// Images built from the repository are candidate code. Well-known infrastructure images
+	// keep their own user so their entrypoints can set up data directories.
+	user := imageUser
+	if service.User != "" {
+		user = service.User
+	}
+	if service.Build == nil && dc.sandbox.trustsServiceImage(service.Image) {
+		dc.sandbox.applyService(hostConfig)
+	} else {
+		dc.sandbox.apply(config, hostConfig, user)
+	}
+
+	resp, err := dc.cli.ContainerCreate(dc.ctx, config, hostConfig, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			networkName: {Aliases: []string{service.Name}},
+		},
+	}, nil, "")
+	if err != nil {
+		return StackService{}, fmt.Errorf("failed to create container: %w", err)
+	}
+	started := StackService{Name: service.Name, ContainerID: resp.ID, Image: service.Image}
+
+	if err := dc.cli.ContainerStart(dc.ctx, resp.ID, container.StartOptions{}); err != nil {
+		dc.RemoveContainer(resp.ID)
+		return StackService{}, fmt.Errorf("failed to start container: %w", err)
+	}
+	if started.Ports, err = dc.publishedPorts(resp.ID, service.Ports); err != nil {
+		dc.RemoveContainer(resp.ID)
+		return StackService{}, err
+	}
+	return started, nil
+}
+
+// waitCondition waits until a started service meets a depends_on condition
+func (dc *DockerClient) waitCondition(services []StackService, name, condition string) error {
+	if condition == ConditionStarted {
+		return nil
+	}
+	var containerID string
+	for _, s := range services {
+		if s.Name == name {
+			containerID = s.ContainerID
+		}
+	}
+
+	deadline := time.Now().Add(ReadyTimeout())
+	for {
+		inspect, err := dc.cli.ContainerInspect(dc.ctx, containerID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect service %s: %w", name, err)
+		}
+		state := inspect.State
+
+		switch condition {
+		case ConditionHealthy:
+			if state.Health == nil {
+				return fmt.Errorf("service %s has no healthcheck to wait for", name)
+			}
+			if state.Health.Status == container.Healthy {
+				return nil
+			}
+			if !state.Running {
+				return fmt.Errorf("service %s exited with code %d before becoming healthy", name, state.ExitCode)
+			}
+		case ConditionCompleted:
+			if !state.Running && state.Status == "exited" {
+				if state.ExitCode != 0 {
+					return fmt.Errorf("service %s exited with code %d", name, state.ExitCode)
+				}
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for service %s to be %s", name, strings.TrimPrefix(condition, "service_"))
+		}
+		time.Sleep(readyPollInterval)
+	}
+}
+
+// FollowStackLogs merges the logs of every service into one stream, each line prefixed with
+// the name of its service. The stream is framed like a single container's, see CopyLogs.
+func (dc *DockerClient) FollowStackLogs(services []StackService, since time.Time) (io.ReadCloser, error) {
+	width := 0
+	for _, s := range services {
+		width = max(width, len(s.Name))
+	}
+
+	pr, pw := io.Pipe()
+	merged := &stackLogs{PipeReader: pr}
+	var wg sync.WaitGroup
+	for _, s := range services {
+		logs, err := dc.FollowLogs(s.ContainerID, since)
+		if err != nil {
+			merged.Close()
+			return nil, fmt.Errorf("failed to follow logs of service %s: %w", s.Name, err)
+		}
+		merged.streams = append(merged.streams, logs)
+
+		prefix := []byte(fmt.Sprintf("%-*s | ", width, s.Name))
+		stdout := &linePrefixer{prefix: prefix, w: stdcopy.NewStdWriter(pw, stdcopy.Stdout)}
+		stderr := &linePrefixer{prefix: prefix, w: stdcopy.NewStdWriter(pw, stdcopy.Stderr)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			CopyLogs(stdout, stderr, logs)
+			stdout.Flush()
+			stderr.Flush()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		pw.Close()
+	}()
+	return merged, nil
+}
+
+// stackLogs closes the log stream of every service along with the merged stream
+type stackLogs struct {
+	*io.PipeReader
+	streams []io.ReadCloser
+}
+
+func (l *stackLogs) Close() error {
+	for _, s := range l.streams {
+		s.Close()
+	}
+	return l.PipeReader.Close()
+}
+
+// linePrefixer writes whole lines to w, each starting with prefix
+type linePrefixer struct {
+	prefix []byte
+	w      io.Writer
+	buf    []byte
+}
+
+func (l *linePrefixer) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := l.writeLine(l.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes what is left of an unterminated last line
+func (l *linePrefixer) Flush() error {
+	if len(l.buf) == 0 {
+		return nil
+	}
+	err := l.writeLine(append(l.buf, '\n'))
+	l.buf = nil
+	return err
+}
+
+func (l *linePrefixer) writeLine(line []byte) error {
+	_, err := l.w.Write(append(append([]byte{}, l.prefix...), line...))
+	return err
+}
+
+// RemoveStack removes the containers of a stack, last started first, and its volumes
+func (dc *DockerClient) RemoveStack(stackName string, services []StackService) error {
+	var firstErr error
+	for i := len(services) - 1; i >= 0; i-- {
+		if err := dc.RemoveContainer(services[i].ContainerID); err != nil && !errdefs.IsNotFound(err) && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove service %s: %w", services[i].Name, err)
+		}
+	}
+
+	volumes, err := dc.StackVolumes()
+	if err != nil {
+		return err
+	}
+	for name, stack := range volumes {
+		if stack != stackName {
+			continue
+		}
+		if err := dc.cli.VolumeRemove(dc.ctx, name, true); err != nil && !errdefs.IsNotFound(err) && firstErr == nil {
+			firstErr = fmt.Errorf("failed to remove volume %s: %w", name, err)
+		}
+	}
+	return firstErr
+}
+
+// RemoveStackVolume removes a volume created for a stack
+func (dc *DockerClient) RemoveStackVolume(name string) error {
+	return dc.cli.VolumeRemove(dc.ctx, name, true)
+}
+
+// StackVolumes returns the volumes created for stacks and the stack each belongs to
+func (dc *DockerClient) StackVolumes() (map[string]string, error) {
+	list, err := dc.cli.VolumeList(dc.ctx, volume.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", stackLabel)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stack volumes: %w", err)
+	}
+
+	volumes := make(map[string]string, len(list.Volumes))
+	for _, v := range list.Volumes {
+		volumes[v.Name] = v.Labels[stackLabel]
+	}
+	return volumes, nil
+}
@@ -35,7 +35,69 @@ func NewEC2Client() (*EC2Client, error) {
 	}, nil
 }
 
+// LaunchOptions describes a sandbox Docker host to launch
+type LaunchOptions struct {
+	Name            string
+	ImageID         string
+	InstanceType    string // t3.micro if empty
+	SubnetID        string
+	SecurityGroupID string            // Replaced by the DockerSandbox group, created if needed
+	Tags            map[string]string // Set on the instance as it is launched, along with Name
+
+	// Where the backend connects from, the only source allowed to reach the Docker API, SSH and
+	// ports published by containers. At least one is required.
+	BackendCIDR            string // e.g. the backend's IP as 203.0.113.7/32
+	BackendSecurityGroupID string // Security group of a backend in the same VPC
+}
+
+// CreateInstance launches a sandbox Docker host and waits for it to be ready
 func (c *EC2Client) CreateInstance(name, imageID, instanceType, subnetID, securityGroupID string) (string, error) {
+	instanceID, err := c.LaunchInstance(LaunchOptions{
+		Name:            name,
+		ImageID:         imageID,
+		InstanceType:    instanceType,
+		SubnetID:        subnetID,
+		SecurityGroupID: securityGroupID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Wait for instance to be ready and logs to be available
+	if err := c.WaitForInstanceReady(instanceID); err != nil {
+		// Get instance state before terminating
+		describeResult, err := c.DescribeInstance(instanceID)
+		if err == nil && len(describeResult.Reservations) > 0 && len(describeResult.Reservations[0].Instances) > 0 {
+			instance := describeResult.Reservations[0].Instances[0]
+			fmt.Printf("Instance state: %s\n", instance.State.Name)
+			fmt.Printf("Instance type: %s\n", instance.InstanceType)
+			fmt.Printf("Platform: %s\n", instance.Platform)
+			if instance.PublicIpAddress != nil {
+				fmt.Printf("Public IP: %s\n", *instance.PublicIpAddress)
+			}
+		}
+		return instanceID, fmt.Errorf("instance failed to initialize: %v", err)
+	}
+
+	// Get and print the system logs
+	logs, err := c.GetInstanceLogs(instanceID)
+	if err != nil {
+		fmt.Printf("Warning: Failed to get system logs: %v\n", err)
+	} else {
+		fmt.Println("System logs:")
+		fmt.Println(logs)
+	}
+	return instanceID, nil
+}
+
+// LaunchInstance launches a sandbox Docker host without waiting for it. Docker listens on
+// port 2375 once its user data script has run.
+func (c *EC2Client) LaunchInstance(opts LaunchOptions) (string, error) {
+	imageID, subnetID, securityGroupID := opts.ImageID, opts.SubnetID, opts.SecurityGroupID
+	if opts.BackendCIDR == "" && opts.BackendSecurityGroupID == "" {
+		return "", fmt.Errorf("a backend CIDR or security group is required, only the backend may reach sandbox hosts")
+	}
+
 	// Use the provided AMI ID
 	fmt.Printf("Using AMI: %s (Amazon Linux 2)\n", imageID)
 
@@ -113,42 +175,9 @@ func (c *EC2Client) CreateInstance(name, imageID, instanceType, subnetID, securi
 		securityGroupID = *sgResult.GroupId
 	}
 
-	// Add inbound rule for Docker daemon
-	_, err = c.client.AuthorizeSecurityGroupIngress(c.ctx, &ec2.AuthorizeSecurityGroupIngressInput{
-		GroupId: aws.String(securityGroupID),
-		IpPermissions: []types.IpPermission{
-			{
-				FromPort:   aws.Int32(2375),
-				ToPort:     aws.Int32(2375),
-				IpProtocol: aws.String("tcp"),
-				IpRanges: []types.IpRange{
-					{
-						CidrIp: aws.String("0.0.0.0/0"),
-					},
-				},
-			},
-			// Add SSH access
-			{
-				FromPort:   aws.Int32(22),
-				ToPort:     aws.Int32(22),
-				IpProtocol: aws.String("tcp"),
-				IpRanges: []types.IpRange{
-					{
-						CidrIp: aws.String("0.0.0.0/0"),
-					},
-				},
-			},
-		},
-	})
-	if err != nil {
-		// Check if the error is about duplicate rules
-		var apiErr smithy.APIError
-		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPermission.Duplicate" {
-			// Ignore duplicate rule error
-			fmt.Println("Security group rule already exists, continuing...")
-		} else {
-			return "", fmt.Errorf("failed to authorize security group ingress: %v", err)
-		}
+	// The Docker API is unauthenticated, only the backend may reach it or any other port
+	if err := c.authorizeBackend(securityGroupID, opts); err != nil {
+		return "", err
 	}
 
 	userData := `#!/bin/bash
@@ -195,29 +224,80 @@ EOF
 systemctl daemon-reload
 systemctl restart docker >> /var/log/user-data-start.log 2>&1
 
+# Room containers must not reach the host itself, where the Docker API listens, nor the
+# instance metadata endpoint. Disabling masquerading on room networks does not cover either.
+# docker0 is the default bridge, br-* are the room networks.
+cat > /usr/local/sbin/k0-firewall << 'FIREWALL'
+#!/bin/bash
+set -e
+rule() { iptables -C "$@" 2>/dev/null || iptables -I "$@"; }
+for bridge in docker0 br-+; do
+    rule INPUT -i "$bridge" -j DROP
+    # Answers to connections the host opened, e.g. docker-proxy forwarding a published port
+    rule INPUT -i "$bridge" -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+    rule DOCKER-USER -i "$bridge" -d 169.254.169.254 -j DROP
+done
+FIREWALL
+chmod 755 /usr/local/sbin/k0-firewall
+
+# Applied again whenever Docker starts, as Docker recreates its chains
+cat > /etc/systemd/system/k0-firewall.service << EOF
+[Unit]
+Description=Keep K0 room containers away from the host
+After=docker.service
+PartOf=docker.service
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/usr/local/sbin/k0-firewall
+
+[Install]
+WantedBy=docker.service
+EOF
+systemctl daemon-reload
+systemctl enable --now k0-firewall >> /var/log/user-data-start.log 2>&1
+
 echo "User data script completed" >> /var/log/user-data-start.log
 `
 
 	encodedUserData := base64.StdEncoding.EncodeToString([]byte(userData))
 
+	instanceType := types.InstanceTypeT3Micro
+	if opts.InstanceType != "" {
+		instanceType = types.InstanceType(opts.InstanceType)
+	}
+	tags := []types.Tag{
+		{
+			Key:   aws.String("Name"),
+			Value: aws.String(opts.Name),
+		},
+	}
+	for key, value := range opts.Tags {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+
 	input := &ec2.RunInstancesInput{
 		ImageId:          aws.String(imageID),
-		InstanceType:     types.InstanceTypeT3Micro,
+		InstanceType:     instanceType,
 		MinCount:         aws.Int32(1),
 		MaxCount:         aws.Int32(1),
 		UserData:         aws.String(encodedUserData),
 		SecurityGroupIds: []string{securityGroupID},
 		KeyName:          aws.String(keyName),
 		SubnetId:         aws.String(subnetID),
+		// Session tokens with a hop limit of 1 keep the metadata endpoint, and the instance
+		// role's credentials, out of reach of containers even without the host firewall
+		MetadataOptions: &types.InstanceMetadataOptionsRequest{
+			HttpEndpoint:            types.InstanceMetadataEndpointStateEnabled,
+			HttpTokens:              types.HttpTokensStateRequired,
+			HttpPutResponseHopLimit: aws.Int32(1),
+		},
+		// Tagged as it is launched, so an instance is never left without its tags
 		TagSpecifications: []types.TagSpecification{
 			{
 				ResourceType: types.ResourceTypeInstance,
-				Tags: []types.Tag{
-					{
-						Key:   aws.String("Name"),
-						Value: aws.String("Docker-Sandbox"),
-					},
-				},
+				Tags:         tags,
 			},
 		},
 	}
@@ -234,31 +314,6 @@ echo "User data script completed" >> /var/log/user-data-start.log
 	instanceID := *result.Instances[0].InstanceId
 	fmt.Printf("Created instance %s\n", instanceID)
 
-	// Wait for instance to be ready and logs to be available
-	if err := c.WaitForInstanceReady(instanceID); err != nil {
-		// Get instance state before terminating
-		describeResult, err := c.DescribeInstance(instanceID)
-		if err == nil && len(describeResult.Reservations) > 0 && len(describeResult.Reservations[0].Instances) > 0 {
-			instance := describeResult.Reservations[0].Instances[0]
-			fmt.Printf("Instance state: %s\n", instance.State.Name)
-			fmt.Printf("Instance type: %s\n", instance.InstanceType)
-			fmt.Printf("Platform: %s\n", instance.Platform)
-			if instance.PublicIpAddress != nil {
-				fmt.Printf("Public IP: %s\n", *instance.PublicIpAddress)
-			}
-		}
-		return instanceID, fmt.Errorf("instance failed to initialize: %v", err)
-	}
-
-	// Get and print the system logs
-	logs, err := c.GetInstanceLogs(instanceID)
-	if err != nil {
-		fmt.Printf("Warning: Failed to get system logs: %v\n", err)
-	} else {
-		fmt.Println("System logs:")
-		fmt.Println(logs)
-	}
-
 	// After instance is created and we have the public IP, print SSH instructions
 	if len(result.Instances) > 0 && result.Instances[0].PublicIpAddress != nil {
 		publicIP := *result.Instances[0].PublicIpAddress
@@ -346,3 +401,105 @@ func (c *EC2Client) GetInstanceLogs(instanceID string) (string, error) {
 
 	return *output.Output, nil
 }
+
+// DescribeTaggedInstances returns the pending and running instances with a tag set to value
+func (c *EC2Client) DescribeTaggedInstances(key, value string) ([]types.Instance, error) {
+	paginator := ec2.NewDescribeInstancesPaginator(c.client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:" + key),
+				Values: []string{value},
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []string{"pending", "running"},
+			},
+		},
+	})
+
+	var instances []types.Instance
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(c.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances tagged %s=%s: %w", key, value, err)
+		}
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+	return instances, nil
+}
+
+// TagInstance sets a tag on an instance
+func (c *EC2Client) TagInstance(instanceID, key, value string) error {
+	_, err := c.client.CreateTags(c.ctx, &ec2.CreateTagsInput{
+		Resources: []string{instanceID},
+		Tags:      []types.Tag{{Key: aws.String(key), Value: aws.String(value)}},
+	})
+	return err
+}
+
+// UntagInstance removes a tag from an instance
+func (c *EC2Client) UntagInstance(instanceID, key string) error {
+	_, err := c.client.DeleteTags(c.ctx, &ec2.DeleteTagsInput{
+		Resources: []string{instanceID},
+		Tags:      []types.Tag{{Key: aws.String(key)}},
+	})
+	return err
+}
+
+// backendPorts are the ports of a sandbox host the backend connects to
+var backendPorts = []struct {
+	from, to int32
+	name     string
+}{
+	{2375, 2375, "Docker API"},
+	{22, 22, "SSH"},
+	// Ports Docker publishes containers on, its default ephemeral range. Rooms are previewed
+	// through the backend, which checks that the viewer is a participant.
+	{32768, 60999, "published container ports"},
+}
+
+// authorizeBackend lets only the backend reach the Docker API, SSH and the ports published by
+// sandbox containers. The rules opening them to everyone, which groups created by earlier
+// versions have, are revoked.
+func (c *EC2Client) authorizeBackend(securityGroupID string, opts LaunchOptions) error {
+	for _, ports := range backendPorts {
+		backend := types.IpPermission{
+			FromPort:   aws.Int32(ports.from),
+			ToPort:     aws.Int32(ports.to),
+			IpProtocol: aws.String("tcp"),
+		}
+		if opts.BackendCIDR != "" {
+			backend.IpRanges = []types.IpRange{{CidrIp: aws.String(opts.BackendCIDR)}}
+		}
+		if opts.BackendSecurityGroupID != "" {
+			backend.UserIdGroupPairs = []types.UserIdGroupPair{{GroupId: aws.String(opts.BackendSecurityGroupID)}}
+		}
+		_, err := c.client.AuthorizeSecurityGroupIngress(c.ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       aws.String(securityGroupID),
+			IpPermissions: []types.IpPermission{backend},
+		})
+		var apiErr smithy.APIError
+		if err != nil && (!errors.As(err, &apiErr) || apiErr.ErrorCode() != "InvalidPermission.Duplicate") {
+			return fmt.Errorf("failed to authorize %s: %v", ports.name, err)
+		}
+
+		// Revoked one port range at a time, a rule that does not exist fails the whole request
+		_, err = c.client.RevokeSecurityGroupIngress(c.ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId: aws.String(securityGroupID),
+			IpPermissions: []types.IpPermission{
+				{
+					FromPort:   aws.Int32(ports.from),
+					ToPort:     aws.Int32(ports.to),
+					IpProtocol: aws.String("tcp"),
+					IpRanges:   []types.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+				},
+			},
+		})
+		if err != nil && (!errors.As(err, &apiErr) || apiErr.ErrorCode() != "InvalidPermission.NotFound") {
+			return fmt.Errorf("failed to revoke public access to %s: %v", ports.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,630 @@
+package ec2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Tags the pool keeps its state in, so a restarted server picks up where it left off
+const (
+	PoolTag     = "k0:pool"     // Name of the pool an instance belongs to
+	DrainingTag = "k0:draining" // Set on instances that take no new rooms and go once they have none
+)
+
+// ErrNoHost is returned by Acquire when no host had room before the context ended
+var ErrNoHost = errors.New("no sandbox host available")
+
+// PoolConfig configures a HostPool
+type PoolConfig struct {
+	Name         string        // Value of PoolTag, instances of other pools are left alone
+	MinHosts     int           // Hosts kept running without rooms, so rooms start right away
+	MaxHosts     int           // Rooms queue once every host is full
+	RoomsPerHost int           // Rooms a host runs at most
+	IdleTimeout  time.Duration // How long a host beyond MinHosts may go without rooms before it is terminated
+	ReadyTimeout time.Duration // How long a launched host gets to pass Probe before it is replaced
+	Interval     time.Duration // How often the pool is reconciled with EC2
+	Launch       LaunchOptions // How hosts are launched, the pool sets Name and PoolTag
+
+	// Probe reports the rooms running on a host. It fails while the host can't take rooms yet,
+	// e.g. because Docker is still being installed.
+	Probe func(ctx context.Context, host Host) ([]string, error)
+}
+
+// PoolConfigFromEnv reads the pool's size from the environment:
+//
+//	HOST_POOL_NAME=default            pool instances are tagged with, one server manages each pool
+//	HOST_POOL_MIN=1                   hosts kept warm
+//	HOST_POOL_MAX=4                   hosts launched at most
+//	HOST_POOL_ROOMS_PER_HOST=4        rooms a host runs
+//	HOST_POOL_IDLE_TIMEOUT=15m        terminate hosts beyond the minimum idle for this long
+//	HOST_POOL_READY_TIMEOUT=20m       replace launched hosts that aren't ready by then
+//	EC2_INSTANCE_TYPE=t3.micro        instance type of new hosts
+//	EC2_SUBNET_ID, EC2_SECURITY_GROUP_ID
+//	EC2_BACKEND_CIDR=203.0.113.7/32   where the backend connects to hosts from
+//	EC2_BACKEND_SECURITY_GROUP_ID     or the backend's security group, one of them is required
+func PoolConfigFromEnv() (PoolConfig, error) {
+	cfg := PoolConfig{
+		Name:         os.Getenv("HOST_POOL_NAME"),
+		MinHosts:     1,
+		MaxHosts:     4,
+		RoomsPerHost: 4,
+		IdleTimeout:  15 * time.Minute,
+		ReadyTimeout: 20 * time.Minute,
+		Interval:     30 * time.Second,
+		Launch: LaunchOptions{
+			InstanceType:    os.Getenv("EC2_INSTANCE_TYPE"),
+			SubnetID:        os.Getenv("EC2_SUBNET_ID"),
+			SecurityGroupID: os.Getenv("EC2_SECURITY_GROUP_ID"),
+
+			BackendCIDR:            os.Getenv("EC2_BACKEND_CIDR"),
+			BackendSecurityGroupID: os.Getenv("EC2_BACKEND_SECURITY_GROUP_ID"),
+		},
+	}
+	if cfg.Name == "" {
+		cfg.Name = "default"
+	}
+	if cfg.Launch.SubnetID == "" {
+		cfg.Launch.SubnetID = "subnet-0988a47a3010e4968"
+	}
+	if cfg.Launch.SecurityGroupID == "" {
+		cfg.Launch.SecurityGroupID = "sg-042b1651131eb71d2"
+	}
+
+	for name, value := range map[string]*int{
+		"HOST_POOL_MIN":            &cfg.MinHosts,
+		"HOST_POOL_MAX":            &cfg.MaxHosts,
+		"HOST_POOL_ROOMS_PER_HOST": &cfg.RoomsPerHost,
+	} {
+		if env := os.Getenv(name); env != "" {
+			parsed, err := strconv.Atoi(env)
+			if err != nil || parsed < 0 {
+				return cfg, fmt.Errorf("invalid %s %q", name, env)
+			}
+			*value = parsed
+		}
+	}
+	for name, value := range map[string]*time.Duration{
+		"HOST_POOL_IDLE_TIMEOUT":  &cfg.IdleTimeout,
+		"HOST_POOL_READY_TIMEOUT": &cfg.ReadyTimeout,
+	} {
+		if env := os.Getenv(name); env != "" {
+			parsed, err := time.ParseDuration(env)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid %s %q: %w", name, env, err)
+			}
+			*value = parsed
+		}
+	}
+
+	if cfg.Launch.BackendCIDR == "" && cfg.Launch.BackendSecurityGroupID == "" {
+		return cfg, fmt.Errorf("EC2_BACKEND_CIDR or EC2_BACKEND_SECURITY_GROUP_ID is required, sandbox hosts are only open to the backend")
+	}
+	if cfg.Launch.BackendCIDR != "" {
+		if _, _, err := net.ParseCIDR(cfg.Launch.BackendCIDR); err != nil {
+			return cfg, fmt.Errorf("invalid EC2_BACKEND_CIDR %q: %w", cfg.Launch.BackendCIDR, err)
+		}
+	}
+	if cfg.MaxHosts < 1 || cfg.RoomsPerHost < 1 {
+		return cfg, fmt.Errorf("HOST_POOL_MAX and HOST_POOL_ROOMS_PER_HOST must be at least 1")
+	}
+	if cfg.MinHosts > cfg.MaxHosts {
+		return cfg, fmt.Errorf("HOST_POOL_MIN %d is above HOST_POOL_MAX %d", cfg.MinHosts, cfg.MaxHosts)
+	}
+	return cfg, nil
+}
+
+// HostState is where a host is in its life
+type HostState string
+
+const (
+	HostProvisioning HostState = "provisioning" // Launched or found, not known to be ready yet
+	HostReady        HostState = "ready"
+	HostDraining     HostState = "draining" // Takes no new rooms, terminated once it has none
+)
+
+// Host is a Docker host of the pool
+type Host struct {
+	InstanceID string
+	Address    string // Public IP, or the private one if it has none or the backend is in the VPC
+	State      HostState
+	Rooms      int
+	LaunchedAt time.Time
+}
+
+// instanceAPI is what the pool needs of EC2, see EC2Client
+type instanceAPI interface {
+	LaunchInstance(opts LaunchOptions) (string, error)
+	DescribeTaggedInstances(key, value string) ([]types.Instance, error)
+	TagInstance(instanceID, key, value string) error
+	UntagInstance(instanceID, key string) error
+	TerminateInstance(instanceID string) error
+}
+
+// poolHost is a host with the rooms placed on it
+type poolHost struct {
+	Host
+	rooms     map[string]bool
+	idleSince time.Time // When the last room left, or the host became ready
+}
+
+func (h *poolHost) snapshot() Host {
+	host := h.Host
+	host.Rooms = len(h.rooms)
+	return host
+}
+
+// waiter is a room queued for a host
+type waiter struct {
+	roomID string
+	host   chan Host
+}
+
+// HostPool keeps a pool of EC2 Docker hosts and places rooms on them. Instances are found by
+// PoolTag, so hosts outlive the server and are picked up again, rooms included, when it
+// restarts. Rooms queue when every host is full while more are launched, and hosts beyond
+// MinHosts are terminated once they have been idle for IdleTimeout.
+type HostPool struct {
+	cfg PoolConfig
+	api instanceAPI
+
+	mu    sync.Mutex
+	hosts map[string]*poolHost // By instance ID
+	rooms map[string]*poolHost // By room ID
+	queue []*waiter
+	wake  chan struct{}
+}
+
+// NewHostPool creates a pool of hosts launched through client
+func NewHostPool(client *EC2Client, cfg PoolConfig) *HostPool {
+	return newHostPool(client, cfg)
+}
+
+func newHostPool(api instanceAPI, cfg PoolConfig) *HostPool {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	if cfg.RoomsPerHost < 1 {
+		cfg.RoomsPerHost = 1
+	}
+	return &HostPool{
+		cfg:   cfg,
+		api:   api,
+		hosts: make(map[string]*poolHost),
+		rooms: make(map[string]*poolHost),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Start finds the pool's existing hosts and the rooms on them, then keeps the pool reconciled
+// in the background until ctx ends. Hosts are left running when it does, for the next start.
+func (p *HostPool) Start(ctx context.Context) error {
+	if err := p.reconcile(ctx); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(p.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-p.wake:
+			}
+			if err := p.reconcile(ctx); err != nil {
+				log.Printf("Failed to reconcile host pool %s: %v", p.cfg.Name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// poke asks for a reconcile soon, e.g. because a room queued
+func (p *HostPool) poke() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Acquire returns the host of a room, placing the room on the least busy host with room to
+// spare. It waits for a host to launch or free up when there is none, until ctx ends.
+func (p *HostPool) Acquire(ctx context.Context, roomID string) (Host, error) {
+	p.mu.Lock()
+	if h, ok := p.rooms[roomID]; ok {
+		p.mu.Unlock()
+		return h.snapshot(), nil
+	}
+	for _, w := range p.queue {
+		if w.roomID == roomID {
+			// Another build of the room is queued already
+			p.mu.Unlock()
+			return p.wait(ctx, w)
+		}
+	}
+	if h := p.pick(); h != nil {
+		p.place(h, roomID)
+		p.mu.Unlock()
+		return h.snapshot(), nil
+	}
+
+	w := &waiter{roomID: roomID, host: make(chan Host, 1)}
+	p.queue = append(p.queue, w)
+	p.mu.Unlock()
+	log.Printf("Room %s is queued for a host of pool %s", roomID, p.cfg.Name)
+	p.poke()
+	return p.wait(ctx, w)
+}
+
+func (p *HostPool) wait(ctx context.Context, w *waiter) (Host, error) {
+	select {
+	case host := <-w.host:
+		w.host <- host // For other builds of the room waiting too
+		return host, nil
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, queued := range p.queue {
+		if queued == w {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return Host{}, fmt.Errorf("%w for room %s: %v", ErrNoHost, w.roomID, ctx.Err())
+		}
+	}
+	// Placed just as ctx ended
+	host := <-w.host
+	w.host <- host
+	return host, nil
+}
+
+// Release takes a room off its host, which may then take a queued room or go idle
+func (p *HostPool) Release(roomID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.rooms[roomID]
+	if !ok {
+		return
+	}
+	delete(p.rooms, roomID)
+	delete(h.rooms, roomID)
+	if len(h.rooms) == 0 {
+		h.idleSince = time.Now()
+	}
+	p.placeQueued()
+	if h.State == HostDraining && len(h.rooms) == 0 {
+		p.poke()
+	}
+}
+
+// Hosts returns the hosts of the pool, by instance ID
+func (p *HostPool) Hosts() []Host {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hosts := make([]Host, 0, len(p.hosts))
+	for _, h := range p.hosts {
+		hosts = append(hosts, h.snapshot())
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].InstanceID < hosts[j].InstanceID })
+	return hosts
+}
+
+// Host returns a host of the pool by instance ID
+func (p *HostPool) Host(instanceID string) (Host, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.hosts[instanceID]
+	if !ok {
+		return Host{}, false
+	}
+	return h.snapshot(), true
+}
+
+// pick returns the ready host with the fewest rooms that can take one more, with p.mu held
+func (p *HostPool) pick() *poolHost {
+	var best *poolHost
+	for _, h := range p.hosts {
+		if h.State != HostReady || len(h.rooms) >= p.cfg.RoomsPerHost {
+			continue
+		}
+		if best == nil || len(h.rooms) < len(best.rooms) || (len(h.rooms) == len(best.rooms) && h.InstanceID < best.InstanceID) {
+			best = h
+		}
+	}
+	return best
+}
+
+// place puts a room on a host, with p.mu held
+func (p *HostPool) place(h *poolHost, roomID string) {
+	h.rooms[roomID] = true
+	p.rooms[roomID] = h
+}
+
+// placeQueued hands hosts with room to spare to queued rooms, first come first served, with p.mu held
+func (p *HostPool) placeQueued() {
+	for len(p.queue) > 0 {
+		h := p.pick()
+		if h == nil {
+			return
+		}
+		w := p.queue[0]
+		p.queue = p.queue[1:]
+		p.place(h, w.roomID)
+		w.host <- h.snapshot()
+	}
+}
+
+// reconcile brings the pool in line with EC2 and with demand: it picks up hosts it doesn't
+// know, probes the ones that aren't ready, launches hosts for queued rooms and the warm
+// minimum, and drains and terminates idle ones.
+func (p *HostPool) reconcile(ctx context.Context) error {
+	instances, err := p.api.DescribeTaggedInstances(PoolTag, p.cfg.Name)
+	if err != nil {
+		return err
+	}
+	p.sync(instances)
+	p.probe(ctx)
+
+	launch, undrain, drain := p.plan(time.Now())
+	for _, id := range undrain {
+		if err := p.api.UntagInstance(id, DrainingTag); err != nil {
+			log.Printf("Failed to put host %s back into pool %s: %v", id, p.cfg.Name, err)
+			continue
+		}
+		p.setState(id, HostReady)
+		log.Printf("Host %s of pool %s takes rooms again", id, p.cfg.Name)
+	}
+	for _, id := range drain {
+		if err := p.api.TagInstance(id, DrainingTag, "true"); err != nil {
+			log.Printf("Failed to drain host %s of pool %s: %v", id, p.cfg.Name, err)
+			continue
+		}
+		p.setState(id, HostDraining)
+		log.Printf("Draining idle host %s of pool %s", id, p.cfg.Name)
+	}
+	for i := 0; i < launch; i++ {
+		p.launch()
+	}
+	for _, id := range p.drained() {
+		p.terminate(id)
+	}
+
+	p.mu.Lock()
+	p.placeQueued()
+	p.mu.Unlock()
+	return nil
+}
+
+// sync adds the instances the pool doesn't know yet and forgets those that are gone
+func (p *HostPool) sync(instances []types.Instance) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	seen := make(map[string]bool, len(instances))
+	for _, instance := range instances {
+		if instance.InstanceId == nil {
+			continue
+		}
+		id := *instance.InstanceId
+		seen[id] = true
+
+		// A backend let in by its security group is in the VPC and must use the private address
+		address := ""
+		if instance.PublicIpAddress != nil && p.cfg.Launch.BackendSecurityGroupID == "" {
+			address = *instance.PublicIpAddress
+		} else if instance.PrivateIpAddress != nil {
+			address = *instance.PrivateIpAddress
+		}
+
+		h, ok := p.hosts[id]
+		if !ok {
+			h = &poolHost{
+				Host:  Host{InstanceID: id, State: HostProvisioning, LaunchedAt: time.Now()},
+				rooms: make(map[string]bool),
+			}
+			if instance.LaunchTime != nil {
+				h.LaunchedAt = *instance.LaunchTime
+			}
+			p.hosts[id] = h
+			log.Printf("Found host %s of pool %s", id, p.cfg.Name)
+		}
+		h.Address = address
+		for _, tag := range instance.Tags {
+			if tag.Key != nil && *tag.Key == DrainingTag && h.State != HostDraining {
+				h.State = HostDraining
+			}
+		}
+	}
+
+	for id, h := range p.hosts {
+		if seen[id] {
+			continue
+		}
+		// Terminated outside of the pool, its rooms are gone with it
+		for roomID := range h.rooms {
+			delete(p.rooms, roomID)
+		}
+		delete(p.hosts, id)
+		log.Printf("Host %s of pool %s is gone, %d rooms were on it", id, p.cfg.Name, len(h.rooms))
+	}
+}
+
+// probe checks the hosts that are not known to be ready, adopting the rooms found on them.
+// Hosts that don't get ready within ReadyTimeout are terminated.
+func (p *HostPool) probe(ctx context.Context) {
+	p.mu.Lock()
+	var pending []Host
+	for _, h := range p.hosts {
+		if h.State == HostProvisioning || (h.State == HostDraining && h.idleSince.IsZero()) {
+			pending = append(pending, h.snapshot())
+		}
+	}
+	p.mu.Unlock()
+
+	for _, host := range pending {
+		if host.Address == "" {
+			p.expire(host)
+			continue
+		}
+		rooms, err := p.cfg.Probe(ctx, host)
+		if err != nil {
+			p.expire(host)
+			continue
+		}
+
+		p.mu.Lock()
+		h, ok := p.hosts[host.InstanceID]
+		if ok {
+			if h.State == HostProvisioning {
+				h.State = HostReady
+				log.Printf("Host %s (%s) of pool %s is ready with %d rooms", h.InstanceID, h.Address, p.cfg.Name, len(rooms))
+			}
+			h.idleSince = time.Now()
+			for _, roomID := range rooms {
+				if _, placed := p.rooms[roomID]; !placed {
+					p.place(h, roomID)
+				}
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// expire terminates a host that is still not ready after ReadyTimeout
+func (p *HostPool) expire(host Host) {
+	if p.cfg.ReadyTimeout <= 0 || time.Since(host.LaunchedAt) < p.cfg.ReadyTimeout {
+		return
+	}
+	log.Printf("Host %s of pool %s did not get ready within %s", host.InstanceID, p.cfg.Name, p.cfg.ReadyTimeout)
+	p.terminate(host.InstanceID)
+}
+
+// plan works out how many hosts to launch and which hosts to take back from draining or to
+// drain. Enough hosts are kept for the rooms placed and queued, and MinHosts at least.
+func (p *HostPool) plan(now time.Time) (launch int, undrain, drain []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	active, rooms := 0, len(p.queue)
+	var draining, idle []*poolHost
+	for _, h := range p.hosts {
+		switch h.State {
+		case HostDraining:
+			if !h.idleSince.IsZero() {
+				draining = append(draining, h)
+			}
+			continue
+		case HostReady:
+			if len(h.rooms) == 0 && now.Sub(h.idleSince) >= p.cfg.IdleTimeout {
+				idle = append(idle, h)
+			}
+		}
+		active++
+		rooms += len(h.rooms)
+	}
+
+	desired := (rooms + p.cfg.RoomsPerHost - 1) / p.cfg.RoomsPerHost
+	desired = max(desired, p.cfg.MinHosts)
+	desired = min(desired, p.cfg.MaxHosts)
+
+	if active < desired {
+		// Hosts still draining are ready already, quicker than launching
+		sort.Slice(draining, func(i, j int) bool { return len(draining[i].rooms) > len(draining[j].rooms) })
+		for _, h := range draining {
+			if active == desired {
+				break
+			}
+			undrain = append(undrain, h.InstanceID)
+			active++
+		}
+		launch = desired - active
+	}
+
+	// Longest idle first
+	sort.Slice(idle, func(i, j int) bool { return idle[i].idleSince.Before(idle[j].idleSince) })
+	for _, h := range idle {
+		if active <= desired {
+			break
+		}
+		drain = append(drain, h.InstanceID)
+		active--
+	}
+	return launch, undrain, drain
+}
+
+// drained returns the draining hosts that have no rooms left
+func (p *HostPool) drained() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ids []string
+	for id, h := range p.hosts {
+		if h.State == HostDraining && !h.idleSince.IsZero() && len(h.rooms) == 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (p *HostPool) setState(instanceID string, state HostState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.hosts[instanceID]; ok {
+		h.State = state
+	}
+}
+
+// launch starts a host. It is tagged as it launches, so it is found again if the server
+// restarts before it is ready.
+func (p *HostPool) launch() {
+	opts := p.cfg.Launch
+	opts.Name = "k0-sandbox-" + p.cfg.Name
+	opts.Tags = map[string]string{PoolTag: p.cfg.Name}
+	for key, value := range p.cfg.Launch.Tags {
+		opts.Tags[key] = value
+	}
+
+	id, err := p.api.LaunchInstance(opts)
+	if err != nil {
+		log.Printf("Failed to launch a host for pool %s: %v", p.cfg.Name, err)
+		return
+	}
+	log.Printf("Launched host %s for pool %s", id, p.cfg.Name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.hosts[id]; !ok {
+		p.hosts[id] = &poolHost{
+			Host:  Host{InstanceID: id, State: HostProvisioning, LaunchedAt: time.Now()},
+			rooms: make(map[string]bool),
+		}
+	}
+}
+
+// terminate terminates a host and forgets it
+func (p *HostPool) terminate(instanceID string) {
+	if err := p.api.TerminateInstance(instanceID); err != nil {
+		log.Printf("Failed to terminate host %s of pool %s: %v", instanceID, p.cfg.Name, err)
+		return
+	}
+	log.Printf("Terminated host %s of pool %s", instanceID, p.cfg.Name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h, ok := p.hosts[instanceID]; ok {
+		for roomID := range h.rooms {
+			delete(p.rooms, roomID)
+		}
+		delete(p.hosts, instanceID)
+	}
+}
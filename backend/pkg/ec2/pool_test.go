@@ -0,0 +1,383 @@
+package ec2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeInstance is an instance of fakeEC2
+type fakeInstance struct {
+	tags    map[string]string
+	ready   bool     // Whether Probe succeeds
+	rooms   []string // Rooms Probe reports
+	public  string
+	private string
+}
+
+// fakeEC2 is an in-memory instanceAPI
+type fakeEC2 struct {
+	mu         sync.Mutex
+	seq        int
+	instances  map[string]*fakeInstance
+	launched   []LaunchOptions
+	terminated []string
+}
+
+func newFakeEC2() *fakeEC2 {
+	return &fakeEC2{instances: make(map[string]*fakeInstance)}
+}
+
+func (f *fakeEC2) LaunchInstance(opts LaunchOptions) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	id := fmt.Sprintf("i-%d", f.seq)
+	tags := map[string]string{"Name": opts.Name}
+	for key, value := range opts.Tags {
+		tags[key] = value
+	}
+	f.instances[id] = &fakeInstance{
+		tags:    tags,
+		public:  fmt.Sprintf("203.0.113.%d", f.seq),
+		private: fmt.Sprintf("10.0.0.%d", f.seq),
+	}
+	f.launched = append(f.launched, opts)
+	return id, nil
+}
+
+func (f *fakeEC2) DescribeTaggedInstances(key, value string) ([]types.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var instances []types.Instance
+	for id, instance := range f.instances {
+		if instance.tags[key] != value {
+			continue
+		}
+		described := types.Instance{
+			InstanceId: aws.String(id),
+			LaunchTime: aws.Time(time.Now()),
+		}
+		if instance.public != "" {
+			described.PublicIpAddress = aws.String(instance.public)
+		}
+		if instance.private != "" {
+			described.PrivateIpAddress = aws.String(instance.private)
+		}
+		for k, v := range instance.tags {
+			described.Tags = append(described.Tags, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+		}
+		instances = append(instances, described)
+	}
+	return instances, nil
+}
+
+func (f *fakeEC2) TagInstance(instanceID, key, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances[instanceID].tags[key] = value
+	return nil
+}
+
+func (f *fakeEC2) UntagInstance(instanceID, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.instances[instanceID].tags, key)
+	return nil
+}
+
+func (f *fakeEC2) TerminateInstance(instanceID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.instances, instanceID)
+	f.terminated = append(f.terminated, instanceID)
+	return nil
+}
+
+// setReady makes every instance pass Probe
+func (f *fakeEC2) setReady() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, instance := range f.instances {
+		instance.ready = true
+	}
+}
+
+func (f *fakeEC2) probe(ctx context.Context, host Host) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance, ok := f.instances[host.InstanceID]
+	if !ok || !instance.ready {
+		return nil, errors.New("Docker is not up yet")
+	}
+	return instance.rooms, nil
+}
+
+func (f *fakeEC2) hasTag(instanceID, key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance, ok := f.instances[instanceID]
+	if !ok {
+		return false
+	}
+	_, tagged := instance.tags[key]
+	return tagged
+}
+
+func newTestPool(api *fakeEC2, cfg PoolConfig) *HostPool {
+	cfg.Name = "test"
+	cfg.Probe = api.probe
+	if cfg.RoomsPerHost == 0 {
+		cfg.RoomsPerHost = 1
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = time.Hour
+	}
+	return newHostPool(api, cfg)
+}
+
+func reconcile(t *testing.T, p *HostPool) {
+	t.Helper()
+	if err := p.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hostIDs returns the instance IDs of the pool's hosts in the given state
+func hostIDs(p *HostPool, state HostState) []string {
+	var ids []string
+	for _, h := range p.Hosts() {
+		if h.State == state {
+			ids = append(ids, h.InstanceID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// queued waits until n rooms are queued
+func queued(t *testing.T, p *HostPool, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		p.mu.Lock()
+		length := len(p.queue)
+		p.mu.Unlock()
+		if length == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d rooms queued, want %d", length, n)
+		}
+	}
+}
+
+func TestPoolKeepsTheWarmMinimum(t *testing.T) {
+	api := newFakeEC2()
+	p := newTestPool(api, PoolConfig{MinHosts: 2, MaxHosts: 4})
+
+	reconcile(t, p)
+	if len(api.launched) != 2 || len(hostIDs(p, HostProvisioning)) != 2 {
+		t.Fatalf("launched %d hosts, %d provisioning, want 2", len(api.launched), len(hostIDs(p, HostProvisioning)))
+	}
+	if opts := api.launched[0]; opts.Tags[PoolTag] != "test" || opts.Name != "k0-sandbox-test" {
+		t.Fatalf("host launched with name %q and tags %v", opts.Name, opts.Tags)
+	}
+
+	// Hosts that are not ready yet count towards the minimum
+	reconcile(t, p)
+	if len(api.launched) != 2 {
+		t.Fatalf("launched %d hosts while the first ones provisioned, want 2", len(api.launched))
+	}
+
+	api.setReady()
+	reconcile(t, p)
+	if ready := hostIDs(p, HostReady); len(ready) != 2 || len(api.launched) != 2 {
+		t.Fatalf("ready hosts %v after launching %d, want 2 of 2", ready, len(api.launched))
+	}
+}
+
+func TestPoolScalesUpForQueuedRooms(t *testing.T) {
+	api := newFakeEC2()
+	p := newTestPool(api, PoolConfig{MinHosts: 1, MaxHosts: 2})
+	reconcile(t, p)
+	api.setReady()
+	reconcile(t, p)
+
+	first, err := p.Acquire(context.Background(), "room-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := p.Acquire(context.Background(), "room-a"); again.InstanceID != first.InstanceID {
+		t.Fatalf("room-a moved from %s to %s", first.InstanceID, again.InstanceID)
+	}
+
+	// The only host is full, room-b waits for another one to launch
+	acquired := make(chan Host)
+	go func() {
+		host, err := p.Acquire(context.Background(), "room-b")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- host
+	}()
+	queued(t, p, 1)
+	reconcile(t, p)
+	if len(api.launched) != 2 {
+		t.Fatalf("launched %d hosts for a queued room, want 2", len(api.launched))
+	}
+	api.setReady()
+	reconcile(t, p)
+
+	select {
+	case host := <-acquired:
+		if host.InstanceID == first.InstanceID || host.Rooms != 1 {
+			t.Fatalf("room-b placed on %+v, want the new host", host)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("room-b was not placed on the new host")
+	}
+
+	// At MaxHosts, rooms wait until their context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Acquire(ctx, "room-c"); !errors.Is(err, ErrNoHost) {
+		t.Fatalf("acquiring beyond MaxHosts: %v", err)
+	}
+	reconcile(t, p)
+	if len(api.launched) != 2 {
+		t.Fatalf("launched %d hosts, want MaxHosts 2", len(api.launched))
+	}
+
+	// A released host takes the next queued room
+	go func() {
+		host, _ := p.Acquire(context.Background(), "room-c")
+		acquired <- host
+	}()
+	queued(t, p, 1)
+	p.Release("room-a")
+	if host := <-acquired; host.InstanceID != first.InstanceID {
+		t.Fatalf("room-c placed on %s, want the host room-a left", host.InstanceID)
+	}
+}
+
+func TestPoolDrainsAndTerminatesIdleHosts(t *testing.T) {
+	api := newFakeEC2()
+	p := newTestPool(api, PoolConfig{MinHosts: 0, MaxHosts: 2, IdleTimeout: time.Nanosecond})
+
+	acquired := make(chan Host)
+	go func() {
+		host, _ := p.Acquire(context.Background(), "room-a")
+		acquired <- host
+	}()
+	queued(t, p, 1)
+	reconcile(t, p)
+	api.setReady()
+	reconcile(t, p)
+	host := <-acquired
+
+	// A host with a room is never drained
+	reconcile(t, p)
+	if len(api.terminated) != 0 || api.hasTag(host.InstanceID, DrainingTag) {
+		t.Fatalf("host %s with a room was drained", host.InstanceID)
+	}
+
+	p.Release("room-a")
+	reconcile(t, p)
+	if len(api.terminated) != 1 || api.terminated[0] != host.InstanceID || len(p.Hosts()) != 0 {
+		t.Fatalf("terminated %v with hosts %v left, want %s terminated", api.terminated, p.Hosts(), host.InstanceID)
+	}
+}
+
+func TestPoolKeepsDrainingHostsUntilTheirRoomsLeave(t *testing.T) {
+	api := newFakeEC2()
+	p := newTestPool(api, PoolConfig{MinHosts: 0, MaxHosts: 2, IdleTimeout: time.Nanosecond})
+	api.instances["i-busy"] = &fakeInstance{
+		tags:    map[string]string{PoolTag: "test", DrainingTag: "true"},
+		ready:   true,
+		rooms:   []string{"room-a"},
+		private: "10.0.1.2",
+	}
+
+	reconcile(t, p)
+	if draining := hostIDs(p, HostDraining); len(draining) != 1 || len(api.terminated) != 0 {
+		t.Fatalf("draining hosts %v, terminated %v, want i-busy draining", draining, api.terminated)
+	}
+	// A draining host takes no new rooms, but keeps those on it
+	if host, _ := p.Acquire(context.Background(), "room-a"); host.InstanceID != "i-busy" {
+		t.Fatalf("room-a is on %s, want i-busy", host.InstanceID)
+	}
+
+	p.Release("room-a")
+	api.setReady()
+	reconcile(t, p)
+	if len(api.terminated) != 1 || api.terminated[0] != "i-busy" {
+		t.Fatalf("terminated %v, want i-busy once room-a left", api.terminated)
+	}
+}
+
+func TestPoolAdoptsTaggedInstancesAfterRestart(t *testing.T) {
+	api := newFakeEC2()
+	api.instances["i-found"] = &fakeInstance{
+		tags:    map[string]string{PoolTag: "test"},
+		ready:   true,
+		rooms:   []string{"room-a", "room-b"},
+		public:  "198.51.100.1",
+		private: "10.0.1.1",
+	}
+	api.instances["i-other"] = &fakeInstance{
+		tags:  map[string]string{PoolTag: "other"},
+		ready: true,
+		rooms: []string{"room-c"},
+	}
+	p := newTestPool(api, PoolConfig{MinHosts: 1, MaxHosts: 2, RoomsPerHost: 4})
+	p.cfg.Launch.BackendSecurityGroupID = "sg-backend"
+
+	reconcile(t, p)
+	if len(api.launched) != 0 {
+		t.Fatalf("launched %d hosts although one was running, want none", len(api.launched))
+	}
+	hosts := p.Hosts()
+	if len(hosts) != 1 || hosts[0].InstanceID != "i-found" || hosts[0].State != HostReady || hosts[0].Rooms != 2 {
+		t.Fatalf("hosts after restart %+v, want i-found ready with 2 rooms", hosts)
+	}
+	// A backend let in by security group reaches hosts over their private address
+	if hosts[0].Address != "10.0.1.1" {
+		t.Fatalf("host address %s, want the private one", hosts[0].Address)
+	}
+
+	// Rooms found on a host stay there
+	if host, _ := p.Acquire(context.Background(), "room-b"); host.InstanceID != "i-found" || host.Rooms != 2 {
+		t.Fatalf("room-b acquired %+v, want i-found with 2 rooms", host)
+	}
+
+	// Instances terminated outside of the pool take their rooms with them
+	api.TerminateInstance("i-found")
+	reconcile(t, p)
+	if _, ok := p.Host("i-found"); ok || len(api.launched) != 1 {
+		t.Fatalf("i-found still known after it was terminated, %d hosts launched", len(api.launched))
+	}
+	p.mu.Lock()
+	_, placed := p.rooms["room-a"]
+	p.mu.Unlock()
+	if placed {
+		t.Fatal("room-a is still placed on a terminated host")
+	}
+}
+
+func TestPoolReplacesHostsThatNeverGetReady(t *testing.T) {
+	api := newFakeEC2()
+	p := newTestPool(api, PoolConfig{MinHosts: 1, MaxHosts: 1, ReadyTimeout: time.Nanosecond})
+
+	reconcile(t, p)
+	reconcile(t, p)
+	if len(api.terminated) != 1 || api.terminated[0] != "i-1" || len(api.launched) != 2 {
+		t.Fatalf("terminated %v after launching %d, want i-1 replaced", api.terminated, len(api.launched))
+	}
+}
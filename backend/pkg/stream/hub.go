@@ -0,0 +1,449 @@
+// Package stream owns container output streams and fans them out to any
+// number of subscribers (WebSocket viewers, persistence writers, ...).
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// DefaultSubscriberBuffer is the number of chunks a subscriber may fall behind
+// before it is considered too slow and dropped
+const DefaultSubscriberBuffer = 256
+
+// DefaultReplayBytes is how much recent output each topic keeps in memory for late joiners
+const DefaultReplayBytes = 1024 * 1024
+
+// ErrTopicExists is returned when opening a topic for an id that is already open
+var ErrTopicExists = errors.New("stream topic already exists")
+
+// Config controls how much output a hub retains for replay
+type Config struct {
+	ReplayBytes int    // Size of the in-memory replay buffer per topic, DefaultReplayBytes if zero
+	SpillDir    string // If set, the full output of every topic is also kept on disk here
+}
+
+// Kind identifies which output stream of a container a chunk came from
+type Kind uint8
+
+const (
+	Stdout Kind = 1
+	Stderr Kind = 2
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Stdout:
+		return "stdout"
+	case Stderr:
+		return "stderr"
+	default:
+		return "unknown"
+	}
+}
+
+// CopyFunc copies src to the writer of the output stream each piece of it belongs to
+type CopyFunc func(stdout, stderr io.Writer, src io.Reader) error
+
+// Raw treats src as a single stdout stream, e.g. the output of a TTY
+func Raw(stdout, stderr io.Writer, src io.Reader) error {
+	_, err := io.Copy(stdout, src)
+	return err
+}
+
+// Chunk is a piece of output read from a container stream
+type Chunk struct {
+	Offset int64  // Position of the first byte of Data within the whole stream, across all kinds
+	Stream Kind   // Output stream the bytes were written to
+	Data   []byte // Raw bytes, shared between subscribers and must not be modified
+}
+
+// End returns the offset just past the last byte of the chunk
+func (c Chunk) End() int64 {
+	return c.Offset + int64(len(c.Data))
+}
+
+// Hub keeps one Topic per container stream
+type Hub struct {
+	cfg Config
+
+	mu     sync.Mutex
+	topics map[string]*Topic
+}
+
+// NewHub creates an empty hub
+func NewHub(cfg Config) *Hub {
+	if cfg.ReplayBytes <= 0 {
+		cfg.ReplayBytes = DefaultReplayBytes
+	}
+	return &Hub{
+		cfg:    cfg,
+		topics: make(map[string]*Topic),
+	}
+}
+
+// Open takes ownership of src and starts broadcasting everything read from it
+// to the subscribers of the topic registered under id. demux splits src into its
+// output streams; pass Raw if it is not multiplexed.
+func (h *Hub) Open(id string, src io.ReadCloser, demux CopyFunc) (*Topic, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.topics[id]; exists {
+		return nil, fmt.Errorf("%w: %s", ErrTopicExists, id)
+	}
+
+	t := &Topic{
+		id:   id,
+		src:  src,
+		ring: newRing(h.cfg.ReplayBytes),
+		subs: make(map[*Subscriber]struct{}),
+		done: make(chan struct{}),
+	}
+	if h.cfg.SpillDir != "" {
+		spill, err := newSpill(h.cfg.SpillDir, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create spill file for %s: %w", id, err)
+		}
+		t.spill = spill
+	}
+	h.topics[id] = t
+
+	go t.pump(src, demux)
+
+	return t, nil
+}
+
+// Reopen attaches a new source to the topic registered under id once its previous source
+// has ended, e.g. after the container was restarted. Retained output and offsets carry on,
+// so viewers can resume where they left off. Without an existing topic it behaves like Open.
+func (h *Hub) Reopen(id string, src io.ReadCloser, demux CopyFunc) (*Topic, error) {
+	h.mu.Lock()
+	t, ok := h.topics[id]
+	h.mu.Unlock()
+	if !ok {
+		return h.Open(id, src, demux)
+	}
+
+	t.mu.Lock()
+	if !t.closed {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s is still streaming", ErrTopicExists, id)
+	}
+	t.src = src
+	t.closed = false
+	t.done = make(chan struct{})
+	t.mu.Unlock()
+
+	go t.pump(src, demux)
+
+	return t, nil
+}
+
+// OpenWriter registers a topic that is fed by the caller instead of a stream. Every
+// Write to the returned writer becomes one stdout chunk, and closing it ends the topic.
+func (h *Hub) OpenWriter(id string) (*Topic, io.WriteCloser, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.topics[id]; exists {
+		return nil, nil, fmt.Errorf("%w: %s", ErrTopicExists, id)
+	}
+
+	t := &Topic{
+		id:   id,
+		ring: newRing(h.cfg.ReplayBytes),
+		subs: make(map[*Subscriber]struct{}),
+		done: make(chan struct{}),
+	}
+	h.topics[id] = t
+
+	return t, &topicWriteCloser{topicWriter{topic: t, kind: Stdout}}, nil
+}
+
+// Get returns the topic registered under id
+func (h *Hub) Get(id string) (*Topic, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.topics[id]
+	return t, ok
+}
+
+// Remove closes the topic registered under id, forgets it and discards its retained output
+func (h *Hub) Remove(id string) {
+	h.mu.Lock()
+	t, ok := h.topics[id]
+	delete(h.topics, id)
+	h.mu.Unlock()
+
+	if ok {
+		t.Close()
+		if t.spill != nil {
+			t.spill.remove()
+		}
+	}
+}
+
+// Topic is a single container stream shared by all of its subscribers
+type Topic struct {
+	id    string
+	src   io.ReadCloser // Nil for topics opened with OpenWriter
+	spill *spill
+
+	mu     sync.Mutex
+	ring   *ring
+	offset int64 // Total number of bytes published so far
+	subs   map[*Subscriber]struct{}
+	closed bool
+	done   chan struct{}
+}
+
+// ID returns the id the topic was opened with
+func (t *Topic) ID() string {
+	return t.id
+}
+
+// Done is closed once the underlying stream has ended
+func (t *Topic) Done() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
+}
+
+// Offset returns the number of bytes published so far
+func (t *Topic) Offset() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.offset
+}
+
+// Subscribe registers a new subscriber that first receives all retained output from
+// offset from onwards and then every chunk published live. Output older than what the
+// topic still retains is skipped, so the first chunk may start after from.
+// Subscribing to a closed topic replays the retained output and then ends.
+func (t *Topic) Subscribe(from int64) *Subscriber {
+	s := &Subscriber{
+		topic: t,
+		live:  make(chan Chunk, DefaultSubscriberBuffer),
+		out:   make(chan Chunk),
+		quit:  make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	if from < 0 {
+		from = 0
+	}
+	if from > t.offset {
+		from = t.offset
+	}
+
+	// The in-memory backlog and the live registration happen under the same lock,
+	// so nothing is missed or delivered twice between replay and live streaming
+	backlog := t.ring.since(from)
+	var spilled *io.SectionReader
+	ringStart := t.ring.start()
+	if t.spill != nil && from < ringStart {
+		spilled = t.spill.section()
+	}
+
+	if t.closed {
+		close(s.live)
+	} else {
+		t.subs[s] = struct{}{}
+	}
+	t.mu.Unlock()
+
+	go s.forward(spilled, from, ringStart, backlog)
+
+	return s
+}
+
+// SubscribeTail is like Subscribe but starts at most n bytes before the current end of the stream
+func (t *Topic) SubscribeTail(n int64) *Subscriber {
+	t.mu.Lock()
+	from := t.offset - n
+	t.mu.Unlock()
+
+	return t.Subscribe(from)
+}
+
+// Unsubscribe removes s from the topic and stops its delivery
+func (t *Topic) Unsubscribe(s *Subscriber) {
+	s.quitOnce.Do(func() { close(s.quit) })
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.subs[s]; ok {
+		delete(t.subs, s)
+		close(s.live)
+	}
+}
+
+// Close stops reading from the underlying stream and ends every subscriber once it has
+// received everything published so far. Retained output stays available for replay.
+func (t *Topic) Close() {
+	t.mu.Lock()
+	src := t.src
+	t.mu.Unlock()
+
+	t.finish(src)
+}
+
+// finish closes src and ends the topic, unless the topic has been reopened with a
+// different source in the meantime
+func (t *Topic) finish(src io.ReadCloser) {
+	if src != nil {
+		src.Close()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.src != src || t.closed {
+		return
+	}
+	t.closed = true
+	for s := range t.subs {
+		delete(t.subs, s)
+		close(s.live)
+	}
+	close(t.done)
+}
+
+// publish retains a chunk and delivers it to every subscriber. Subscribers whose buffer
+// is full are dropped instead of blocking the stream for everyone else.
+func (t *Topic) publish(kind Kind, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := Chunk{Offset: t.offset, Stream: kind, Data: data}
+	t.offset = c.End()
+	t.ring.push(c)
+	if t.spill != nil {
+		if err := t.spill.write(c); err != nil {
+			log.Printf("Error spilling output of %s to disk: %v", t.id, err)
+		}
+	}
+
+	for s := range t.subs {
+		select {
+		case s.live <- c:
+		default:
+			delete(t.subs, s)
+			s.lagged = true
+			close(s.live)
+		}
+	}
+}
+
+// pump reads src until it ends
+func (t *Topic) pump(src io.ReadCloser, demux CopyFunc) {
+	defer t.finish(src)
+
+	err := demux(&topicWriter{topic: t, kind: Stdout}, &topicWriter{topic: t, kind: Stderr}, src)
+
+	t.mu.Lock()
+	current := t.src == src && !t.closed
+	t.mu.Unlock()
+	if err != nil && current {
+		log.Printf("Error reading output of %s: %v", t.id, err)
+	}
+}
+
+// topicWriter publishes everything written to it as chunks of one kind
+type topicWriter struct {
+	topic *Topic
+	kind  Kind
+}
+
+func (w *topicWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Callers reuse their buffers, subscribers need a stable copy
+	data := make([]byte, len(p))
+	copy(data, p)
+	w.topic.publish(w.kind, data)
+	return len(p), nil
+}
+
+// topicWriteCloser is the writer handed out by OpenWriter
+type topicWriteCloser struct {
+	topicWriter
+}
+
+func (w *topicWriteCloser) Close() error {
+	w.topic.Close()
+	return nil
+}
+
+// Subscriber receives the chunks published to a topic
+type Subscriber struct {
+	topic    *Topic
+	live     chan Chunk // Filled by the topic as chunks are published
+	out      chan Chunk // Replayed and live chunks, in order, for the consumer
+	quit     chan struct{}
+	quitOnce sync.Once
+	lagged   bool // Guarded by topic.mu
+}
+
+// Chunks returns the channel chunks are delivered on. It is closed when the topic ends,
+// the subscriber unsubscribes, or the subscriber falls too far behind.
+func (s *Subscriber) Chunks() <-chan Chunk {
+	return s.out
+}
+
+// Lagged reports whether the subscriber was dropped for not keeping up.
+// A lagged client can resume by subscribing again from the end of the last chunk it received.
+func (s *Subscriber) Lagged() bool {
+	s.topic.mu.Lock()
+	defer s.topic.mu.Unlock()
+	return s.lagged
+}
+
+// Close unsubscribes from the topic
+func (s *Subscriber) Close() {
+	s.topic.Unsubscribe(s)
+}
+
+// forward delivers the spilled output, then the in-memory backlog, then live chunks
+func (s *Subscriber) forward(spilled *io.SectionReader, from, until int64, backlog []Chunk) {
+	defer close(s.out)
+
+	send := func(c Chunk) bool {
+		select {
+		case s.out <- c:
+			return true
+		case <-s.quit:
+			return false
+		}
+	}
+
+	if spilled != nil {
+		err := readSpill(spilled, from, until, send)
+		if errors.Is(err, errStopped) {
+			return
+		}
+		if err != nil {
+			// Carry on with what is still in memory rather than dropping the viewer
+			log.Printf("Error replaying spilled output of %s: %v", s.topic.id, err)
+		}
+	}
+
+	for _, c := range backlog {
+		if !send(c) {
+			return
+		}
+	}
+
+	for c := range s.live {
+		if !send(c) {
+			return
+		}
+	}
+}
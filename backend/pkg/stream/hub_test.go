@@ -0,0 +1,316 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// collect reads a subscriber until its channel is closed
+func collect(t *testing.T, s *Subscriber) []Chunk {
+	t.Helper()
+	var chunks []Chunk
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c, ok := <-s.Chunks():
+			if !ok {
+				return chunks
+			}
+			chunks = append(chunks, c)
+		case <-timeout:
+			t.Fatalf("subscriber did not end, received %d chunks", len(chunks))
+		}
+	}
+}
+
+// join concatenates chunks, failing if they are not contiguous
+func join(t *testing.T, chunks []Chunk) string {
+	t.Helper()
+	var out bytes.Buffer
+	for i, c := range chunks {
+		if i > 0 && c.Offset != chunks[i-1].End() {
+			t.Fatalf("chunk %d starts at %d, previous one ended at %d", i, c.Offset, chunks[i-1].End())
+		}
+		out.Write(c.Data)
+	}
+	return out.String()
+}
+
+// writeAll writes each part as a chunk of its own
+func writeAll(t *testing.T, w io.Writer, parts ...string) {
+	t.Helper()
+	for _, p := range parts {
+		if _, err := io.WriteString(w, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRingEvictsOldestChunks(t *testing.T) {
+	r := newRing(8)
+	r.push(Chunk{Offset: 0, Data: []byte("abcd")})
+	r.push(Chunk{Offset: 4, Data: []byte("efgh")})
+	r.push(Chunk{Offset: 8, Data: []byte("ij")})
+	if got := r.start(); got != 4 {
+		t.Fatalf("ring starts at %d, want 4", got)
+	}
+
+	// The newest chunk stays even if it alone exceeds the budget
+	r.push(Chunk{Offset: 10, Data: []byte("klmnopqrstu")})
+	if got := r.start(); got != 10 || len(r.chunks) != 1 {
+		t.Fatalf("ring starts at %d with %d chunks, want only the oversized chunk at 10", r.start(), len(r.chunks))
+	}
+
+	r = newRing(100)
+	r.push(Chunk{Offset: 0, Data: []byte("abcd")})
+	r.push(Chunk{Offset: 4, Data: []byte("efgh")})
+	since := r.since(2)
+	if len(since) != 2 || since[0].Offset != 2 || string(since[0].Data) != "cd" {
+		t.Fatalf("since(2) = %+v, want the first chunk trimmed to cd", since)
+	}
+	if since := r.since(8); len(since) != 0 {
+		t.Fatalf("since(8) = %+v, want nothing", since)
+	}
+}
+
+func TestSubscribeReplaysAndStreamsLive(t *testing.T) {
+	hub := NewHub(Config{})
+	topic, w, err := hub.OpenWriter("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, w, "one ", "two ")
+
+	s := topic.Subscribe(0)
+	writeAll(t, w, "three")
+	w.Close()
+
+	if got := join(t, collect(t, s)); got != "one two three" {
+		t.Fatalf("subscriber received %q", got)
+	}
+	if topic.Offset() != int64(len("one two three")) {
+		t.Fatalf("topic is at offset %d", topic.Offset())
+	}
+
+	// A closed topic still replays what it retained, then ends
+	if got := join(t, collect(t, topic.Subscribe(4))); got != "two three" {
+		t.Fatalf("subscriber of the closed topic received %q", got)
+	}
+}
+
+func TestSubscribeOutsideTheRetainedWindow(t *testing.T) {
+	hub := NewHub(Config{ReplayBytes: 4})
+	topic, w, err := hub.OpenWriter("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, w, "abcd", "efgh")
+
+	// Before the window starts at what is still retained
+	before := topic.Subscribe(0)
+	// Beyond the end gets only what is published from now on
+	beyond := topic.Subscribe(100)
+	writeAll(t, w, "ij")
+	w.Close()
+
+	chunks := collect(t, before)
+	if len(chunks) == 0 || chunks[0].Offset != 4 || join(t, chunks) != "efghij" {
+		t.Fatalf("subscriber from before the window received %+v", chunks)
+	}
+	chunks = collect(t, beyond)
+	if len(chunks) != 1 || chunks[0].Offset != 8 || string(chunks[0].Data) != "ij" {
+		t.Fatalf("subscriber from beyond the end received %+v", chunks)
+	}
+}
+
+func TestSubscribeTail(t *testing.T) {
+	hub := NewHub(Config{})
+	topic, w, err := hub.OpenWriter("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, w, "hello ", "world")
+	w.Close()
+
+	if got := join(t, collect(t, topic.SubscribeTail(3))); got != "rld" {
+		t.Fatalf("tail of 3 bytes is %q", got)
+	}
+	if got := join(t, collect(t, topic.SubscribeTail(100))); got != "hello world" {
+		t.Fatalf("tail longer than the stream is %q", got)
+	}
+}
+
+func TestSpillReplaysWhatTheRingEvicted(t *testing.T) {
+	dir := t.TempDir()
+	hub := NewHub(Config{ReplayBytes: 4, SpillDir: dir})
+	r, w := io.Pipe()
+	topic, err := hub.Open("room/../topic", r, Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, w, "abcd", "efgh", "ijkl")
+	// Writes to the pipe return once read, before they are published
+	for deadline := time.Now().Add(5 * time.Second); topic.Offset() < 12; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("topic only published %d bytes", topic.Offset())
+		}
+	}
+
+	// Spilled output comes first, then the ring, without overlapping
+	s := topic.Subscribe(2)
+	writeAll(t, w, "mn")
+	w.Close()
+	chunks := collect(t, s)
+	if chunks[0].Offset != 2 || join(t, chunks) != "cdefghijklmn" {
+		t.Fatalf("subscriber received %+v", chunks)
+	}
+
+	// The topic id cannot place the spill file outside the directory
+	files, _ := filepath.Glob(filepath.Join(dir, "*.spill"))
+	if len(files) != 1 {
+		t.Fatalf("spill files %v, want one in %s", files, dir)
+	}
+	hub.Remove("room/../topic")
+	if _, err := os.Stat(files[0]); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("spill file left behind after Remove: %v", err)
+	}
+}
+
+func TestReadSpillTrims(t *testing.T) {
+	var buf bytes.Buffer
+	for i, data := range []string{"abcd", "efgh", "ijkl"} {
+		var header [spillHeaderSize]byte
+		header[3] = byte(len(data))
+		header[4] = byte(Stdout + Kind(i%2))
+		buf.Write(header[:])
+		buf.WriteString(data)
+	}
+
+	var chunks []Chunk
+	err := readSpill(&buf, 2, 10, func(c Chunk) bool {
+		chunks = append(chunks, c)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := join(t, chunks); got != "cdefghij" || chunks[0].Offset != 2 || chunks[1].Stream != Stderr {
+		t.Fatalf("readSpill(2, 10) = %+v", chunks)
+	}
+}
+
+func TestSlowSubscribersAreDropped(t *testing.T) {
+	hub := NewHub(Config{})
+	topic, w, err := hub.OpenWriter("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := topic.Subscribe(0)
+	fast := topic.Subscribe(0)
+
+	// slow reads nothing, so its buffer fills up while fast keeps up with every chunk
+	total := DefaultSubscriberBuffer + 10
+	for i := 0; i < total; i++ {
+		writeAll(t, w, "x")
+		select {
+		case <-fast.Chunks():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fast subscriber did not receive chunk %d", i)
+		}
+	}
+
+	if chunks := collect(t, slow); !slow.Lagged() || len(chunks) >= total {
+		t.Fatalf("slow subscriber received %d of %d chunks, lagged %v", len(chunks), total, slow.Lagged())
+	}
+	w.Close()
+	if chunks := collect(t, fast); len(chunks) != 0 || fast.Lagged() {
+		t.Fatalf("fast subscriber received %d more chunks, lagged %v", len(chunks), fast.Lagged())
+	}
+}
+
+func TestUnsubscribeEndsDelivery(t *testing.T) {
+	hub := NewHub(Config{})
+	topic, w, err := hub.OpenWriter("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s := topic.Subscribe(0)
+	writeAll(t, w, "a")
+	s.Close()
+	collect(t, s)
+	if s.Lagged() {
+		t.Fatal("unsubscribing marked the subscriber as lagged")
+	}
+}
+
+func TestReopenContinuesOffsets(t *testing.T) {
+	hub := NewHub(Config{})
+	r, w := io.Pipe()
+	topic, err := hub.Open("topic", r, Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hub.Open("topic", r, Raw); !errors.Is(err, ErrTopicExists) {
+		t.Fatalf("opening the topic twice: %v", err)
+	}
+	first := topic.Subscribe(0)
+	writeAll(t, w, "first run\n")
+
+	// A live topic cannot be reopened
+	if _, err := hub.Reopen("topic", io.NopCloser(&bytes.Buffer{}), Raw); !errors.Is(err, ErrTopicExists) {
+		t.Fatalf("reopening a live topic: %v", err)
+	}
+
+	w.Close()
+	<-topic.Done()
+	if got := join(t, collect(t, first)); got != "first run\n" {
+		t.Fatalf("first run is %q", got)
+	}
+
+	r, w = io.Pipe()
+	reopened, err := hub.Reopen("topic", r, Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened != topic {
+		t.Fatal("Reopen returned another topic")
+	}
+	from := topic.Offset()
+	second := topic.Subscribe(from)
+	writeAll(t, w, "second run\n")
+	w.Close()
+
+	chunks := collect(t, second)
+	if len(chunks) == 0 || chunks[0].Offset != from || join(t, chunks) != "second run\n" {
+		t.Fatalf("second run is %+v, want it to start at %d", chunks, from)
+	}
+	if got := join(t, collect(t, topic.Subscribe(0))); got != "first run\nsecond run\n" {
+		t.Fatalf("replay across runs is %q", got)
+	}
+}
+
+func TestDemuxSeparatesStreams(t *testing.T) {
+	hub := NewHub(Config{})
+	demux := func(stdout, stderr io.Writer, src io.Reader) error {
+		fmt.Fprint(stdout, "out")
+		fmt.Fprint(stderr, "err")
+		return nil
+	}
+	topic, err := hub.Open("topic", io.NopCloser(&bytes.Buffer{}), demux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-topic.Done()
+
+	chunks := collect(t, topic.Subscribe(0))
+	if len(chunks) != 2 || chunks[0].Stream != Stdout || chunks[1].Stream != Stderr || chunks[1].Offset != 3 {
+		t.Fatalf("chunks %+v, want stdout then stderr at offset 3", chunks)
+	}
+}
@@ -0,0 +1,55 @@
+package stream
+
+// ring retains the most recent chunks of a topic up to a byte budget
+type ring struct {
+	max    int
+	size   int
+	end    int64 // Offset just past the newest chunk ever pushed
+	chunks []Chunk
+}
+
+func newRing(max int) *ring {
+	return &ring{max: max}
+}
+
+// push appends a chunk and evicts the oldest ones until the ring fits its budget again.
+// The newest chunk is always kept, even if it alone is larger than the budget.
+func (r *ring) push(c Chunk) {
+	r.chunks = append(r.chunks, c)
+	r.size += len(c.Data)
+	r.end = c.End()
+
+	drop := 0
+	for r.size > r.max && drop < len(r.chunks)-1 {
+		r.size -= len(r.chunks[drop].Data)
+		drop++
+	}
+	if drop > 0 {
+		// Copy instead of reslicing so evicted chunks can be garbage collected
+		r.chunks = append([]Chunk(nil), r.chunks[drop:]...)
+	}
+}
+
+// start returns the offset of the oldest retained byte
+func (r *ring) start() int64 {
+	if len(r.chunks) == 0 {
+		return r.end
+	}
+	return r.chunks[0].Offset
+}
+
+// since returns the retained chunks covering offset from onwards, trimming the first
+// one so that nothing before from is included
+func (r *ring) since(from int64) []Chunk {
+	var out []Chunk
+	for _, c := range r.chunks {
+		if c.End() <= from {
+			continue
+		}
+		if c.Offset < from {
+			c = Chunk{Offset: from, Stream: c.Stream, Data: c.Data[from-c.Offset:]}
+		}
+		out = append(out, c)
+	}
+	return out
+}
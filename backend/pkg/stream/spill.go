@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const spillHeaderSize = 5
+
+// errStopped is returned by readSpill when the subscriber went away mid-replay
+var errStopped = errors.New("replay stopped")
+
+// spill keeps the full output of a topic on disk so that replay is not limited
+// by the in-memory ring. Each chunk is stored as a 4 byte big-endian length and
+// a 1 byte Kind followed by its data; offsets are implied by the running total.
+type spill struct {
+	file *os.File
+	size int64 // Bytes written to file, guarded by the owning topic's lock
+}
+
+func newSpill(dir, id string) (*spill, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Topic ids come from room ids and image names, keep them from escaping dir
+	name := strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(id) + ".spill"
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &spill{file: file}, nil
+}
+
+func (s *spill) write(c Chunk) error {
+	var header [spillHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(c.Data)))
+	header[4] = byte(c.Stream)
+	if _, err := s.file.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := s.file.Write(c.Data); err != nil {
+		return err
+	}
+	s.size += int64(len(header) + len(c.Data))
+	return nil
+}
+
+// section returns a reader over everything written so far. Later writes only
+// append, so it stays valid while the topic keeps publishing.
+func (s *spill) section() *io.SectionReader {
+	return io.NewSectionReader(s.file, 0, s.size)
+}
+
+func (s *spill) remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// readSpill replays the chunks stored in r that cover offsets [from, until)
+func readSpill(r io.Reader, from, until int64, send func(Chunk) bool) error {
+	var offset int64
+	var header [spillHeaderSize]byte
+	for offset < until {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read spill header: %w", err)
+		}
+		n := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := Kind(header[4])
+
+		if offset+n <= from {
+			if _, err := io.CopyN(io.Discard, r, n); err != nil {
+				return fmt.Errorf("failed to skip spilled chunk: %w", err)
+			}
+			offset += n
+			continue
+		}
+
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("failed to read spilled chunk: %w", err)
+		}
+		c := Chunk{Offset: offset, Stream: kind, Data: data}
+		offset += n
+
+		// Trim to [from, until) so nothing overlaps the in-memory backlog
+		if c.Offset < from {
+			c = Chunk{Offset: from, Stream: c.Stream, Data: c.Data[from-c.Offset:]}
+		}
+		if c.End() > until {
+			c.Data = c.Data[:until-c.Offset]
+		}
+		if !send(c) {
+			return errStopped
+		}
+	}
+	return nil
+}
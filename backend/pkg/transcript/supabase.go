@@ -0,0 +1,54 @@
+package transcript
+
+import (
+	"fmt"
+
+	"github.com/supabase-community/postgrest-go"
+	"github.com/supabase-community/supabase-go"
+)
+
+// chunksTable holds one row per persisted batch, see README for the schema
+const chunksTable = "terminal_output_chunks"
+
+// rowsPageSize matches the default maximum number of rows PostgREST returns per request
+const rowsPageSize = 1000
+
+// SupabaseStore keeps transcript rows in Supabase
+type SupabaseStore struct {
+	client *supabase.Client
+}
+
+// NewSupabaseStore creates a store backed by the given Supabase client
+func NewSupabaseStore(client *supabase.Client) *SupabaseStore {
+	return &SupabaseStore{client: client}
+}
+
+// Append inserts rows. Rows already stored by an earlier retry are merged instead of duplicated.
+func (s *SupabaseStore) Append(rows []Row) error {
+	_, _, err := s.client.From(chunksTable).Insert(rows, true, "room_id,stream_id,offset", "minimal", "").Execute()
+	if err != nil {
+		return fmt.Errorf("failed to append transcript rows: %w", err)
+	}
+	return nil
+}
+
+// Rows returns every row of a room in the order it was appended
+func (s *SupabaseStore) Rows(roomID string) ([]Row, error) {
+	var rows []Row
+	for from := 0; ; from += rowsPageSize {
+		var page []Row
+		_, err := s.client.From(chunksTable).
+			Select("room_id,stream_id,stream,offset,data", "", false).
+			Eq("room_id", roomID).
+			Order("id", &postgrest.OrderOpts{Ascending: true}).
+			Range(from, from+rowsPageSize-1, "").
+			ExecuteTo(&page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read transcript rows: %w", err)
+		}
+		rows = append(rows, page...)
+		if len(page) < rowsPageSize {
+			return rows, nil
+		}
+	}
+}
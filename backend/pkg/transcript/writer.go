@@ -0,0 +1,217 @@
+// Package transcript persists container output as append-only rows so the full
+// terminal history of a room can be rebuilt without rewriting it on every chunk.
+package transcript
+
+import (
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ICBasecamp/K0/backend/pkg/stream"
+)
+
+const (
+	DefaultFlushInterval = 500 * time.Millisecond // Longest time output waits before being persisted
+	DefaultFlushBytes    = 16 * 1024              // Batch size that triggers an early flush
+	maxPendingRows       = 256                    // Failed batches kept for retry before the oldest are dropped
+)
+
+// Row is one persisted batch of output
+type Row struct {
+	RoomID   string `json:"room_id"`
+	StreamID string `json:"stream_id"` // Topic the output came from, a room can run several containers over time
+	Stream   string `json:"stream"`    // stdout or stderr
+	Offset   int64  `json:"offset"`    // Stream offset of the first byte in the batch
+	Data     string `json:"data"`      // Terminal output including ANSI escape sequences
+}
+
+// Store appends rows and reads them back in the order they were appended.
+// Appending a row that already exists (same room, stream and offset) must be a no-op.
+type Store interface {
+	Append(rows []Row) error
+	Rows(roomID string) ([]Row, error)
+}
+
+// Writer batches the output of a topic by time and size and appends it to a Store
+type Writer struct {
+	Store         Store
+	RoomID        string
+	FlushInterval time.Duration
+	FlushBytes    int
+	Encode        func([]byte) string // Turns raw output into storable text
+	From          int64               // Stream offset to start at, output before it is already persisted
+
+	pending []Row
+}
+
+// NewWriter creates a writer with the default batching settings
+func NewWriter(store Store, roomID string) *Writer {
+	return &Writer{
+		Store:         store,
+		RoomID:        roomID,
+		FlushInterval: DefaultFlushInterval,
+		FlushBytes:    DefaultFlushBytes,
+		Encode:        toText,
+	}
+}
+
+// batch is output of a single stream received but not yet persisted
+type batch struct {
+	stream stream.Kind
+	offset int64
+	end    int64
+	data   []byte
+	heldN  int // Bytes at the start of data carried over from an earlier batch, see held
+
+	// An incomplete UTF-8 sequence at the end of a flushed batch is held back and written
+	// with the next batch of the same stream, so characters split across batches survive
+	held map[stream.Kind]heldBytes
+}
+
+// heldBytes is the start of a character whose remaining bytes have not arrived yet
+type heldBytes struct {
+	offset int64
+	data   []byte
+}
+
+// Run persists everything published to topic until it ends. It does not depend on any
+// viewer being connected; if it falls behind it resumes from the last byte it received.
+func (w *Writer) Run(topic *stream.Topic) {
+	ticker := time.NewTicker(w.FlushInterval)
+	defer ticker.Stop()
+
+	b := &batch{end: w.From, held: make(map[stream.Kind]heldBytes)}
+	for {
+		sub := topic.Subscribe(b.end)
+		w.drain(topic.ID(), sub, b, ticker.C)
+		if !sub.Lagged() {
+			break
+		}
+		log.Printf("Transcript writer for room %s fell behind, resuming from offset %d", w.RoomID, b.end)
+	}
+
+	w.flush(topic.ID(), b, true)
+}
+
+// drain consumes sub until its channel is closed, flushing whenever the batch is full or old enough
+func (w *Writer) drain(streamID string, sub *stream.Subscriber, b *batch, tick <-chan time.Time) {
+	defer sub.Close()
+
+	for {
+		select {
+		case chunk, ok := <-sub.Chunks():
+			if !ok {
+				return
+			}
+			// Output older than the topic retains may have been skipped, never merge across a gap
+			// or mix stdout and stderr in one row. Characters split by a gap cannot be completed.
+			if chunk.Offset != b.end {
+				w.flush(streamID, b, true)
+			} else if len(b.data) > 0 && chunk.Stream != b.stream {
+				w.flush(streamID, b, false)
+			}
+			if len(b.data) == 0 {
+				b.offset = chunk.Offset
+				b.stream = chunk.Stream
+				if h, ok := b.held[chunk.Stream]; ok {
+					delete(b.held, chunk.Stream)
+					b.offset = h.offset
+					b.data = append(b.data, h.data...)
+					b.heldN = len(h.data)
+				}
+			}
+			b.data = append(b.data, chunk.Data...)
+			b.end = chunk.End()
+			if len(b.data) >= w.FlushBytes {
+				w.flush(streamID, b, false)
+			}
+		case <-tick:
+			w.flush(streamID, b, false)
+		}
+	}
+}
+
+// flush turns the batch into a row and appends it together with any rows that failed before.
+// Unless the stream ended, an incomplete character at the end of the batch is held back.
+func (w *Writer) flush(streamID string, b *batch, final bool) {
+	if len(b.data) > 0 && !final {
+		if n := incompleteTail(b.data); n > 0 {
+			cut := len(b.data) - n
+			offset := b.end - int64(n)
+			if cut < b.heldN {
+				offset = b.offset + int64(cut) // Still within the bytes held before
+			}
+			b.held[b.stream] = heldBytes{offset: offset, data: append([]byte(nil), b.data[cut:]...)}
+			b.data = b.data[:cut]
+		}
+	}
+	w.addRow(streamID, b.stream, b.offset, b.data)
+	b.data, b.heldN = nil, 0
+
+	// Nothing can complete what is held once the stream ended
+	if final {
+		for kind, h := range b.held {
+			w.addRow(streamID, kind, h.offset, h.data)
+			delete(b.held, kind)
+		}
+	}
+	if len(w.pending) == 0 {
+		return
+	}
+
+	if err := w.Store.Append(w.pending); err != nil {
+		log.Printf("Error persisting terminal output for room %s: %v", w.RoomID, err)
+		if len(w.pending) > maxPendingRows {
+			log.Printf("Dropping %d unpersisted terminal output batches for room %s", len(w.pending)-maxPendingRows, w.RoomID)
+			w.pending = append([]Row(nil), w.pending[len(w.pending)-maxPendingRows:]...)
+		}
+		return
+	}
+	w.pending = nil
+}
+
+// addRow queues output for the store unless there is none
+func (w *Writer) addRow(streamID string, kind stream.Kind, offset int64, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	w.pending = append(w.pending, Row{
+		RoomID:   w.RoomID,
+		StreamID: streamID,
+		Stream:   kind.String(),
+		Offset:   offset,
+		Data:     w.Encode(data),
+	})
+}
+
+// incompleteTail returns the length of a UTF-8 sequence cut off at the end of data, 0 if the
+// last character is complete. Invalid bytes count as complete, they never become valid.
+func incompleteTail(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if utf8.FullRune(data[i:]) {
+				return 0
+			}
+			return len(data) - i
+		}
+	}
+	return 0
+}
+
+// Rebuild concatenates rows into the full transcript
+func Rebuild(rows []Row) string {
+	var sb strings.Builder
+	for _, row := range rows {
+		sb.WriteString(row.Data)
+	}
+	return sb.String()
+}
+
+// toText makes raw output safe to store in a text column. Escape sequences are kept so
+// the transcript can be rendered by a terminal emulator; only NUL bytes and invalid UTF-8,
+// which Postgres text cannot hold, are dropped. Writer never splits a character between
+// two calls, so only output that really is invalid is lost.
+func toText(data []byte) string {
+	return strings.ToValidUTF8(strings.ReplaceAll(string(data), "\x00", ""), "")
+}
@@ -0,0 +1,96 @@
+package transcript
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ICBasecamp/K0/backend/pkg/stream"
+)
+
+// memoryStore keeps rows in memory, ignoring rows appended twice like SupabaseStore
+type memoryStore struct {
+	mu   sync.Mutex
+	rows []Row
+}
+
+func (s *memoryStore) Append(rows []Row) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, row := range rows {
+		duplicate := false
+		for _, existing := range s.rows {
+			duplicate = duplicate || (existing.StreamID == row.StreamID && existing.Offset == row.Offset)
+		}
+		if !duplicate {
+			s.rows = append(s.rows, row)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Rows(roomID string) ([]Row, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Row(nil), s.rows...), nil
+}
+
+func TestWriterKeepsCharactersSplitAcrossBatches(t *testing.T) {
+	hub := stream.NewHub(stream.Config{ReplayBytes: 1 << 20})
+	topic, w, err := hub.OpenWriter("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memoryStore{}
+	writer := NewWriter(store, "room")
+	writer.FlushBytes = 4 // Every write fills a batch
+	writer.FlushInterval = time.Hour
+	done := make(chan struct{})
+	go func() {
+		writer.Run(topic)
+		close(done)
+	}()
+
+	// "héllo wörld ✓" written so that every multibyte character is cut in two
+	want := "héllo wörld ✓"
+	data := []byte(want)
+	for _, part := range [][]byte{data[:2], data[2:9], data[9:15], data[15:]} {
+		if _, err := w.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	<-done
+
+	rows, _ := store.Rows("room")
+	if got := Rebuild(rows); got != want {
+		t.Fatalf("transcript is %q, want %q", got, want)
+	}
+	offsets := make(map[int64]bool)
+	for _, row := range rows {
+		if offsets[row.Offset] {
+			t.Fatalf("two rows start at offset %d", row.Offset)
+		}
+		offsets[row.Offset] = true
+	}
+}
+
+func TestIncompleteTail(t *testing.T) {
+	check := []byte("✓") // 3 bytes
+	for _, tc := range []struct {
+		data []byte
+		want int
+	}{
+		{[]byte("abc"), 0},
+		{check, 0},
+		{check[:1], 1},
+		{check[:2], 2},
+		{append([]byte("a"), check[:2]...), 2},
+		{[]byte{0xff}, 0}, // Invalid, never completed
+	} {
+		if got := incompleteTail(tc.data); got != tc.want {
+			t.Errorf("incompleteTail(%q) = %d, want %d", tc.data, got, tc.want)
+		}
+	}
+}
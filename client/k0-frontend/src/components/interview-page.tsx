@@ -151,16 +151,20 @@ export const InterviewPage = ({ roomId }: { roomId: string }) => {
 
     useEffect(() => {
 
+        // load what has been persisted so far, then append new chunks as they are inserted
+        axios.get(`${process.env.NEXT_PUBLIC_BACKEND_URL}/rooms/${roomId}/transcript`)
+            .then(res => setLogs(res.data))
+            .catch(err => console.error("Error loading transcript:", err))
+
         const channel = supabase.channel('room-updates')
         .on(
             'postgres_changes',
-            { event: 'UPDATE', schema: 'public', table: 'running_rooms', filter: `id=eq.${roomId}` },
+            { event: 'INSERT', schema: 'public', table: 'terminal_output_chunks', filter: `room_id=eq.${roomId}` },
             (payload) => {
                 if (socket) {
                     return;
                 }
-                setLogs(payload.new.terminal_output)
-                // console.log('Room updated:', payload);
+                setLogs(prevLogs => prevLogs + payload.new.data)
             }
         )
         .subscribe()